@@ -10,7 +10,10 @@ import (
 	"syscall"
 
 	"github.com/whynullname/go-collect-metrics/internal/agent"
+	"github.com/whynullname/go-collect-metrics/internal/agent/grpcsender"
+	"github.com/whynullname/go-collect-metrics/internal/agent/spool"
 	config "github.com/whynullname/go-collect-metrics/internal/configs/agentconfig"
+	"github.com/whynullname/go-collect-metrics/internal/envelope"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
 	"github.com/whynullname/go-collect-metrics/internal/rsareader"
@@ -37,15 +40,43 @@ func main() {
 	cfg := config.NewAgentConfig()
 	cfg.ParseFlags()
 
-	if err := cfg.ReadRSA(); !errors.Is(err, rsareader.ErrEmptyKeyPath) {
+	if err := cfg.ReadRSA(); err != nil && !errors.Is(err, rsareader.ErrEmptyKeyPath) {
 		return
 	}
 
+	if cfg.RSAKey != nil {
+		logger.Log.Infof("Encrypt metrics with RSA key %s", envelope.KeyID(cfg.RSAKey))
+	}
+
 	repo := inmemory.NewInMemoryRepository()
 	metricsUseCase := metrics.NewMetricUseCase(repo)
-	instance := agent.NewAgent(metricsUseCase, cfg)
+	var agentOpts []agent.Option
+	switch cfg.Transport {
+	case config.TransportHTTP:
+		logger.Log.Infof("Start agent, try work with server in %s \n", cfg.EndPointAdress)
+	case config.TransportGRPC:
+		grpcSender, err := grpcsender.NewGRPCSender(cfg.GRPCAdress, cfg.HashKey)
+		if err != nil {
+			logger.Log.Errorf("Fail create grpc sender! Error: %s", err.Error())
+			return
+		}
+		agentOpts = append(agentOpts, agent.WithGRPCSender(grpcSender))
+		logger.Log.Infof("Start agent, try work with grpc server in %s \n", cfg.GRPCAdress)
+	default:
+		logger.Log.Errorf("Unknown transport %s", cfg.Transport)
+		return
+	}
+
+	if cfg.SpoolDir != "" {
+		metricsSpool, err := spool.Open(cfg.SpoolDir, spool.WithMaxBytes(cfg.SpoolMaxBytes), spool.WithMaxAge(cfg.SpoolMaxAge))
+		if err != nil {
+			logger.Log.Errorf("Fail open spool! Error: %s", err.Error())
+			return
+		}
+		agentOpts = append(agentOpts, agent.WithSpool(metricsSpool))
+	}
 
-	logger.Log.Infof("Start agent, try work with server in %s \n", cfg.EndPointAdress)
+	instance := agent.NewAgent(metricsUseCase, cfg, agentOpts...)
 	ctx, cancel := context.WithCancel(context.Background())
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/whynullname/go-collect-metrics/internal/alerting"
 	config "github.com/whynullname/go-collect-metrics/internal/configs/serverconfig"
+	"github.com/whynullname/go-collect-metrics/internal/grpcserver"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
 	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
 	"github.com/whynullname/go-collect-metrics/internal/repository/postgres"
+	"github.com/whynullname/go-collect-metrics/internal/repository/sqlite"
 	"github.com/whynullname/go-collect-metrics/internal/rsareader"
 	"github.com/whynullname/go-collect-metrics/internal/server"
+	"github.com/whynullname/go-collect-metrics/internal/server/handlers"
+	"github.com/whynullname/go-collect-metrics/internal/statsd"
 	"github.com/whynullname/go-collect-metrics/internal/storage/filestorage"
 	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
 
@@ -28,6 +38,12 @@ var (
 	buildCommit  string = "N/A"
 )
 
+// historyCleanupInterval как часто удалять устаревшую историю и ключи идемпотентности:
+// десятая часть срока хранения, но не чаще раза в секунду.
+func historyCleanupInterval(retention time.Duration) time.Duration {
+	return max(retention/10, time.Second)
+}
+
 func main() {
 	err := logger.Initialize("info")
 	if err != nil {
@@ -35,6 +51,14 @@ func main() {
 		return
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			logger.Log.Errorf("Migrate failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger.Log.Infof("Build version: %s", buildVersion)
 	logger.Log.Infof("Build date: %s", buildDate)
 	logger.Log.Infof("Build commit: %s", buildCommit)
@@ -42,47 +66,307 @@ func main() {
 	cfg := config.NewServerConfig()
 	cfg.ParseFlags()
 
-	if err := cfg.ReadRSA(); !errors.Is(err, rsareader.ErrEmptyKeyPath) {
+	if err := cfg.ReadRSA(); err != nil && !errors.Is(err, rsareader.ErrEmptyKeyPath) {
+		logger.Log.Errorf("Can't read RSA keys from %s: %v", cfg.RSAPrivateKeyPath, err)
 		return
 	}
 
+	// без ключа gRPC нечем проверять вызовы, а строгий режим обещает отклонять неподписанные
+	if cfg.HashStrict && cfg.HashKey == "" && cfg.GRPCAdress != "" {
+		logger.Log.Errorf("Refuse to start grpc server: hash-strict requires key for sha hash")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if cfg.RSAPrivateKeyPath != "" {
+		logger.Log.Infof("Loaded RSA keys: %v", cfg.RSAKeys.IDs())
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go reloadRSAKeys(ctx, cfg, reload)
+	}
+
 	var repo repository.Repository
+	var selfMetrics metrics.SelfMetricsSource
 	if cfg.PostgressAdress == "" {
-		repo = inmemory.NewInMemoryRepository()
+		var opts []inmemory.Option
+		if cfg.HistoryRetention > 0 {
+			opts = append(opts, inmemory.WithHistory())
+		}
+		repo = inmemory.NewInMemoryRepository(opts...)
+	} else if sqlite.IsDSN(cfg.PostgressAdress) {
+		var opts []sqlite.Option
+		if cfg.HistoryRetention > 0 {
+			opts = append(opts, sqlite.WithHistory())
+		}
+		repo, err = sqlite.NewSQLiteRepo(cfg.PostgressAdress, opts...)
+		if err != nil {
+			logger.Log.Fatalln(err)
+			return
+		}
 	} else {
-		repo, err = postgres.NewPostgresRepo(cfg.PostgressAdress)
+		opts := []postgres.Option{postgres.WithPoolConfig(postgres.PoolConfig{
+			MaxConns:               int32(cfg.DBMaxConns),
+			MinConns:               int32(cfg.DBMinConns),
+			ConnectTimeout:         cfg.DBConnectTimeout,
+			HealthCheckPeriod:      cfg.DBHealthCheck,
+			PingTimeout:            cfg.DBPingTimeout,
+			StatementCacheCapacity: cfg.DBStatementCache,
+		})}
+		if cfg.HistoryRetention > 0 {
+			opts = append(opts, postgres.WithHistory())
+		}
+		postgresRepo, err := postgres.NewPostgresRepo(cfg.PostgressAdress, opts...)
 		if err != nil {
 			logger.Log.Fatalln(err)
 			return
 		}
+		repo = postgresRepo
+		selfMetrics = postgresRepo.PoolStats
 	}
 	defer repo.CloseRepository()
-	metricsUseCase := metrics.NewMetricUseCase(repo)
-	server := server.NewServer(metricsUseCase, cfg, repo.PingRepo)
-	fileStorage, err := filestorage.NewFileStorage(cfg.FileStoragePath)
 
+	snapshotCodec, err := filestorage.CodecByName(cfg.StoreFormat)
 	if err != nil {
 		logger.Log.Errorf("Fail initialize file storage! Error: %s", err.Error())
 		return
 	}
 
-	if cfg.RestoreData {
-		fileStorage.ReadAllMetrics(repo)
+	snapshotKeys, err := readSnapshotKeys(cfg)
+	if err != nil {
+		logger.Log.Errorf("Fail read snapshot encryption keys! Error: %s", err.Error())
+		return
+	}
+	if len(snapshotKeys) > 0 {
+		logger.Log.Infof("Metrics snapshot is encrypted with key %s", snapshotKeys[0].ID)
 	}
 
+	storageOpts := []filestorage.Option{
+		filestorage.WithCodec(snapshotCodec),
+		filestorage.WithSyncInterval(cfg.WALSyncInterval),
+		filestorage.WithEncryption(snapshotKeys...),
+		filestorage.WithBackups(cfg.SnapshotBackups, cfg.SnapshotMaxAge),
+	}
+	migratePlaintext := cfg.StoreAllowPlaintext && len(snapshotKeys) > 0
+	if migratePlaintext {
+		storageOpts = append(storageOpts, filestorage.WithPlaintextMigration())
+	}
+	fileStorage, err := filestorage.NewFileStorage(cfg.FileStoragePath, storageOpts...)
+	if err != nil {
+		logger.Log.Errorf("Fail initialize file storage! Error: %s", err.Error())
+		return
+	}
+
+	if cfg.RestoreFrom != "" {
+		// явно запрошенную точку восстановления нельзя молча заменить пустым состоянием
+		backup, err := fileStorage.RestoreFrom(repo, cfg.RestoreFrom)
+		if err != nil {
+			logger.Log.Errorf("Fail restore metrics from %s! Error: %s", cfg.RestoreFrom, err.Error())
+			return
+		}
+		logger.Log.Infof("Restored metrics from snapshot %s taken at %s", backup.Path, backup.Time.Format(time.RFC3339))
+	} else if cfg.RestoreData {
+		err := fileStorage.ReadAllMetrics(repo)
+		if errors.Is(err, filestorage.ErrPlaintext) {
+			// иначе следующий снимок заменил бы открытые данные пустыми
+			logger.Log.Errorf("Fail restore metrics: %s. Start once with store-allow-plaintext to encrypt them", err.Error())
+			return
+		}
+		if err != nil {
+			logger.Log.Errorf("Fail restore metrics from file storage! Error: %s", err.Error())
+		}
+	}
+	if migratePlaintext {
+		// открытые снимок и журнал сразу переписываются зашифрованными, дальше флаг миграции не нужен
+		if err := fileStorage.WriteMetrics(repo); err != nil {
+			logger.Log.Errorf("Fail rewrite metrics snapshot encrypted! Error: %s", err.Error())
+			return
+		}
+		logger.Log.Infof("Metrics snapshot is rewritten encrypted, store-allow-plaintext can be removed")
+	}
+	switch {
+	case cfg.PostgressAdress != "":
+		// Postgres и SQLite сами сохраняют каждое обновление, файловое хранилище для них пишет только снимки
+	case cfg.StoreInterval == 0:
+		// снимок пишется после каждого обновления, журнал между снимками не нужен
+		repo = fileStorage.Synchronous(repo)
+	default:
+		// обновления идут через журнал, чтобы не потерять их между снимками
+		repo = fileStorage.Journal(repo)
+	}
+
+	metricsUseCase := metrics.NewMetricUseCase(repo, metrics.WithHistogramBuckets(cfg.HistogramBuckets))
+	if cfg.HistoryRetention > 0 {
+		go metricsUseCase.RunHistoryRetention(ctx, cfg.HistoryRetention, historyCleanupInterval(cfg.HistoryRetention))
+	}
+	go metricsUseCase.RunIdempotencyRetention(ctx, cfg.IdempotencyTTL, historyCleanupInterval(cfg.IdempotencyTTL))
+	if selfMetrics != nil && cfg.SelfMetricsInterval > 0 {
+		go metricsUseCase.RunSelfMetrics(ctx, cfg.SelfMetricsInterval, selfMetrics)
+	}
+	var handlersOpts []handlers.Option
+	var alertDispatcher *alerting.Dispatcher
+	if cfg.AlertRulesPath != "" {
+		rules, err := alerting.LoadRules(cfg.AlertRulesPath)
+		if err != nil {
+			logger.Log.Errorf("Fail load alerting rules! Error: %s", err.Error())
+			return
+		}
+
+		var managerOpts []alerting.ManagerOption
+		if notifiers := alertNotifiers(cfg); len(notifiers) > 0 {
+			alertDispatcher = alerting.NewDispatcher(notifiers, alerting.WithGroupWait(cfg.AlertGroupWait))
+			go alertDispatcher.Run(ctx)
+			managerOpts = append(managerOpts, alerting.WithDispatcher(alertDispatcher))
+		}
+
+		alertManager := alerting.NewManager(rules, metricsUseCase, cfg.AlertInterval, managerOpts...)
+		go alertManager.Run(ctx)
+		handlersOpts = append(handlersOpts, handlers.WithAlerts(alertManager))
+		logger.Log.Infof("Loaded %d alerting rules from %s", len(rules), cfg.AlertRulesPath)
+	}
+
+	handlersOpts = append(handlersOpts, handlers.WithSnapshots(snapshotter{storage: fileStorage, repo: repo}))
+	server := server.NewServer(metricsUseCase, cfg, repo.PingRepo, handlersOpts...)
 	go fileStorage.RecordMetric(cfg.StoreInterval, repo)
 
+	var grpcServer *grpcserver.Server
+	if cfg.GRPCAdress != "" {
+		var grpcOpts []grpcserver.Option
+		if cfg.HashKey != "" {
+			grpcOpts = append(grpcOpts, grpcserver.WithAuth(server.Verifier, cfg.HashStrict))
+		}
+		grpcServer = grpcserver.NewServer(metricsUseCase, cfg.GRPCAdress, grpcOpts...)
+		go func() {
+			if err := grpcServer.ListenAndServe(); err != nil {
+				logger.Log.Errorf("grpc server stopped with error: %v", err)
+			}
+		}()
+		logger.Log.Infof("Start grpc server in %s \n", cfg.GRPCAdress)
+	}
+
+	// ingesters принимают метрики не через HTTP и gRPC, при остановке их буферы сбрасываются до финального снимка
+	ingestCtx, stopIngest := context.WithCancel(ctx)
+	defer stopIngest()
+	var ingesters sync.WaitGroup
+	if cfg.StatsDAdress != "" {
+		receiver := statsd.NewReceiver(metricsUseCase, cfg.StatsDAdress, cfg.StatsDFlush, statsd.WithHistogramBuckets(cfg.HistogramBuckets))
+		ingesters.Add(1)
+		go func() {
+			defer ingesters.Done()
+			if err := receiver.ListenAndServe(ingestCtx); err != nil {
+				logger.Log.Errorf("statsd receiver stopped with error: %v", err)
+			}
+		}()
+		logger.Log.Infof("Start statsd receiver in %s \n", cfg.StatsDAdress)
+	}
+
 	logger.Log.Infof("Start server in %s \n", cfg.EndPointAdress)
 
 	exit := make(chan os.Signal, 1)
 	idleConnChan := make(chan struct{}, 1)
 	signal.Notify(exit, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
-	if err := server.ListenAndServe(exit, idleConnChan); err != nil {
+	// ErrServerClosed означает штатную остановку по сигналу, дальше идет завершение работы
+	if err := server.ListenAndServe(exit, idleConnChan); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
 
 	<-idleConnChan
 	close(exit)
 	close(idleConnChan)
+
+	if grpcServer != nil {
+		grpcServer.Shutdown()
+	}
+	stopIngest()
+	ingesters.Wait()
+
+	// после остановки серверов и сброса буферов StatsD обновлений больше нет, финальный снимок содержит все метрики
+	if err := fileStorage.WriteMetrics(repo); err != nil {
+		logger.Log.Errorf("Fail write final metrics snapshot! Error: %s", err.Error())
+	}
+	if err := fileStorage.Close(); err != nil {
+		logger.Log.Errorf("Fail close file storage! Error: %s", err.Error())
+	}
+
+	if alertDispatcher != nil {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), alertFlushTimeout)
+		defer flushCancel()
+		alertDispatcher.Flush(flushCtx)
+		alertDispatcher.Wait()
+	}
+}
+
+// reloadRSAKeys перечитывает закрытые ключи при получении SIGHUP.
+// Если прочитать ключи не удалось, продолжает работать со старым набором.
+func reloadRSAKeys(ctx context.Context, cfg *config.ServerConfig, reload <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			if err := cfg.ReadRSA(); err != nil {
+				logger.Log.Errorf("Can't reload RSA keys, keep old ones: %v", err)
+				continue
+			}
+			logger.Log.Infof("Reloaded RSA keys: %v", cfg.RSAKeys.IDs())
+		}
+	}
+}
+
+// snapshotter сохраняет снимок метрик по запросу /api/v1/admin/snapshot через FileStorage.
+type snapshotter struct {
+	storage *filestorage.FileStorage
+	repo    repository.Repository
+}
+
+func (s snapshotter) Snapshot() (handlers.Snapshot, error) {
+	backup, err := s.storage.Snapshot(s.repo)
+	if errors.Is(err, filestorage.ErrClosed) {
+		return handlers.Snapshot{}, fmt.Errorf("%w: %v", handlers.ErrSnapshotUnavailable, err)
+	}
+	return handlers.Snapshot{Path: backup.Path, Time: backup.Time}, err
+}
+
+// readSnapshotKeys собирает ключи шифрования снимка: сначала из store-key-file, затем выведенные из crypto-key.
+// Снимок шифруется первым ключом, остальные нужны, чтобы прочитать снимок, записанный до смены ключа.
+func readSnapshotKeys(cfg *config.ServerConfig) ([]filestorage.Key, error) {
+	var keys []filestorage.Key
+	if cfg.StoreKeyFile != "" {
+		fileKeys, err := filestorage.ReadKeyFiles(cfg.StoreKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	if cfg.StoreKeyFromRSA {
+		privateKeys, err := rsareader.ReadPrivateRSAKeys(cfg.RSAPrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, privateKey := range privateKeys {
+			key, err := filestorage.DeriveKey(privateKey)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// alertFlushTimeout сколько ждать отправки последних уведомлений при остановке сервера.
+const alertFlushTimeout = 5 * time.Second
+
+func alertNotifiers(cfg *config.ServerConfig) []alerting.Notifier {
+	notifiers := make([]alerting.Notifier, 0, len(cfg.AlertWebhooks)+1)
+	for _, url := range cfg.AlertWebhooks {
+		notifiers = append(notifiers, alerting.NewWebhookNotifier(url, cfg.HashKey))
+	}
+	if cfg.AlertLogPath != "" {
+		notifiers = append(notifiers, alerting.NewFileNotifier(cfg.AlertLogPath))
+	}
+	return notifiers
 }
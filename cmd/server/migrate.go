@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository/postgres/migrations"
+	"github.com/whynullname/go-collect-metrics/internal/repository/sqlite"
+)
+
+const migrateUsage = `usage: server migrate [-d dsn] <command>
+
+commands:
+  up             apply all pending migrations
+  down [steps]   roll back the last steps migrations, 1 by default
+  to <version>   migrate up or down to version, 0 rolls back everything
+  status         print current and latest schema version
+`
+
+var errMigrateUsage = errors.New("bad migrate arguments")
+
+// errSQLiteMigrate схема SQLite обновляется при старте сервера, отдельной команды для нее нет.
+var errSQLiteMigrate = errors.New("migrate supports only postgres, sqlite schema is migrated on server start")
+
+// runMigrate выполняет подкоманду migrate. DSN берется из флага -d или переменной DATABASE_DSN.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), migrateUsage)
+		flags.PrintDefaults()
+	}
+	dsn := flags.String("d", os.Getenv("DATABASE_DSN"), "adress to connect postgres")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dsn == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return errMigrateUsage
+	}
+	if sqlite.IsDSN(*dsn) {
+		return errSQLiteMigrate
+	}
+
+	db, err := sql.Open("pgx", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch command := flags.Arg(0); command {
+	case "up":
+		err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if flags.NArg() > 1 {
+			steps, err = strconv.Atoi(flags.Arg(1))
+			if err != nil || steps <= 0 {
+				return fmt.Errorf("%w: steps must be a positive number", errMigrateUsage)
+			}
+		}
+		err = migrator.Down(ctx, steps)
+	case "to":
+		if flags.NArg() < 2 {
+			return fmt.Errorf("%w: version is required", errMigrateUsage)
+		}
+		version, parseErr := strconv.ParseInt(flags.Arg(1), 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("%w: bad version %s", errMigrateUsage, flags.Arg(1))
+		}
+		err = migrator.To(ctx, version)
+	case "status":
+	default:
+		flags.Usage()
+		return fmt.Errorf("%w: unknown command %s", errMigrateUsage, command)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d, latest %d\n", version, migrator.Latest())
+	return nil
+}
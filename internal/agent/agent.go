@@ -4,12 +4,16 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"runtime"
 	"sync"
 	"time"
 
+	"github.com/whynullname/go-collect-metrics/internal/agent/batcher"
 	"github.com/whynullname/go-collect-metrics/internal/agent/collector"
+	"github.com/whynullname/go-collect-metrics/internal/agent/grpcsender"
 	"github.com/whynullname/go-collect-metrics/internal/agent/sender"
+	"github.com/whynullname/go-collect-metrics/internal/agent/spool"
 	config "github.com/whynullname/go-collect-metrics/internal/configs/agentconfig"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
@@ -17,19 +21,42 @@ import (
 )
 
 type Agent struct {
-	sender    *sender.AgentSender
-	Collector *collector.AgentCollector
-	config    *config.AgentConfig
+	sender     *sender.AgentSender
+	grpcSender *grpcsender.GRPCSender
+	spool      *spool.Spool
+	Collector  *collector.AgentCollector
+	config     *config.AgentConfig
 }
 
-func NewAgent(metricUseCase *metrics.MetricsUseCase, config *config.AgentConfig) *Agent {
+// Option настраивает Agent.
+type Option func(*Agent)
+
+// WithGRPCSender переключает отправку метрик на gRPC.
+func WithGRPCSender(grpcSender *grpcsender.GRPCSender) Option {
+	return func(a *Agent) {
+		a.grpcSender = grpcSender
+	}
+}
+
+// WithSpool включает буферизацию неотправленных метрик на диске.
+func WithSpool(spool *spool.Spool) Option {
+	return func(a *Agent) {
+		a.spool = spool
+	}
+}
+
+func NewAgent(metricUseCase *metrics.MetricsUseCase, config *config.AgentConfig, opts ...Option) *Agent {
 	collector := collector.NewAgentCollector(&runtime.MemStats{}, metricUseCase)
 
-	return &Agent{
+	agent := &Agent{
 		sender:    sender.NewAgentSender(collector, config),
 		Collector: collector,
 		config:    config,
 	}
+	for _, opt := range opts {
+		opt(agent)
+	}
+	return agent
 }
 
 // UpdateMetrics горутина которая каждые config.PollInterval обновляет метрики в репозитории.
@@ -60,11 +87,23 @@ func (a *Agent) SendActualMetrics(ctx context.Context, wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
+	if a.spool != nil {
+		defer a.spool.Close()
+	}
+
+	if a.grpcSender != nil {
+		a.sendByGRPC(ctx, ticker)
+		return
+	}
+
 	var workerWaitGroup sync.WaitGroup
-	jobs := make(chan *repository.Metric, 18)
-	for i := 0; i < a.config.RateLimit; i++ {
+	rateLimit := max(a.config.RateLimit, 1)
+	jobs := make(chan repository.Metric, max(a.config.BatchSize, 1)*rateLimit)
+	batches := make(chan []repository.Metric, rateLimit)
+	go batcher.NewBatcher(a.config.BatchSize, a.config.BatchMaxBytes, a.config.BatchLinger).Run(jobs, batches)
+	for i := 0; i < rateLimit; i++ {
 		workerWaitGroup.Add(1)
-		go a.worker(&workerWaitGroup, jobs)
+		go a.worker(&workerWaitGroup, batches)
 	}
 	for {
 		select {
@@ -73,33 +112,168 @@ func (a *Agent) SendActualMetrics(ctx context.Context, wg *sync.WaitGroup) {
 			workerWaitGroup.Wait()
 			return
 		case <-ticker.C:
-			metricsArray, err := a.Collector.GetAllMetrics()
+			metricsArray, err := a.collectMetrics()
 			if err != nil {
 				continue
 			}
 
-			for _, json := range metricsArray {
+			// пока в очереди на диске есть неотправленные метрики, новые пишутся за ними,
+			// чтобы сервер получил значения в том порядке, в котором они собраны
+			if !a.replaySpool() {
+				a.spoolMetrics(sender.NewBatchKey(), metricsArray)
+				continue
+			}
+
+			for i := range metricsArray {
 				select {
-				case jobs <- &json:
+				case jobs <- metricsArray[i]:
 					// успешно отправлено
+					continue
 				default:
-					logger.Log.Warnf("jobs channel is full, dropping metric %s\n", json.ID)
 				}
+
+				if a.spool == nil {
+					logger.Log.Warnf("jobs channel is full, dropping metric %s\n", metricsArray[i].ID)
+					continue
+				}
+				logger.Log.Warnf("jobs channel is full, spool %d metrics\n", len(metricsArray)-i)
+				a.spoolMetrics(sender.NewBatchKey(), metricsArray[i:])
+				break
 			}
 		}
 	}
 }
 
-func (a *Agent) worker(wg *sync.WaitGroup, metricsToSend <-chan *repository.Metric) {
-	defer wg.Done()
+// sendByGRPC каждый тик отправляет все метрики одним батчем по gRPC.
+func (a *Agent) sendByGRPC(ctx context.Context, ticker *time.Ticker) {
+	defer a.grpcSender.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metricsArray, err := a.collectMetrics()
+			if err != nil {
+				continue
+			}
+
+			key := sender.NewBatchKey()
+			if !a.replaySpool() {
+				a.spoolMetrics(key, metricsArray)
+				continue
+			}
+			if err := a.sendBatch(key, metricsArray); err != nil {
+				logger.Log.Infof("error while send metrics by grpc: %v", err)
+				a.spoolMetrics(key, metricsArray)
+			}
+		}
+	}
+}
+
+// collectMetrics получает метрики из коллектора и проставляет им метки из конфига агента.
+func (a *Agent) collectMetrics() ([]repository.Metric, error) {
+	metricsArray, err := a.Collector.GetAllMetrics()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range metricsArray {
+		a.sender.AttachLabels(&metricsArray[i])
+	}
+	return metricsArray, nil
+}
+
+// sendBatch отправляет батч выбранным транспортом вместе с ключом идемпотентности.
+func (a *Agent) sendBatch(key string, batch []repository.Metric) error {
+	if a.grpcSender != nil {
+		return a.grpcSender.SendMetrics(key, batch)
+	}
+	return a.sender.SendBatchWithKey(key, batch)
+}
 
-	for metric := range metricsToSend {
-		jsonBytes, err := json.Marshal(metric)
+// spooledBatch запись очереди на диске. Ключ сохраняется вместе с батчем,
+// чтобы сервер не применил батч второй раз, если первая отправка все-таки дошла.
+type spooledBatch struct {
+	Key     string              `json:"key"`
+	Metrics []repository.Metric `json:"metrics"`
+}
+
+// decodeSpooledBatch читает запись очереди. Записи старого формата содержат только массив метрик.
+func decodeSpooledBatch(data []byte) (spooledBatch, error) {
+	var batch spooledBatch
+	if err := json.Unmarshal(data, &batch); err == nil {
+		return batch, nil
+	}
+
+	if err := json.Unmarshal(data, &batch.Metrics); err != nil {
+		return batch, err
+	}
+	batch.Key = sender.NewBatchKey()
+	return batch, nil
+}
+
+// spoolMetrics сохраняет метрики в очередь на диске. Без очереди метрики теряются.
+func (a *Agent) spoolMetrics(key string, batch []repository.Metric) {
+	if a.spool == nil || len(batch) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(spooledBatch{Key: key, Metrics: batch})
+	if err != nil {
+		logger.Log.Errorf("Can't marshal metrics for spool: %v", err)
+		return
+	}
+	if err := a.spool.Append(data); err != nil {
+		logger.Log.Errorf("Can't spool %d metrics: %v", len(batch), err)
+	}
+}
+
+// replaySpool отправляет метрики из очереди на диске по порядку.
+// Возвращает true, если очередь пуста и можно отправлять новые метрики.
+func (a *Agent) replaySpool() bool {
+	if a.spool == nil {
+		return true
+	}
+
+	err := a.spool.Replay(func(data []byte) error {
+		batch, err := decodeSpooledBatch(data)
 		if err != nil {
-			logger.Log.Infof("error %s", err.Error())
-		} else {
-			logger.Log.Infof("Send metric %s\n", metric.ID)
-			a.sender.SendJSONWithEncoding(jsonBytes, true)
+			logger.Log.Errorf("Skip broken spool record: %v", err)
+			return nil
+		}
+
+		err = a.sendBatch(batch.Key, batch.Metrics)
+		if errors.Is(err, sender.ErrRejected) {
+			logger.Log.Errorf("Server rejected spooled metrics, drop them: %v", err)
+			return nil
+		}
+		if errors.Is(err, sender.ErrInvalidResponseSignature) {
+			logger.Log.Errorf("Can't verify server response for spooled metrics: %v", err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		logger.Log.Infof("Can't replay spool, server still unavailable: %v", err)
+		return false
+	}
+	return true
+}
+
+// worker отправляет батчи в /updates. Батчи, которые не удалось отправить из-за недоступности сервера,
+// сохраняются в очередь на диске.
+func (a *Agent) worker(wg *sync.WaitGroup, batches <-chan []repository.Metric) {
+	defer wg.Done()
+
+	for batch := range batches {
+		logger.Log.Infof("Send batch of %d metrics\n", len(batch))
+		key := sender.NewBatchKey()
+		err := a.sender.SendBatchWithKey(key, batch)
+		if errors.Is(err, sender.ErrServerUnavailable) {
+			a.spoolMetrics(key, batch)
+		} else if err != nil {
+			logger.Log.Errorf("Error while send batch: %v", err)
 		}
 	}
 }
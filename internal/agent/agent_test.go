@@ -1,10 +1,18 @@
 package agent
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/agent/sender"
+	"github.com/whynullname/go-collect-metrics/internal/agent/spool"
 	config "github.com/whynullname/go-collect-metrics/internal/configs/agentconfig"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
@@ -62,3 +70,54 @@ func TestUpdateGaugeMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestReplaySpool(t *testing.T) {
+	logger.Initialize("info")
+	received := make([][]repository.Metric, 0)
+	keys := make([]string, 0)
+	reject := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reject {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []repository.Metric
+		require.NoError(t, json.NewDecoder(reader).Decode(&batch))
+		received = append(received, batch)
+		keys = append(keys, r.Header.Get(sender.IdempotencyKeyHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := config.NewAgentConfig()
+	cfg.EndPointAdress = strings.TrimPrefix(server.URL, "http://")
+	metricsSpool, err := spool.Open(t.TempDir())
+	require.NoError(t, err)
+	agInstance := NewAgent(metrics.NewMetricUseCase(inmemory.NewInMemoryRepository()), cfg, WithSpool(metricsSpool))
+
+	first, second := 1.0, 2.0
+	agInstance.spoolMetrics("first", []repository.Metric{{ID: "HeapAlloc", MType: repository.GaugeMetricKey, Value: &first}})
+	agInstance.spoolMetrics("second", []repository.Metric{{ID: "HeapAlloc", MType: repository.GaugeMetricKey, Value: &second}})
+	// запись старого формата без ключа идемпотентности
+	legacy, err := json.Marshal([]repository.Metric{{ID: "HeapAlloc", MType: repository.GaugeMetricKey, Value: &first}})
+	require.NoError(t, err)
+	require.NoError(t, metricsSpool.Append(legacy))
+
+	require.True(t, agInstance.replaySpool())
+	require.Len(t, received, 3)
+	assert.Equal(t, first, received[0][0].GetValue())
+	assert.Equal(t, second, received[1][0].GetValue())
+	assert.Equal(t, first, received[2][0].GetValue())
+	// при повторной отправке из очереди используется ключ первой попытки
+	assert.Equal(t, "first", keys[0])
+	assert.Equal(t, "second", keys[1])
+	assert.NotEmpty(t, keys[2])
+
+	// отклоненные сервером батчи не повторяются бесконечно
+	reject = true
+	agInstance.spoolMetrics("rejected", []repository.Metric{{ID: "HeapAlloc", MType: repository.GaugeMetricKey, Value: &first}})
+	assert.True(t, agInstance.replaySpool())
+	assert.Equal(t, int64(0), metricsSpool.Len())
+}
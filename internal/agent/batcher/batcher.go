@@ -0,0 +1,82 @@
+// Пакет batcher собирает метрики в батчи для отправки одним запросом.
+package batcher
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// Batcher копит метрики и отдает батч, когда выполнено одно из условий:
+// набрано maxSize метрик, размер батча в JSON достиг maxBytes
+// или с момента добавления первой метрики прошло linger.
+type Batcher struct {
+	maxSize  int
+	maxBytes int
+	linger   time.Duration
+}
+
+func NewBatcher(maxSize int, maxBytes int, linger time.Duration) *Batcher {
+	return &Batcher{
+		maxSize:  max(maxSize, 1),
+		maxBytes: maxBytes,
+		linger:   linger,
+	}
+}
+
+// Run читает метрики из in и пишет батчи в out. Когда in закрыт,
+// отдает оставшиеся метрики последним батчем и закрывает out.
+func (b *Batcher) Run(in <-chan repository.Metric, out chan<- []repository.Metric) {
+	defer close(out)
+
+	timer := time.NewTimer(b.linger)
+	timer.Stop()
+
+	batch := make([]repository.Metric, 0, b.maxSize)
+	batchBytes := 2 // скобки массива
+	flush := func() {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		out <- batch
+		batch = make([]repository.Metric, 0, b.maxSize)
+		batchBytes = 2
+	}
+
+	for {
+		select {
+		case metric, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+
+			size := metricSize(&metric)
+			if b.maxBytes > 0 && len(batch) > 0 && batchBytes+size > b.maxBytes {
+				flush()
+			}
+			if len(batch) == 0 {
+				timer.Reset(b.linger)
+			}
+
+			batch = append(batch, metric)
+			batchBytes += size
+			if len(batch) >= b.maxSize || (b.maxBytes > 0 && batchBytes >= b.maxBytes) {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// metricSize размер метрики в JSON массиве вместе с запятой.
+func metricSize(metric *repository.Metric) int {
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return 0
+	}
+	return len(data) + 1
+}
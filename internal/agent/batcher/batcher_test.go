@@ -0,0 +1,62 @@
+package batcher
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+func gauges(n int) []repository.Metric {
+	output := make([]repository.Metric, 0, n)
+	for i := 0; i < n; i++ {
+		value := float64(i)
+		output = append(output, repository.Metric{ID: fmt.Sprintf("Gauge%d", i), MType: repository.GaugeMetricKey, Value: &value})
+	}
+	return output
+}
+
+func run(b *Batcher, metrics []repository.Metric, closeInput bool) <-chan []repository.Metric {
+	in := make(chan repository.Metric, len(metrics))
+	out := make(chan []repository.Metric, len(metrics)+1)
+	for _, metric := range metrics {
+		in <- metric
+	}
+	if closeInput {
+		close(in)
+	}
+	go b.Run(in, out)
+	return out
+}
+
+func sizes(out <-chan []repository.Metric) []int {
+	output := make([]int, 0)
+	for batch := range out {
+		output = append(output, len(batch))
+	}
+	return output
+}
+
+func TestMaxSize(t *testing.T) {
+	out := run(NewBatcher(4, 0, time.Hour), gauges(10), true)
+	assert.Equal(t, []int{4, 4, 2}, sizes(out))
+}
+
+func TestMaxBytes(t *testing.T) {
+	metrics := gauges(6)
+	// каждая метрика около 40 байт, в батч помещаются две
+	out := run(NewBatcher(100, 2+2*(metricSize(&metrics[0]))+1, time.Hour), metrics, true)
+	assert.Equal(t, []int{2, 2, 2}, sizes(out))
+}
+
+func TestLinger(t *testing.T) {
+	out := run(NewBatcher(100, 0, 10*time.Millisecond), gauges(3), false)
+	select {
+	case batch := <-out:
+		assert.Len(t, batch, 3)
+	case <-time.After(time.Second):
+		t.Fatal("batch was not flushed after linger")
+	}
+}
@@ -0,0 +1,94 @@
+// Пакет grpcsender предназначен для отправки метрик на сервер по gRPC.
+package grpcsender
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/agent/sender"
+	pb "github.com/whynullname/go-collect-metrics/internal/proto"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// sendTimeout ограничивает время одной отправки батча.
+const sendTimeout = 10 * time.Second
+
+// GRPCSender отправляет батчи метрик unary вызовом UpdateMetrics.
+// Батч считается доставленным только после ответа сервера, поэтому недоставленный батч можно сохранить в очередь.
+type GRPCSender struct {
+	conn   *grpc.ClientConn
+	client pb.MetricsClient
+}
+
+// NewGRPCSender создает отправителя. Если hashKey не пуст, каждый вызов подписывается им.
+func NewGRPCSender(address string, hashKey string) (*GRPCSender, error) {
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if hashKey != "" {
+		dialOpts = append(dialOpts,
+			grpc.WithChainUnaryInterceptor(signUnaryInterceptor(hashKey)),
+			grpc.WithChainStreamInterceptor(signStreamInterceptor(hashKey)),
+		)
+	}
+	conn, err := grpc.NewClient(address, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GRPCSender{
+		conn:   conn,
+		client: pb.NewMetricsClient(conn),
+	}, nil
+}
+
+// UpdateMetrics отправить метрики одним unary вызовом и получить их значения после обновления.
+func (g *GRPCSender) UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
+	response, err := g.client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: pb.FromMetrics(metrics)})
+	if err != nil {
+		return nil, err
+	}
+	return pb.ToMetrics(response.GetMetrics()), nil
+}
+
+// idempotencyKeyMetadata ключ метаданных с ключом идемпотентности, см. grpcserver.IdempotencyKeyMetadata.
+const idempotencyKeyMetadata = "idempotency-key"
+
+// SendMetrics отправить батч метрик с ключом идемпотентности key и дождаться ответа сервера.
+// Повторная отправка с тем же ключом, например из очереди на диске, не применяется сервером второй раз.
+// Ошибки приводятся к ошибкам пакета sender: sender.ErrRejected, если повтор бессмысленен,
+// и sender.ErrServerUnavailable, если батч можно отправить позже.
+func (g *GRPCSender) SendMetrics(key string, metrics []repository.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, idempotencyKeyMetadata, key)
+	}
+	_, err := g.UpdateMetrics(ctx, metrics)
+	return sendError(err)
+}
+
+func sendError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.NotFound:
+		return fmt.Errorf("%w: %v", sender.ErrRejected, err)
+	}
+	return fmt.Errorf("%w: %v", sender.ErrServerUnavailable, err)
+}
+
+// Close закрывает соединение с сервером.
+func (g *GRPCSender) Close() error {
+	return g.conn.Close()
+}
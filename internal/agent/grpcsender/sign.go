@@ -0,0 +1,47 @@
+package grpcsender
+
+import (
+	"context"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
+	pb "github.com/whynullname/go-collect-metrics/internal/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// signContext добавляет в метаданные вызова method подпись HashKey со временем и nonce, как у HTTP запросов.
+func signContext(ctx context.Context, key, method string, message proto.Message) (context.Context, error) {
+	body, err := pb.SigningBody(method, message)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]string, 0, 6)
+	for name, value := range hashsign.RequestHeaders(key, body, time.Now()) {
+		pairs = append(pairs, name, value)
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...), nil
+}
+
+func signUnaryInterceptor(key string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, request, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		message, _ := request.(proto.Message)
+		ctx, err := signContext(ctx, key, method, message)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, request, reply, cc, opts...)
+	}
+}
+
+func signStreamInterceptor(key string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, err := signContext(ctx, key, method, nil)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
@@ -4,25 +4,37 @@ package sender
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/hmac"
+	"context"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"strconv"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/whynullname/go-collect-metrics/internal/agent/collector"
 	config "github.com/whynullname/go-collect-metrics/internal/configs/agentconfig"
+	"github.com/whynullname/go-collect-metrics/internal/envelope"
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
 )
 
+var (
+	// ErrServerUnavailable сервер не ответил или ответил ошибкой 5xx.
+	ErrServerUnavailable = errors.New("server unavailable")
+	// ErrRejected сервер отклонил запрос, повторять его бессмысленно.
+	ErrRejected = errors.New("request rejected by server")
+	// ErrInvalidResponseSignature ответ сервера не подписан HashKey или подпись не совпала.
+	// Запрос мог быть уже применен сервером, поэтому повторять его нельзя.
+	ErrInvalidResponseSignature = errors.New("invalid response signature")
+)
+
 type AgentSender struct {
 	collector *collector.AgentCollector
 	client    *resty.Client
@@ -30,24 +42,55 @@ type AgentSender struct {
 }
 
 func NewAgentSender(collector *collector.AgentCollector, config *config.AgentConfig) *AgentSender {
-	client := resty.New().
+	sender := &AgentSender{
+		collector: collector,
+		config:    config,
+	}
+	sender.client = resty.New().
+		SetHeader("Accept", "application/json").
 		SetRetryCount(3).
 		SetRetryWaitTime(1 * time.Second).
 		AddRetryCondition(
 			func(r *resty.Response, err error) bool {
 				return err != nil || r.StatusCode() >= http.StatusInternalServerError
 			},
-		)
-	return &AgentSender{
-		collector: collector,
-		config:    config,
-		client:    client,
+		).
+		OnBeforeRequest(sender.signAttempt)
+	return sender
+}
+
+// collectMetrics получает метрики из коллектора и проставляет им метки из конфига агента.
+func (s *AgentSender) collectMetrics() ([]repository.Metric, error) {
+	metrics, err := s.collector.GetAllMetrics()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range metrics {
+		s.AttachLabels(&metrics[i])
 	}
+	return metrics, nil
+}
+
+// AttachLabels проставляет метрике метки из конфига агента.
+func (s *AgentSender) AttachLabels(metric *repository.Metric) {
+	if len(s.config.Labels) == 0 {
+		return
+	}
+
+	labels := make(repository.Labels, len(metric.Labels)+len(s.config.Labels))
+	for name, value := range metric.Labels {
+		labels[name] = value
+	}
+	for name, value := range s.config.Labels {
+		labels[name] = value
+	}
+	metric.Labels = labels
 }
 
 // SendAllMetricsByArray отправить все метрики одним массивом.
 func (s *AgentSender) SendAllMetricsByArray() {
-	jsonArray, err := s.collector.GetAllMetrics()
+	jsonArray, err := s.collectMetrics()
 	if err != nil {
 		return
 	}
@@ -59,7 +102,7 @@ func (s *AgentSender) SendAllMetricsByArray() {
 
 // SendAllMetricByArrayAndSHA отправить все метрики массивом и подписать с помощью SHA.
 func (s *AgentSender) SendAllMetricByArrayAndSHA() {
-	jsonArray, err := s.collector.GetAllMetrics()
+	jsonArray, err := s.collectMetrics()
 	if err != nil {
 		return
 	}
@@ -69,23 +112,17 @@ func (s *AgentSender) SendAllMetricByArrayAndSHA() {
 	if err != nil {
 		logger.Log.Infof("error %s", err.Error())
 	}
-	requestHash := s.generateHash(jsonBytes)
-	newRequest := s.client.R().SetBody(jsonArray).
-		SetHeader("HashSHA256", requestHash)
+	newRequest := s.client.R().SetBody(jsonBytes).
+		SetHeader("Content-Type", "application/json")
+	s.signRequest(newRequest, jsonBytes)
 	s.sendRequest(newRequest, url)
 }
 
-func (s *AgentSender) generateHash(data []byte) string {
-	hash := hmac.New(sha256.New, []byte(s.config.HashKey))
-	hash.Write(data)
-	return hex.EncodeToString(hash.Sum(nil))
-}
-
 // SendMetricsByJSON отправить все метрики в формате JSON.
 // ВАЖНО! Каждая метрика отправляется по очереди.
 // Метод отправляет json закодированным с помощью gzip.
 func (s *AgentSender) SendMetricsByJSON() {
-	jsonArray, err := s.collector.GetAllMetrics()
+	jsonArray, err := s.collectMetrics()
 	if err != nil {
 		return
 	}
@@ -101,15 +138,88 @@ func (s *AgentSender) SendMetricsByJSON() {
 }
 
 // SendJSONWithEncoding позволяет отправить JSON в закодированном ввиде с помощью gzip.
-func (s *AgentSender) SendJSONWithEncoding(json []byte, enableEncoding bool) {
+func (s *AgentSender) SendJSONWithEncoding(json []byte, enableEncoding bool) error {
 	buff := s.GZIPData(json)
 	url := fmt.Sprintf("http://%s/update", s.config.EndPointAdress)
 	newRequest := s.client.R().
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Content-Encoding", "gzip").
 		SetBody(buff)
+	s.signRequest(newRequest, json)
 
-	s.sendRequest(newRequest, url)
+	return s.sendRequest(newRequest, url)
+}
+
+// IdempotencyKeyHeader заголовок с ключом идемпотентности батча.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// NewBatchKey возвращает случайный ключ идемпотентности для нового батча.
+func NewBatchKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
+
+// SendBatch отправить метрики одним массивом в /updates с новым ключом идемпотентности.
+func (s *AgentSender) SendBatch(metrics []repository.Metric) error {
+	return s.SendBatchWithKey(NewBatchKey(), metrics)
+}
+
+// SendBatchWithKey отправить метрики одним массивом в /updates.
+// Ключ идемпотентности защищает от повторного применения батча при ретраях и повторной отправке из очереди.
+// Тело подписывается HashKey, если он задан, сжимается gzip и шифруется, если задан RSA ключ.
+func (s *AgentSender) SendBatchWithKey(key string, metrics []repository.Metric) error {
+	jsonBytes, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	body := s.GZIPData(jsonBytes).Bytes()
+	contentType := "application/json"
+	if s.config.RSAKey != nil {
+		body, err = s.EncryptData(body)
+		if err != nil {
+			return err
+		}
+		contentType = envelope.WrapContentType(contentType)
+	}
+
+	url := fmt.Sprintf("http://%s/updates", s.config.EndPointAdress)
+	newRequest := s.client.R().
+		SetHeader("Content-Type", contentType).
+		SetHeader("Content-Encoding", "gzip").
+		SetHeader(IdempotencyKeyHeader, key).
+		SetBody(body)
+	s.signRequest(newRequest, jsonBytes)
+
+	return s.sendRequest(newRequest, url)
+}
+
+// signBodyKey ключ контекста запроса с несжатым телом, которое подписывает signAttempt.
+type signBodyKey struct{}
+
+// signRequest помечает запрос для подписи несжатого тела вместе со временем и nonce, если задан HashKey.
+// Сама подпись ставится в signAttempt перед каждой попыткой.
+func (s *AgentSender) signRequest(request *resty.Request, body []byte) {
+	if s.config.HashKey == "" {
+		return
+	}
+	request.SetContext(context.WithValue(request.Context(), signBodyKey{}, body))
+}
+
+// signAttempt подписывает запрос вместе с методом и путем перед каждой попыткой отправки. Сервер запоминает nonce до вызова обработчика,
+// поэтому ретрай после 5xx с прежним nonce был бы отклонен как повтор.
+func (s *AgentSender) signAttempt(_ *resty.Client, request *resty.Request) error {
+	body, ok := request.Context().Value(signBodyKey{}).([]byte)
+	if !ok {
+		return nil
+	}
+	target, err := neturl.Parse(request.URL)
+	if err != nil {
+		return err
+	}
+	request.SetHeaders(hashsign.RequestHeaders(s.config.HashKey, hashsign.HTTPBody(request.Method, target.RequestURI(), body), time.Now()))
+	return nil
 }
 
 // GZIPData кодирует массив byte с помощью gzip.
@@ -121,24 +231,18 @@ func (s *AgentSender) GZIPData(data []byte) *bytes.Buffer {
 	return &buff
 }
 
-func (s *AgentSender) EncryptData(data []byte) []byte {
+// EncryptData шифрует data открытым ключом сервера в формате envelope.
+func (s *AgentSender) EncryptData(data []byte) ([]byte, error) {
 	if s.config.RSAKey == nil {
-		logger.Log.Warnf("Can't encrypt data, because rsa key is nil")
-		return data
-	}
-
-	encryptedMessage, err := rsa.EncryptPKCS1v15(rand.Reader, s.config.RSAKey, data)
-	if err != nil {
-		logger.Log.Errorf("Error while encrypt data: %v\n", err)
-		return data
+		return nil, errors.New("can't encrypt data, because rsa key is nil")
 	}
 
-	return encryptedMessage
+	return envelope.Seal(s.config.RSAKey, data)
 }
 
 // SendMetricsByPostResponse отправить каждую метрику с помощью POST формата по URL.
 func (s *AgentSender) SendMetricsByPostResponse() {
-	jsonArray, err := s.collector.GetAllMetrics()
+	jsonArray, err := s.collectMetrics()
 	if err != nil {
 		return
 	}
@@ -153,8 +257,16 @@ func (s *AgentSender) SendMetricsByPostResponse() {
 		}
 
 		url := fmt.Sprintf("http://%s/update/%s/%s/%s", s.config.EndPointAdress, metric.MType, metric.ID, metricValue)
+		if len(metric.Labels) > 0 {
+			query := neturl.Values{}
+			for name, value := range metric.Labels {
+				query.Set(name, value)
+			}
+			url += "?" + query.Encode()
+		}
 		requst := s.client.NewRequest()
 		requst.SetHeader("ContentType", "text/plain")
+		s.signRequest(requst, nil)
 		_, err := requst.Post(url)
 		if err != nil {
 			log.Printf("Can't send post method in %s ! Err %s \n", url, err)
@@ -163,9 +275,23 @@ func (s *AgentSender) SendMetricsByPostResponse() {
 	}
 }
 
-func (s *AgentSender) sendRequest(request *resty.Request, url string) {
-	_, err := request.Post(url)
+// sendRequest отправляет запрос. Если сервер недоступен или ответил 5xx,
+// возвращается ошибка ErrServerUnavailable, такой запрос можно повторить позже.
+func (s *AgentSender) sendRequest(request *resty.Request, url string) error {
+	response, err := request.Post(url)
 	if err != nil {
 		logger.Log.Infof("error %s", err.Error())
+		return fmt.Errorf("%w: %v", ErrServerUnavailable, err)
+	}
+
+	if response.StatusCode() >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: status %d", ErrServerUnavailable, response.StatusCode())
+	}
+	if response.StatusCode() >= http.StatusBadRequest {
+		return fmt.Errorf("%w: status %d", ErrRejected, response.StatusCode())
+	}
+	if s.config.HashKey != "" && !hashsign.Verify(s.config.HashKey, response.Body(), response.Header().Get(hashsign.HeaderKey)) {
+		return ErrInvalidResponseSignature
 	}
+	return nil
 }
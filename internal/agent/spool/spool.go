@@ -0,0 +1,341 @@
+// Пакет spool реализует очередь на диске для батчей, которые агент не смог отправить.
+//
+// Батчи дописываются в файлы-сегменты. Каждая запись сегмента - длина данных, CRC32 и сами данные.
+// Позиция чтения хранится в отдельном файле, поэтому после перезапуска агента отправка
+// продолжается с первой неотправленной записи.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+const (
+	segmentExt  = ".seg"
+	cursorFile  = "cursor"
+	headerSize  = 8
+	maxRecord   = 64 << 20
+	defaultSize = 64 << 20
+	defaultAge  = 24 * time.Hour
+)
+
+var ErrRecordTooLarge = errors.New("spool record too large")
+
+type segment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+// Spool ограниченная по размеру и возрасту очередь на диске.
+type Spool struct {
+	dir            string
+	maxBytes       int64
+	maxAge         time.Duration
+	segmentMaxSize int64
+
+	mx       sync.Mutex
+	segments []segment
+	current  *os.File
+	// позиция чтения: номер сегмента и смещение в нем
+	readSeq    uint64
+	readOffset int64
+}
+
+// Option настраивает Spool.
+type Option func(*Spool)
+
+// WithMaxBytes ограничивает суммарный размер сегментов. При превышении удаляются самые старые сегменты.
+func WithMaxBytes(maxBytes int64) Option {
+	return func(s *Spool) {
+		s.maxBytes = maxBytes
+	}
+}
+
+// WithMaxAge задает, сколько хранятся сегменты. Более старые удаляются без отправки.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(s *Spool) {
+		s.maxAge = maxAge
+	}
+}
+
+// Open открывает очередь в dir, создавая директорию при необходимости.
+func Open(dir string, opts ...Option) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	spool := &Spool{
+		dir:      dir,
+		maxBytes: defaultSize,
+		maxAge:   defaultAge,
+	}
+	for _, opt := range opts {
+		opt(spool)
+	}
+	spool.segmentMaxSize = max(spool.maxBytes/16, 64<<10)
+
+	if err := spool.load(); err != nil {
+		return nil, err
+	}
+	return spool, nil
+}
+
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, segment{seq: seq, path: filepath.Join(s.dir, name), size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	data, err := os.ReadFile(filepath.Join(s.dir, cursorFile))
+	if err == nil {
+		_, err = fmt.Sscanf(string(data), "%d %d", &s.readSeq, &s.readOffset)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Log.Warnf("Can't read spool cursor, replay from the oldest segment: %v", err)
+		s.readSeq, s.readOffset = 0, 0
+	}
+	return nil
+}
+
+// Append дописывает батч в конец очереди.
+func (s *Spool) Append(data []byte) error {
+	if len(data) > maxRecord {
+		return ErrRecordTooLarge
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.current == nil || s.segments[len(s.segments)-1].size >= s.segmentMaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+
+	if _, err := s.current.Write(record); err != nil {
+		return err
+	}
+	if err := s.current.Sync(); err != nil {
+		return err
+	}
+
+	s.segments[len(s.segments)-1].size += int64(len(record))
+	s.enforceLimits()
+	return nil
+}
+
+// rotate закрывает текущий сегмент и открывает новый.
+func (s *Spool) rotate() error {
+	if err := s.closeCurrent(); err != nil {
+		return err
+	}
+
+	seq := uint64(1)
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.current = file
+	s.segments = append(s.segments, segment{seq: seq, path: path})
+	return nil
+}
+
+func (s *Spool) closeCurrent() error {
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+// enforceLimits удаляет самые старые сегменты, пока очередь больше maxBytes,
+// и сегменты, в которые не писали дольше maxAge. Текущий сегмент не удаляется.
+func (s *Spool) enforceLimits() {
+	total := int64(0)
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+
+	now := time.Now()
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		expired := false
+		if info, err := os.Stat(oldest.path); err == nil && now.Sub(info.ModTime()) > s.maxAge {
+			expired = true
+		}
+		if total <= s.maxBytes && !expired {
+			break
+		}
+
+		logger.Log.Warnf("Spool limit exceeded, drop segment %s with unsent metrics", oldest.path)
+		s.removeOldest()
+		total -= oldest.size
+	}
+}
+
+func (s *Spool) removeOldest() {
+	oldest := s.segments[0]
+	if err := os.Remove(oldest.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Log.Errorf("Can't remove spool segment %s: %v", oldest.path, err)
+	}
+	s.segments = s.segments[1:]
+	if s.readSeq <= oldest.seq {
+		s.readSeq, s.readOffset = 0, 0
+	}
+}
+
+// Len возвращает суммарный размер неотправленных сегментов в байтах.
+func (s *Spool) Len() int64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	total := int64(0)
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	if len(s.segments) > 0 && s.readSeq == s.segments[0].seq {
+		total -= s.readOffset
+	}
+	return total
+}
+
+// Replay по порядку передает записи в send. Успешно отправленные записи удаляются из очереди.
+// При первой ошибке send отправка останавливается, запись остается в очереди и ошибка возвращается.
+func (s *Spool) Replay(send func(data []byte) error) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.enforceLimits()
+	if err := s.closeCurrent(); err != nil {
+		return err
+	}
+
+	for len(s.segments) > 0 {
+		oldest := s.segments[0]
+		if s.readSeq != oldest.seq {
+			s.readSeq, s.readOffset = oldest.seq, 0
+		}
+
+		if err := s.replaySegment(oldest, send); err != nil {
+			return err
+		}
+
+		s.removeOldest()
+		if err := s.saveCursor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Spool) replaySegment(seg segment, send func(data []byte) error) error {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(s.readOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Log.Warnf("Truncated record in spool segment %s, skip the rest", seg.path)
+			}
+			return nil
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxRecord {
+			logger.Log.Warnf("Corrupted record in spool segment %s, skip the rest", seg.path)
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			logger.Log.Warnf("Truncated record in spool segment %s, skip the rest", seg.path)
+			return nil
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			logger.Log.Warnf("Corrupted record in spool segment %s, skip the rest", seg.path)
+			return nil
+		}
+
+		if err := send(data); err != nil {
+			return err
+		}
+
+		s.readOffset += int64(headerSize) + int64(length)
+		if err := s.saveCursor(); err != nil {
+			return err
+		}
+	}
+}
+
+// saveCursor атомарно сохраняет позицию чтения.
+func (s *Spool) saveCursor() error {
+	path := filepath.Join(s.dir, cursorFile)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d", s.readSeq, s.readOffset)
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Close закрывает текущий сегмент. Неотправленные записи остаются на диске.
+func (s *Spool) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.closeCurrent()
+}
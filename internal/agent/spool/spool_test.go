@@ -0,0 +1,112 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+func collect(t *testing.T, s *Spool) []string {
+	output := make([]string, 0)
+	require.NoError(t, s.Replay(func(data []byte) error {
+		output = append(output, string(data))
+		return nil
+	}))
+	return output
+}
+
+func TestReplayOrder(t *testing.T) {
+	logger.Initialize("info")
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.Append([]byte(fmt.Sprintf("batch-%d", i))))
+	}
+	assert.Equal(t, []string{"batch-0", "batch-1", "batch-2", "batch-3", "batch-4"}, collect(t, s))
+	assert.Empty(t, collect(t, s))
+	assert.Equal(t, int64(0), s.Len())
+}
+
+func TestReplayStopsOnError(t *testing.T) {
+	logger.Initialize("info")
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Append([]byte(fmt.Sprintf("batch-%d", i))))
+	}
+
+	sent := 0
+	errUnavailable := errors.New("unavailable")
+	err = s.Replay(func(data []byte) error {
+		if sent == 1 {
+			return errUnavailable
+		}
+		sent++
+		return nil
+	})
+	assert.ErrorIs(t, err, errUnavailable)
+	require.NoError(t, s.Append([]byte("batch-3")))
+	require.NoError(t, s.Close())
+
+	// после перезапуска отправка продолжается с первой неотправленной записи
+	reopened, err := Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"batch-1", "batch-2", "batch-3"}, collect(t, reopened))
+}
+
+func TestMaxBytes(t *testing.T) {
+	logger.Initialize("info")
+	s, err := Open(t.TempDir(), WithMaxBytes(1))
+	require.NoError(t, err)
+	s.segmentMaxSize = 1
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, s.Append([]byte(fmt.Sprintf("batch-%d", i))))
+	}
+	// старые сегменты удаляются, последний остается
+	assert.Equal(t, []string{"batch-3"}, collect(t, s))
+}
+
+func TestMaxAge(t *testing.T) {
+	logger.Initialize("info")
+	s, err := Open(t.TempDir(), WithMaxAge(time.Minute))
+	require.NoError(t, err)
+	s.segmentMaxSize = 1
+
+	require.NoError(t, s.Append([]byte("old")))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(s.segments[0].path, old, old))
+	require.NoError(t, s.Append([]byte("new")))
+
+	assert.Equal(t, []string{"new"}, collect(t, s))
+}
+
+func TestTruncatedSegment(t *testing.T) {
+	logger.Initialize("info")
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, s.Append([]byte("complete")))
+	require.NoError(t, s.Close())
+
+	// запись, которую агент не успел дописать до конца
+	file, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 1, segmentExt)), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 10, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	reopened, err := Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"complete"}, collect(t, reopened))
+}
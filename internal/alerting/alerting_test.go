@@ -0,0 +1,139 @@
+package alerting
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Rule
+		wantErr bool
+	}{
+		{
+			name: "gauge threshold",
+			line: "gauge HeapAlloc > 5e8 for 2m",
+			want: Rule{Name: "gauge HeapAlloc > 5e8 for 2m", Expr: "gauge HeapAlloc > 5e8 for 2m",
+				MetricType: "gauge", MetricID: "HeapAlloc", Op: OpGreater, Threshold: 5e8, For: 2 * time.Minute},
+		},
+		{
+			name: "named rate with selector",
+			line: `NoPolls: rate(counter PollCount{host="web-1"}) == 0 for 1m`,
+			want: Rule{Name: "NoPolls", Expr: `rate(counter PollCount{host="web-1"}) == 0 for 1m`, Func: FuncRate,
+				MetricType: "counter", MetricID: "PollCount", Selector: repository.Labels{"host": "web-1"},
+				Op: OpEqual, Threshold: 0, For: time.Minute},
+		},
+		{
+			name: "without for",
+			line: "gauge CPUutilization1 >= 90",
+			want: Rule{Name: "gauge CPUutilization1 >= 90", Expr: "gauge CPUutilization1 >= 90",
+				MetricType: "gauge", MetricID: "CPUutilization1", Op: OpGreaterOrEqual, Threshold: 90},
+		},
+		{name: "unknown type", line: "summary X > 1", wantErr: true},
+		{name: "rate of gauge", line: "rate(gauge Alloc) > 1", wantErr: true},
+		{name: "unbalanced parentheses", line: "rate(counter PollCount > 1", wantErr: true},
+		{name: "bad threshold", line: "gauge Alloc > lots", wantErr: true},
+		{name: "bad duration", line: "gauge Alloc > 1 for ever", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := ParseRule(test.line)
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidRule)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, rule)
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	content := "# heap\ngauge HeapAlloc > 5e8 for 2m\n\nrate(counter PollCount) == 0 for 1m\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+	assert.Len(t, rules, 2)
+
+	require.NoError(t, os.WriteFile(path, []byte("gauge HeapAlloc >\n"), 0600))
+	_, err = LoadRules(path)
+	assert.ErrorIs(t, err, ErrInvalidRule)
+}
+
+func TestManagerStates(t *testing.T) {
+	repo := inmemory.NewInMemoryRepository()
+	useCase := metrics.NewMetricUseCase(repo)
+	setGauge := func(value float64) {
+		_, err := useCase.UpdateMetric(context.Background(), &repository.Metric{
+			ID: "HeapAlloc", MType: repository.GaugeMetricKey, Value: &value,
+		})
+		require.NoError(t, err)
+	}
+
+	rule, err := ParseRule("gauge HeapAlloc > 100 for 2m")
+	require.NoError(t, err)
+	manager := NewManager([]Rule{rule}, useCase, time.Second)
+	start := time.Now()
+
+	setGauge(50)
+	manager.Evaluate(context.Background(), start)
+	assert.Empty(t, manager.Alerts())
+
+	setGauge(150)
+	manager.Evaluate(context.Background(), start.Add(time.Minute))
+	require.Len(t, manager.Alerts(), 1)
+	assert.Equal(t, StatePending, manager.Alerts()[0].State)
+
+	manager.Evaluate(context.Background(), start.Add(3*time.Minute))
+	assert.Equal(t, StateFiring, manager.Alerts()[0].State)
+	assert.Equal(t, float64(150), manager.Alerts()[0].Value)
+
+	setGauge(50)
+	manager.Evaluate(context.Background(), start.Add(4*time.Minute))
+	assert.Equal(t, StateResolved, manager.Alerts()[0].State)
+
+	manager.Evaluate(context.Background(), start.Add(4*time.Minute+resolvedRetention))
+	assert.Empty(t, manager.Alerts())
+}
+
+func TestManagerRate(t *testing.T) {
+	repo := inmemory.NewInMemoryRepository()
+	useCase := metrics.NewMetricUseCase(repo)
+	addPolls := func(delta int64) {
+		_, err := useCase.UpdateMetric(context.Background(), &repository.Metric{
+			ID: "PollCount", MType: repository.CounterMetricKey, Delta: &delta,
+		})
+		require.NoError(t, err)
+	}
+
+	rule, err := ParseRule("rate(counter PollCount) == 0")
+	require.NoError(t, err)
+	manager := NewManager([]Rule{rule}, useCase, time.Second)
+	start := time.Now()
+
+	addPolls(5)
+	manager.Evaluate(context.Background(), start)
+	assert.Empty(t, manager.Alerts(), "rate needs two evaluations")
+
+	addPolls(5)
+	manager.Evaluate(context.Background(), start.Add(10*time.Second))
+	assert.Empty(t, manager.Alerts())
+
+	manager.Evaluate(context.Background(), start.Add(20*time.Second))
+	require.Len(t, manager.Alerts(), 1)
+	assert.Equal(t, StateFiring, manager.Alerts()[0].State)
+}
@@ -0,0 +1,44 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileNotifier дописывает уведомления в файл, по одному JSON объекту на строку.
+type FileNotifier struct {
+	path string
+	mx   sync.Mutex
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (f *FileNotifier) Name() string {
+	return "file " + f.path
+}
+
+func (f *FileNotifier) Notify(ctx context.Context, notification Notification) error {
+	line, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,247 @@
+package alerting
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// Состояния алерта.
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// resolvedRetention сколько разрешенный алерт остается в списке алертов.
+const resolvedRetention = 15 * time.Minute
+
+// MetricsSource источник метрик для вычисления правил.
+type MetricsSource interface {
+	GetAllMetricsByType(ctx context.Context, metricType string) ([]repository.Metric, error)
+}
+
+// Alert состояние правила для одной метрики.
+type Alert struct {
+	Name       string            `json:"name"`
+	Expr       string            `json:"expr"`
+	MetricID   string            `json:"metric_id"`
+	Labels     repository.Labels `json:"labels,omitempty"`
+	State      string            `json:"state"`
+	Value      float64           `json:"value"`
+	ActiveAt   time.Time         `json:"active_at"`
+	FiredAt    *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time        `json:"resolved_at,omitempty"`
+}
+
+type counterPoint struct {
+	value     float64
+	timestamp time.Time
+}
+
+// Manager периодически вычисляет правила и хранит текущие состояния алертов.
+type Manager struct {
+	rules    []Rule
+	source   MetricsSource
+	interval time.Duration
+
+	dispatcher *Dispatcher
+
+	mx       sync.RWMutex
+	alerts   map[string]*Alert
+	counters map[string]counterPoint
+}
+
+// ManagerOption настраивает Manager.
+type ManagerOption func(*Manager)
+
+// WithDispatcher передает переходы алертов в firing и resolved в dispatcher для отправки уведомлений.
+func WithDispatcher(dispatcher *Dispatcher) ManagerOption {
+	return func(m *Manager) {
+		m.dispatcher = dispatcher
+	}
+}
+
+func NewManager(rules []Rule, source MetricsSource, interval time.Duration, opts ...ManagerOption) *Manager {
+	manager := &Manager{
+		rules:    rules,
+		source:   source,
+		interval: interval,
+		alerts:   make(map[string]*Alert),
+		counters: make(map[string]counterPoint),
+	}
+	for _, opt := range opts {
+		opt(manager)
+	}
+	return manager
+}
+
+// Run горутина, которая каждые interval вычисляет все правила.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.Evaluate(ctx, now)
+		}
+	}
+}
+
+// Evaluate вычисляет все правила на момент now и обновляет состояния алертов.
+func (m *Manager) Evaluate(ctx context.Context, now time.Time) {
+	values := make(map[string]float64)
+	seriesByKey := make(map[string]repository.Metric)
+	rulesByKey := make(map[string]*Rule)
+
+	metricsByType := make(map[string][]repository.Metric)
+	for i := range m.rules {
+		rule := &m.rules[i]
+		metrics, ok := metricsByType[rule.MetricType]
+		if !ok {
+			var err error
+			metrics, err = m.source.GetAllMetricsByType(ctx, rule.MetricType)
+			if err != nil {
+				logger.Log.Errorf("Can't evaluate rule %s: %v", rule.Name, err)
+				continue
+			}
+			metricsByType[rule.MetricType] = metrics
+		}
+
+		for _, metric := range metrics {
+			if metric.ID != rule.MetricID || !metric.Labels.Matches(rule.Selector) {
+				continue
+			}
+
+			value, ok := m.ruleValue(rule, &metric, now)
+			if !ok {
+				continue
+			}
+
+			key := alertKey(rule, &metric)
+			values[key] = value
+			seriesByKey[key] = metric
+			rulesByKey[key] = rule
+		}
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for key, value := range values {
+		rule := rulesByKey[key]
+		if !rule.Compare(value) {
+			continue
+		}
+
+		alert, ok := m.alerts[key]
+		if !ok || alert.State == StateResolved {
+			metric := seriesByKey[key]
+			alert = &Alert{
+				Name:     rule.Name,
+				Expr:     rule.Expr,
+				MetricID: metric.ID,
+				Labels:   metric.Labels,
+				State:    StatePending,
+				ActiveAt: now,
+			}
+			m.alerts[key] = alert
+		}
+
+		alert.Value = value
+		if alert.State == StatePending && now.Sub(alert.ActiveAt) >= rule.For {
+			firedAt := now
+			alert.State = StateFiring
+			alert.FiredAt = &firedAt
+			m.notify(key, alert)
+		}
+	}
+
+	for key, alert := range m.alerts {
+		value, ok := values[key]
+		if ok && rulesByKey[key].Compare(value) {
+			continue
+		}
+		if ok {
+			alert.Value = value
+		}
+
+		switch alert.State {
+		case StatePending:
+			delete(m.alerts, key)
+		case StateFiring:
+			resolvedAt := now
+			alert.State = StateResolved
+			alert.ResolvedAt = &resolvedAt
+			m.notify(key, alert)
+		case StateResolved:
+			if now.Sub(*alert.ResolvedAt) >= resolvedRetention {
+				delete(m.alerts, key)
+			}
+		}
+	}
+}
+
+// ruleValue возвращает значение, с которым сравнивается порог правила.
+// Для rate значение появляется со второго вычисления.
+func (m *Manager) ruleValue(rule *Rule, metric *repository.Metric, now time.Time) (float64, bool) {
+	if rule.Func != FuncRate {
+		value, ok := metric.SampleValue()
+		return value, ok
+	}
+
+	current := float64(metric.GetDelta())
+	key := alertKey(rule, metric)
+	m.mx.Lock()
+	previous, ok := m.counters[key]
+	m.counters[key] = counterPoint{value: current, timestamp: now}
+	m.mx.Unlock()
+
+	elapsed := now.Sub(previous.timestamp).Seconds()
+	if !ok || elapsed <= 0 {
+		return 0, false
+	}
+
+	increase := current - previous.value
+	if increase < 0 {
+		// counter был сброшен, считаем что он рос с нуля
+		increase = current
+	}
+	return increase / elapsed, true
+}
+
+func (m *Manager) notify(key string, alert *Alert) {
+	if m.dispatcher != nil {
+		m.dispatcher.Enqueue(key, *alert)
+	}
+}
+
+func alertKey(rule *Rule, metric *repository.Metric) string {
+	return rule.Name + "\x00" + rule.Expr + "\x00" + metric.Key()
+}
+
+// Alerts возвращает текущие алерты, отсортированные по имени правила и меткам.
+func (m *Manager) Alerts() []Alert {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	output := make([]Alert, 0, len(m.alerts))
+	for _, alert := range m.alerts {
+		output = append(output, *alert)
+	}
+
+	sort.Slice(output, func(i, j int) bool {
+		if output[i].Name != output[j].Name {
+			return output[i].Name < output[j].Name
+		}
+		return output[i].Labels.String() < output[j].Labels.String()
+	})
+	return output
+}
@@ -0,0 +1,198 @@
+package alerting
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+// Notification уведомление об изменении состояния группы алертов одного правила.
+type Notification struct {
+	GroupKey string    `json:"group_key"`
+	Status   string    `json:"status"`
+	Alerts   []Alert   `json:"alerts"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// Notifier доставляет уведомления во внешнюю систему.
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+	Name() string
+}
+
+const (
+	defaultGroupWait    = 30 * time.Second
+	defaultRetryCount   = 5
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = time.Minute
+)
+
+// Dispatcher группирует изменения состояний алертов и рассылает их всем Notifier.
+//
+// Изменения копятся в течение groupWait, для каждого алерта остается только последнее состояние.
+// Если это состояние уже было отправлено, алерт пропускается, поэтому флапающий алерт,
+// который за окно успел сработать и разрешиться, не порождает уведомлений.
+type Dispatcher struct {
+	notifiers    []Notifier
+	groupWait    time.Duration
+	retryCount   int
+	retryBackoff time.Duration
+
+	mx      sync.Mutex
+	pending map[string]Alert
+	sent    map[string]string
+	wg      sync.WaitGroup
+}
+
+// DispatcherOption настраивает Dispatcher.
+type DispatcherOption func(*Dispatcher)
+
+// WithGroupWait задает окно группировки уведомлений.
+func WithGroupWait(groupWait time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.groupWait = groupWait
+	}
+}
+
+// WithRetry задает число попыток доставки и начальную задержку между ними.
+// Задержка удваивается после каждой неудачной попытки.
+func WithRetry(count int, backoff time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.retryCount = count
+		d.retryBackoff = backoff
+	}
+}
+
+func NewDispatcher(notifiers []Notifier, opts ...DispatcherOption) *Dispatcher {
+	dispatcher := &Dispatcher{
+		notifiers:    notifiers,
+		groupWait:    defaultGroupWait,
+		retryCount:   defaultRetryCount,
+		retryBackoff: defaultRetryBackoff,
+		pending:      make(map[string]Alert),
+		sent:         make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(dispatcher)
+	}
+	return dispatcher
+}
+
+// Enqueue добавляет изменение состояния алерта в очередь на отправку.
+func (d *Dispatcher) Enqueue(key string, alert Alert) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.pending[key] = alert
+}
+
+// Run горутина, которая каждые groupWait отправляет накопленные уведомления.
+// При завершении ctx оставшиеся уведомления отправляются без ожидания окна.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.groupWait)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.Flush(context.Background())
+			d.wg.Wait()
+			return
+		case <-ticker.C:
+			d.Flush(ctx)
+		}
+	}
+}
+
+// Flush группирует накопленные изменения по правилам и отправляет их.
+func (d *Dispatcher) Flush(ctx context.Context) {
+	notifications := d.collect(time.Now())
+	for _, notification := range notifications {
+		for _, notifier := range d.notifiers {
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.deliver(ctx, notifier, notification)
+			}()
+		}
+	}
+}
+
+// Wait ожидает завершения всех начатых отправок.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) collect(now time.Time) []Notification {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	groups := make(map[string][]Alert)
+	for key, alert := range d.pending {
+		delete(d.pending, key)
+
+		lastState, wasSent := d.sent[key]
+		if lastState == alert.State || (!wasSent && alert.State == StateResolved) {
+			continue
+		}
+
+		if alert.State == StateResolved {
+			delete(d.sent, key)
+		} else {
+			d.sent[key] = alert.State
+		}
+		groups[alert.Name] = append(groups[alert.Name], alert)
+	}
+
+	output := make([]Notification, 0, len(groups))
+	for name, alerts := range groups {
+		sort.Slice(alerts, func(i, j int) bool {
+			return alerts[i].Labels.String() < alerts[j].Labels.String()
+		})
+
+		status := StateResolved
+		for _, alert := range alerts {
+			if alert.State == StateFiring {
+				status = StateFiring
+				break
+			}
+		}
+
+		output = append(output, Notification{
+			GroupKey: name,
+			Status:   status,
+			Alerts:   alerts,
+			SentAt:   now,
+		})
+	}
+
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].GroupKey < output[j].GroupKey
+	})
+	return output
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, notifier Notifier, notification Notification) {
+	backoff := d.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := notifier.Notify(ctx, notification)
+		if err == nil {
+			return
+		}
+		if attempt >= d.retryCount {
+			logger.Log.Errorf("Can't send notification %s to %s after %d attempts: %v",
+				notification.GroupKey, notifier.Name(), attempt, err)
+			return
+		}
+
+		logger.Log.Infof("Error while send notification to %s, retry in %s: %v", notifier.Name(), backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
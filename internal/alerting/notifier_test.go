@@ -0,0 +1,155 @@
+package alerting
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+type recordNotifier struct {
+	mx            sync.Mutex
+	failures      int
+	notifications []Notification
+}
+
+func (r *recordNotifier) Name() string {
+	return "record"
+}
+
+func (r *recordNotifier) Notify(ctx context.Context, notification Notification) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("temporary error")
+	}
+	r.notifications = append(r.notifications, notification)
+	return nil
+}
+
+func TestDispatcherDedup(t *testing.T) {
+	logger.Initialize("info")
+	notifier := &recordNotifier{}
+	dispatcher := NewDispatcher([]Notifier{notifier})
+
+	firing := Alert{Name: "HighCPU", MetricID: "CPUutilization1", State: StateFiring}
+	resolved := Alert{Name: "HighCPU", MetricID: "CPUutilization1", State: StateResolved}
+
+	// алерт сработал и разрешился в пределах одного окна - уведомлять не о чем
+	dispatcher.Enqueue("cpu", firing)
+	dispatcher.Enqueue("cpu", resolved)
+	dispatcher.Flush(context.TODO())
+	dispatcher.Wait()
+	assert.Empty(t, notifier.notifications)
+
+	dispatcher.Enqueue("cpu", firing)
+	dispatcher.Flush(context.TODO())
+	dispatcher.Wait()
+	require.Len(t, notifier.notifications, 1)
+	assert.Equal(t, StateFiring, notifier.notifications[0].Status)
+
+	// повторное срабатывание без разрешения не отправляется
+	dispatcher.Enqueue("cpu", firing)
+	dispatcher.Flush(context.TODO())
+	dispatcher.Wait()
+	require.Len(t, notifier.notifications, 1)
+
+	dispatcher.Enqueue("cpu", resolved)
+	dispatcher.Flush(context.TODO())
+	dispatcher.Wait()
+	require.Len(t, notifier.notifications, 2)
+	assert.Equal(t, StateResolved, notifier.notifications[1].Status)
+}
+
+func TestDispatcherGrouping(t *testing.T) {
+	logger.Initialize("info")
+	notifier := &recordNotifier{}
+	dispatcher := NewDispatcher([]Notifier{notifier})
+
+	dispatcher.Enqueue("cpu1", Alert{Name: "HighCPU", MetricID: "CPUutilization1", State: StateFiring})
+	dispatcher.Enqueue("cpu2", Alert{Name: "HighCPU", MetricID: "CPUutilization2", State: StateFiring})
+	dispatcher.Enqueue("heap", Alert{Name: "HighHeap", MetricID: "HeapAlloc", State: StateFiring})
+	dispatcher.Flush(context.TODO())
+	dispatcher.Wait()
+
+	require.Len(t, notifier.notifications, 2)
+	groups := map[string]int{}
+	for _, notification := range notifier.notifications {
+		groups[notification.GroupKey] = len(notification.Alerts)
+	}
+	assert.Equal(t, map[string]int{"HighCPU": 2, "HighHeap": 1}, groups)
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	logger.Initialize("info")
+	notifier := &recordNotifier{failures: 2}
+	dispatcher := NewDispatcher([]Notifier{notifier}, WithRetry(3, time.Millisecond))
+
+	dispatcher.Enqueue("cpu", Alert{Name: "HighCPU", State: StateFiring})
+	dispatcher.Flush(context.TODO())
+	dispatcher.Wait()
+	assert.Len(t, notifier.notifications, 1)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	const hashKey = "secret"
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if !hashsign.Verify(hashKey, body, r.Header.Get(hashsign.HeaderKey)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		require.NoError(t, json.Unmarshal(body, &received))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	notification := Notification{GroupKey: "HighCPU", Status: StateFiring,
+		Alerts: []Alert{{Name: "HighCPU", MetricID: "CPUutilization1", State: StateFiring, Value: 95}}}
+
+	err := NewWebhookNotifier(server.URL, hashKey).Notify(context.TODO(), notification)
+	require.NoError(t, err)
+	assert.Equal(t, "HighCPU", received.GroupKey)
+	require.Len(t, received.Alerts, 1)
+	assert.Equal(t, 95.0, received.Alerts[0].Value)
+
+	err = NewWebhookNotifier(server.URL, "wrong").Notify(context.TODO(), notification)
+	assert.Error(t, err)
+}
+
+func TestFileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.log")
+	notifier := NewFileNotifier(path)
+
+	require.NoError(t, notifier.Notify(context.TODO(), Notification{GroupKey: "HighCPU", Status: StateFiring}))
+	require.NoError(t, notifier.Notify(context.TODO(), Notification{GroupKey: "HighCPU", Status: StateResolved}))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	statuses := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var notification Notification
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &notification))
+		statuses = append(statuses, notification.Status)
+	}
+	assert.Equal(t, []string{StateFiring, StateResolved}, statuses)
+}
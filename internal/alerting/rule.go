@@ -0,0 +1,169 @@
+// Пакет alerting загружает правила алертинга и вычисляет состояния алертов по метрикам.
+package alerting
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+var ErrInvalidRule = errors.New("invalid alerting rule")
+
+// Операторы сравнения, которые поддерживаются в правилах.
+const (
+	OpGreater        = ">"
+	OpGreaterOrEqual = ">="
+	OpLess           = "<"
+	OpLessOrEqual    = "<="
+	OpEqual          = "=="
+	OpNotEqual       = "!="
+)
+
+// FuncRate функция, которая считает скорость роста counter метрики в секунду.
+const FuncRate = "rate"
+
+// Rule правило алертинга, например `gauge HeapAlloc > 5e8 for 2m`.
+type Rule struct {
+	Name       string            // имя правила, по умолчанию совпадает с выражением
+	Expr       string            // исходное выражение правила
+	Func       string            // функция над значением метрики, пустая или rate
+	MetricType string            // тип метрики: gauge или counter
+	MetricID   string            // имя метрики
+	Selector   repository.Labels // метки, которые должны быть у метрики
+	Op         string            // оператор сравнения
+	Threshold  float64           // порог
+	For        time.Duration     // сколько условие должно выполняться, прежде чем алерт начнет срабатывать
+}
+
+var ruleRegexp = regexp.MustCompile(`^(?:([A-Za-z_][A-Za-z0-9_]*):\s+)?` +
+	`(?:(rate)\(\s*)?(gauge|counter)\s+([^\s{}()]+)(\{[^}]*\})?\s*(\))?` +
+	`\s*(>=|<=|==|!=|>|<)\s*(\S+)` +
+	`(?:\s+for\s+(\S+))?$`)
+
+var selectorRegexp = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*=\s*"((?:[^"\\]|\\.)*)"\s*$`)
+
+// ParseRule разбирает правило из строки вида
+// `[name:] [rate(]<type> <id>[{label="value",...}][)] <op> <threshold> [for <duration>]`.
+func ParseRule(line string) (Rule, error) {
+	line = strings.TrimSpace(line)
+	match := ruleRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return Rule{}, fmt.Errorf("%w: %q", ErrInvalidRule, line)
+	}
+
+	rule := Rule{
+		Name:       match[1],
+		Func:       match[2],
+		MetricType: match[3],
+		MetricID:   match[4],
+		Op:         match[7],
+	}
+
+	if (match[2] == "") != (match[6] == "") {
+		return Rule{}, fmt.Errorf("%w: unbalanced parentheses in %q", ErrInvalidRule, line)
+	}
+	if rule.Func == FuncRate && rule.MetricType != repository.CounterMetricKey {
+		return Rule{}, fmt.Errorf("%w: rate() is supported only for counter metrics", ErrInvalidRule)
+	}
+
+	selector, err := parseSelector(match[5])
+	if err != nil {
+		return Rule{}, err
+	}
+	rule.Selector = selector
+
+	rule.Threshold, err = strconv.ParseFloat(match[8], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w: bad threshold %q", ErrInvalidRule, match[8])
+	}
+
+	if match[9] != "" {
+		rule.For, err = time.ParseDuration(match[9])
+		if err != nil || rule.For < 0 {
+			return Rule{}, fmt.Errorf("%w: bad duration %q", ErrInvalidRule, match[9])
+		}
+	}
+
+	rule.Expr = line
+	if rule.Name != "" {
+		rule.Expr = strings.TrimSpace(strings.TrimPrefix(line, rule.Name+":"))
+	} else {
+		rule.Name = rule.Expr
+	}
+	return rule, nil
+}
+
+func parseSelector(value string) (repository.Labels, error) {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "{"), "}")
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	selector := make(repository.Labels)
+	for _, pair := range strings.Split(value, ",") {
+		match := selectorRegexp.FindStringSubmatch(pair)
+		if match == nil {
+			return nil, fmt.Errorf("%w: bad label selector %q", ErrInvalidRule, pair)
+		}
+		labelValue, err := strconv.Unquote(`"` + match[2] + `"`)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad label value %q", ErrInvalidRule, match[2])
+		}
+		selector[match[1]] = labelValue
+	}
+	return selector, nil
+}
+
+// LoadRules читает правила из файла: одно правило на строку, пустые строки и строки с # пропускаются.
+func LoadRules(path string) ([]Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := make([]Rule, 0)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// Compare сравнивает значение с порогом правила.
+func (r *Rule) Compare(value float64) bool {
+	switch r.Op {
+	case OpGreater:
+		return value > r.Threshold
+	case OpGreaterOrEqual:
+		return value >= r.Threshold
+	case OpLess:
+		return value < r.Threshold
+	case OpLessOrEqual:
+		return value <= r.Threshold
+	case OpEqual:
+		return value == r.Threshold
+	case OpNotEqual:
+		return value != r.Threshold
+	}
+	return false
+}
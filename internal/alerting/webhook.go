@@ -0,0 +1,61 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// WebhookNotifier отправляет уведомления JSON POST запросом.
+// Если задан hashKey, тело подписывается так же, как запросы агента.
+type WebhookNotifier struct {
+	url     string
+	hashKey string
+	client  *http.Client
+}
+
+func NewWebhookNotifier(url string, hashKey string) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:     url,
+		hashKey: hashKey,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook " + w.url
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if w.hashKey != "" {
+		request.Header.Set(hashsign.HeaderKey, hashsign.Sign(w.hashKey, body))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	return nil
+}
@@ -4,8 +4,11 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/rsareader"
@@ -19,14 +22,38 @@ type AgentConfig struct {
 	RateLimit        int
 	RSAPublicKeyPath string
 	RSAKey           *rsa.PublicKey
+	Labels           map[string]string
+	Transport        string
+	GRPCAdress       string
+	SpoolDir         string
+	SpoolMaxBytes    int64
+	SpoolMaxAge      time.Duration
+	BatchSize        int
+	BatchMaxBytes    int
+	BatchLinger      time.Duration
 	configPath       string
 }
 
+// Транспорты, которыми агент может отправлять метрики.
+const (
+	TransportHTTP = "http"
+	TransportGRPC = "grpc"
+)
+
 type jsonConfig struct {
-	Adress           string `json:"address"`
-	ReportInterval   int    `json:"report_interval"`
-	PollInterval     int    `json:"poll_interval"`
-	RSAPublicKeyPath string `json:"crypto_key"`
+	Adress           string            `json:"address"`
+	ReportInterval   int               `json:"report_interval"`
+	PollInterval     int               `json:"poll_interval"`
+	RSAPublicKeyPath string            `json:"crypto_key"`
+	Labels           map[string]string `json:"labels"`
+	Transport        string            `json:"transport"`
+	GRPCAdress       string            `json:"grpc_address"`
+	SpoolDir         string            `json:"spool_dir"`
+	SpoolMaxBytes    int64             `json:"spool_max_bytes"`
+	SpoolMaxAge      string            `json:"spool_max_age"`
+	BatchSize        int               `json:"batch_size"`
+	BatchMaxBytes    int               `json:"batch_max_bytes"`
+	BatchLinger      string            `json:"batch_linger"`
 }
 
 func NewAgentConfig() *AgentConfig {
@@ -39,8 +66,23 @@ func (a *AgentConfig) setDefaultValues() {
 	a.EndPointAdress = "localhost:8080"
 	a.ReportInterval = 10
 	a.PollInterval = 2
+	a.Transport = TransportHTTP
+	a.GRPCAdress = "localhost:3200"
+	a.SpoolMaxBytes = defaultSpoolMaxBytes
+	a.SpoolMaxAge = defaultSpoolMaxAge
+	a.BatchSize = defaultBatchSize
+	a.BatchMaxBytes = defaultBatchMaxBytes
+	a.BatchLinger = defaultBatchLinger
 }
 
+const (
+	defaultSpoolMaxBytes = 64 << 20
+	defaultSpoolMaxAge   = 24 * time.Hour
+	defaultBatchSize     = 100
+	defaultBatchMaxBytes = 1 << 20
+	defaultBatchLinger   = time.Second
+)
+
 func (a *AgentConfig) ParseFlags() {
 	a.registerFlags()
 	flag.Parse()
@@ -65,6 +107,28 @@ func (a *AgentConfig) registerFlags() {
 	flag.StringVar(&a.HashKey, "k", "", "key for sha hash")
 	flag.IntVar(&a.RateLimit, "l", 1, "rate limit goroutines to send metrics")
 	flag.StringVar(&a.RSAPublicKeyPath, "crypto-key", "", "path to RSA public key")
+	flag.Func("labels", "comma separated labels attached to every metric, e.g. host=web-1,service=api", func(value string) error {
+		labels, err := parseLabels(value)
+		if err != nil {
+			return err
+		}
+		a.Labels = labels
+		return nil
+	})
+	flag.Func("transport", "transport to send metrics: http or grpc", func(value string) error {
+		if value != TransportHTTP && value != TransportGRPC {
+			return fmt.Errorf("unknown transport %q", value)
+		}
+		a.Transport = value
+		return nil
+	})
+	flag.StringVar(&a.GRPCAdress, "grpc-address", "localhost:3200", "address and port of server grpc service")
+	flag.StringVar(&a.SpoolDir, "spool-dir", "", "directory to buffer unsent metrics, empty disables spool")
+	flag.Int64Var(&a.SpoolMaxBytes, "spool-max-bytes", defaultSpoolMaxBytes, "max size of spool on disk")
+	flag.DurationVar(&a.SpoolMaxAge, "spool-max-age", defaultSpoolMaxAge, "how long to keep unsent metrics in spool")
+	flag.IntVar(&a.BatchSize, "batch-size", defaultBatchSize, "max number of metrics in one request")
+	flag.IntVar(&a.BatchMaxBytes, "batch-max-bytes", defaultBatchMaxBytes, "max size of one request body before compression")
+	flag.DurationVar(&a.BatchLinger, "batch-linger", defaultBatchLinger, "how long to wait for a batch to fill up")
 	flag.StringVar(&a.configPath, "c", "", "path to json config")
 	flag.StringVar(&a.configPath, "config", "", "path to json config")
 }
@@ -105,6 +169,94 @@ func (a *AgentConfig) checkEnv() {
 	if keyPath := os.Getenv("CRYPTO_KEY"); keyPath != "" {
 		a.RSAPublicKeyPath = keyPath
 	}
+
+	if transport := os.Getenv("TRANSPORT"); transport != "" {
+		a.Transport = transport
+	}
+
+	if grpcAdress := os.Getenv("GRPC_ADDRESS"); grpcAdress != "" {
+		a.GRPCAdress = grpcAdress
+	}
+
+	if spoolDir := os.Getenv("SPOOL_DIR"); spoolDir != "" {
+		a.SpoolDir = spoolDir
+	}
+
+	if envMaxBytes := os.Getenv("SPOOL_MAX_BYTES"); envMaxBytes != "" {
+		maxBytes, err := strconv.ParseInt(envMaxBytes, 10, 64)
+		if err != nil {
+			logger.Log.Errorf("Can't parse SPOOL_MAX_BYTES env! Error %s", err.Error())
+			return
+		}
+
+		a.SpoolMaxBytes = maxBytes
+	}
+
+	if envMaxAge := os.Getenv("SPOOL_MAX_AGE"); envMaxAge != "" {
+		maxAge, err := time.ParseDuration(envMaxAge)
+		if err != nil {
+			logger.Log.Errorf("Can't parse SPOOL_MAX_AGE env! Error %s", err.Error())
+			return
+		}
+
+		a.SpoolMaxAge = maxAge
+	}
+
+	if envBatchSize := os.Getenv("BATCH_SIZE"); envBatchSize != "" {
+		batchSize, err := strconv.Atoi(envBatchSize)
+		if err != nil {
+			logger.Log.Errorf("Can't parse BATCH_SIZE env! Error %s", err.Error())
+			return
+		}
+
+		a.BatchSize = batchSize
+	}
+
+	if envMaxBytes := os.Getenv("BATCH_MAX_BYTES"); envMaxBytes != "" {
+		maxBytes, err := strconv.Atoi(envMaxBytes)
+		if err != nil {
+			logger.Log.Errorf("Can't parse BATCH_MAX_BYTES env! Error %s", err.Error())
+			return
+		}
+
+		a.BatchMaxBytes = maxBytes
+	}
+
+	if envLinger := os.Getenv("BATCH_LINGER"); envLinger != "" {
+		linger, err := time.ParseDuration(envLinger)
+		if err != nil {
+			logger.Log.Errorf("Can't parse BATCH_LINGER env! Error %s", err.Error())
+			return
+		}
+
+		a.BatchLinger = linger
+	}
+
+	if envLabels := os.Getenv("LABELS"); envLabels != "" {
+		labels, err := parseLabels(envLabels)
+		if err != nil {
+			logger.Log.Errorf("Can't parse LABELS env! Error %s", err.Error())
+			return
+		}
+
+		a.Labels = labels
+	}
+}
+
+func parseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		name, labelValue, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must be in name=value form", pair)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(labelValue)
+	}
+	return labels, nil
 }
 
 func (a *AgentConfig) readConfigFile() {
@@ -141,4 +293,50 @@ func (a *AgentConfig) readConfigFile() {
 	if a.RSAPublicKeyPath == "" {
 		a.RSAPublicKeyPath = cfg.RSAPublicKeyPath
 	}
+
+	if len(a.Labels) == 0 {
+		a.Labels = cfg.Labels
+	}
+
+	if a.Transport == TransportHTTP && cfg.Transport != "" {
+		a.Transport = cfg.Transport
+	}
+
+	if a.GRPCAdress == "localhost:3200" && cfg.GRPCAdress != "" {
+		a.GRPCAdress = cfg.GRPCAdress
+	}
+
+	if a.SpoolDir == "" {
+		a.SpoolDir = cfg.SpoolDir
+	}
+
+	if a.SpoolMaxBytes == defaultSpoolMaxBytes && cfg.SpoolMaxBytes > 0 {
+		a.SpoolMaxBytes = cfg.SpoolMaxBytes
+	}
+
+	if a.BatchSize == defaultBatchSize && cfg.BatchSize > 0 {
+		a.BatchSize = cfg.BatchSize
+	}
+
+	if a.BatchMaxBytes == defaultBatchMaxBytes && cfg.BatchMaxBytes > 0 {
+		a.BatchMaxBytes = cfg.BatchMaxBytes
+	}
+
+	if a.BatchLinger == defaultBatchLinger && cfg.BatchLinger != "" {
+		linger, err := time.ParseDuration(cfg.BatchLinger)
+		if err != nil {
+			logger.Log.Errorf("error wile parse batch_linger %v\n", err)
+		} else {
+			a.BatchLinger = linger
+		}
+	}
+
+	if a.SpoolMaxAge == defaultSpoolMaxAge && cfg.SpoolMaxAge != "" {
+		maxAge, err := time.ParseDuration(cfg.SpoolMaxAge)
+		if err != nil {
+			logger.Log.Errorf("error wile parse spool_max_age %v\n", err)
+		} else {
+			a.SpoolMaxAge = maxAge
+		}
+	}
 }
@@ -1,72 +1,221 @@
 package config
 
 import (
-	"crypto/rsa"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"math"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/whynullname/go-collect-metrics/internal/envelope"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
 	"github.com/whynullname/go-collect-metrics/internal/rsareader"
 )
 
 type ServerConfig struct {
-	EndPointAdress    string
-	StoreInterval     uint64
-	FileStoragePath   string
-	RestoreData       bool
-	PostgressAdress   string
-	HashKey           string
-	RSAPrivateKeyPath string
-	RSAKey            *rsa.PrivateKey
-	configPath        string
+	EndPointAdress      string
+	StoreInterval       uint64
+	FileStoragePath     string
+	StoreFormat         string
+	StoreKeyFile        string
+	StoreKeyFromRSA     bool
+	StoreAllowPlaintext bool
+	SnapshotBackups     int
+	SnapshotMaxAge      time.Duration
+	RestoreData         bool
+	RestoreFrom         string
+	WALSyncInterval     time.Duration
+	PostgressAdress     string
+	DBMaxConns          int
+	DBMinConns          int
+	DBConnectTimeout    time.Duration
+	DBHealthCheck       time.Duration
+	DBPingTimeout       time.Duration
+	DBStatementCache    int
+	SelfMetricsInterval time.Duration
+	HashKey             string
+	HashMaxSkew         time.Duration
+	HashNonceCacheSize  int
+	HashStrict          bool
+	HashLegacy          bool
+	AdminToken          string
+	RSAPrivateKeyPath   string
+	RSAKeys             *envelope.KeyRing
+	HistogramBuckets    []float64
+	HistoryRetention    time.Duration
+	IdempotencyTTL      time.Duration
+	AlertRulesPath      string
+	AlertInterval       time.Duration
+	AlertWebhooks       []string
+	AlertLogPath        string
+	AlertGroupWait      time.Duration
+	GRPCAdress          string
+	StatsDAdress        string
+	StatsDFlush         time.Duration
+	configPath          string
 }
 
 type jsonConfig struct {
-	Adress            string `json:"address"`
-	RestoreData       bool   `json:"restore"`
-	StoreInterval     uint64 `json:"store_interval"`
-	StoreFilePath     string `json:"store_file"`
-	PostgressAdress   string `json:"database_dsn"`
-	RSAPrivateKeyPath string `json:"crypto_key"`
+	Adress              string    `json:"address"`
+	RestoreData         bool      `json:"restore"`
+	StoreInterval       *uint64   `json:"store_interval"`
+	StoreFilePath       string    `json:"store_file"`
+	StoreFormat         string    `json:"store_format"`
+	StoreKeyFile        string    `json:"store_key_file"`
+	StoreKeyFromRSA     bool      `json:"store_key_from_rsa"`
+	StoreAllowPlaintext bool      `json:"store_allow_plaintext"`
+	SnapshotBackups     int       `json:"snapshot_backups"`
+	SnapshotMaxAge      string    `json:"snapshot_max_age"`
+	RestoreFrom         string    `json:"restore_from"`
+	WALSyncInterval     string    `json:"wal_sync_interval"`
+	PostgressAdress     string    `json:"database_dsn"`
+	DBMaxConns          int       `json:"db_max_conns"`
+	DBMinConns          int       `json:"db_min_conns"`
+	DBConnectTimeout    string    `json:"db_connect_timeout"`
+	DBHealthCheck       string    `json:"db_health_check_period"`
+	DBPingTimeout       string    `json:"db_ping_timeout"`
+	DBStatementCache    *int      `json:"db_statement_cache"`
+	SelfMetricsInterval string    `json:"self_metrics_interval"`
+	HashMaxSkew         string    `json:"hash_max_skew"`
+	HashNonceCacheSize  int       `json:"hash_nonce_cache_size"`
+	HashStrict          bool      `json:"hash_strict"`
+	HashLegacy          bool      `json:"hash_legacy"`
+	AdminToken          string    `json:"admin_token"`
+	RSAPrivateKeyPath   string    `json:"crypto_key"`
+	HistogramBuckets    []float64 `json:"histogram_buckets"`
+	HistoryRetention    string    `json:"history_retention"`
+	IdempotencyTTL      string    `json:"idempotency_ttl"`
+	AlertRulesPath      string    `json:"alert_rules"`
+	AlertInterval       string    `json:"alert_interval"`
+	AlertWebhooks       []string  `json:"alert_webhooks"`
+	AlertLogPath        string    `json:"alert_log"`
+	AlertGroupWait      string    `json:"alert_group_wait"`
+	GRPCAdress          string    `json:"grpc_address"`
+	StatsDAdress        string    `json:"statsd_address"`
+	StatsDFlush         string    `json:"statsd_flush_interval"`
 }
 
 func NewServerConfig() *ServerConfig {
-	cfg := ServerConfig{}
+	cfg := ServerConfig{RSAKeys: envelope.NewKeyRing()}
 	cfg.setDefaultsValues()
 	return &cfg
 }
 
 func (s *ServerConfig) setDefaultsValues() {
 	s.EndPointAdress = "localhost:8080"
+	s.HistogramBuckets = repository.DefaultHistogramBuckets
+	s.HistoryRetention = defaultHistoryRetention
+	s.IdempotencyTTL = defaultIdempotencyTTL
+	s.AlertInterval = defaultAlertInterval
+	s.AlertGroupWait = defaultAlertGroupWait
+	s.StatsDFlush = defaultStatsDFlush
+	s.HashMaxSkew = defaultHashMaxSkew
+	s.StoreFormat = defaultStoreFormat
+	s.DBConnectTimeout = defaultDBConnectTimeout
+	s.DBHealthCheck = defaultDBHealthCheck
+	s.DBPingTimeout = defaultDBPingTimeout
+	s.DBStatementCache = defaultDBStatementCache
+	s.SelfMetricsInterval = defaultSelfMetricsInterval
+	s.HashNonceCacheSize = defaultHashNonceCacheSize
 }
 
+const (
+	// defaultHistoryRetention история включается явно: она хранит каждое обновление и растет вместе с нагрузкой.
+	defaultHistoryRetention = 0
+	// defaultIdempotencyTTL совпадает со сроком хранения очереди на диске агента по умолчанию.
+	defaultIdempotencyTTL      = 24 * time.Hour
+	defaultAlertInterval       = 15 * time.Second
+	defaultAlertGroupWait      = 30 * time.Second
+	defaultStatsDFlush         = 10 * time.Second
+	defaultHashMaxSkew         = 5 * time.Minute
+	defaultStoreFormat         = "json"
+	defaultDBConnectTimeout    = 5 * time.Second
+	defaultDBHealthCheck       = time.Minute
+	defaultDBPingTimeout       = time.Second
+	defaultDBStatementCache    = 512
+	defaultSelfMetricsInterval = 10 * time.Second
+	// defaultHashNonceCacheSize должен вмещать nonce всех подписанных запросов за окно defaultHashMaxSkew.
+	defaultHashNonceCacheSize = 100000
+)
+
 func (s *ServerConfig) ParseFlags() {
 	s.registerFlags()
 	flag.Parse()
 	s.checkEnvAddr()
 	s.readConfigFile()
+
+	// флаг и переменная окружения проверяются при разборе, бакеты из файла конфигурации - здесь
+	if err := validateBuckets(s.HistogramBuckets); err != nil {
+		logger.Log.Fatalf("Invalid histogram buckets! Error %s", err.Error())
+	}
 }
 
+// ReadRSA загружает закрытые ключи из RSAPrivateKeyPath в RSAKeys.
+// Повторный вызов заменяет набор ключей, так ключи перечитываются по SIGHUP.
 func (s *ServerConfig) ReadRSA() error {
-	key, err := rsareader.ReadPrivateRSAKey(s.RSAPrivateKeyPath)
+	keys, err := rsareader.ReadPrivateRSAKeys(s.RSAPrivateKeyPath)
 	if err != nil {
 		return err
 	}
 
-	s.RSAKey = key
+	s.RSAKeys.Replace(keys...)
 	return nil
 }
 
 func (s *ServerConfig) registerFlags() {
 	flag.StringVar(&s.EndPointAdress, "a", "localhost:8080", "address and port to run server")
-	flag.Uint64Var(&s.StoreInterval, "i", 300, "interval to save all metrics to file")
+	flag.Uint64Var(&s.StoreInterval, "i", 300, "interval in seconds to save all metrics to file, 0 saves them on every update")
 	flag.StringVar(&s.FileStoragePath, "f", "metrics.json", "path to save metrics")
+	flag.StringVar(&s.StoreFormat, "store-format", defaultStoreFormat, "format of metrics snapshot: json, ndjson, gzip or binary")
+	flag.StringVar(&s.StoreKeyFile, "store-key-file", "", "comma separated paths to 32 byte keys to encrypt metrics snapshot, the first one encrypts")
+	flag.BoolVar(&s.StoreKeyFromRSA, "store-key-from-rsa", false, "encrypt metrics snapshot with keys derived from crypto-key")
+	flag.BoolVar(&s.StoreAllowPlaintext, "store-allow-plaintext", false, "one-shot migration: read unencrypted snapshot and wal once and rewrite them encrypted on start")
+	flag.IntVar(&s.SnapshotBackups, "snapshot-backups", 0, "how many timestamped copies of metrics snapshot to keep, 0 means no limit by count")
+	flag.DurationVar(&s.SnapshotMaxAge, "snapshot-max-age", 0, "how long to keep copies of metrics snapshot, 0 means no limit by age")
 	flag.BoolVar(&s.RestoreData, "r", true, "need load saved data in start")
-	flag.StringVar(&s.PostgressAdress, "d", "", "adress to connect postgres")
+	flag.StringVar(&s.RestoreFrom, "restore-from", "", "restore metrics from snapshot copy: path, copy name or RFC3339 time instead of the latest snapshot; the metrics storage must be empty, clear database tables first")
+	flag.DurationVar(&s.WALSyncInterval, "wal-sync-interval", 0, "interval to fsync metrics write-ahead log, 0 syncs after every update")
+	flag.StringVar(&s.PostgressAdress, "d", "", "adress to connect postgres or sqlite:///path/to/metrics.db")
+	flag.IntVar(&s.DBMaxConns, "db-max-conns", 0, "max size of postgres connection pool, 0 uses pgxpool default")
+	flag.IntVar(&s.DBMinConns, "db-min-conns", 0, "min size of postgres connection pool")
+	flag.DurationVar(&s.DBConnectTimeout, "db-connect-timeout", defaultDBConnectTimeout, "timeout to connect postgres")
+	flag.DurationVar(&s.DBHealthCheck, "db-health-check-period", defaultDBHealthCheck, "how often to check idle postgres connections")
+	flag.DurationVar(&s.DBPingTimeout, "db-ping-timeout", defaultDBPingTimeout, "timeout of postgres ping in /ping")
+	flag.IntVar(&s.DBStatementCache, "db-statement-cache", defaultDBStatementCache, "prepared statements to cache per postgres connection, 0 disables cache")
+	flag.DurationVar(&s.SelfMetricsInterval, "self-metrics-interval", defaultSelfMetricsInterval, "interval to save own server metrics, 0 disables them")
 	flag.StringVar(&s.HashKey, "k", "", "key for sha hash")
-	flag.StringVar(&s.RSAPrivateKeyPath, "crypto-key", "", "path to RSA private key")
+	flag.DurationVar(&s.HashMaxSkew, "hash-max-skew", defaultHashMaxSkew, "max clock skew for signed requests with timestamp")
+	flag.IntVar(&s.HashNonceCacheSize, "hash-nonce-cache", defaultHashNonceCacheSize, "how many nonces of signed requests to remember")
+	flag.BoolVar(&s.HashStrict, "hash-strict", false, "reject unsigned requests and grpc write streams when key for sha hash is set")
+	flag.BoolVar(&s.HashLegacy, "hash-legacy", false, "accept old agents signing body only, without timestamp and nonce; such requests can be replayed, ignored in strict mode")
+	flag.StringVar(&s.AdminToken, "admin-token", "", "bearer token for /api/v1/admin endpoints, admin API is disabled when empty")
+	flag.StringVar(&s.RSAPrivateKeyPath, "crypto-key", "", "comma separated paths to RSA private keys or directories with them")
+	flag.Func("histogram-buckets", "comma separated upper bounds of histogram buckets", func(value string) error {
+		buckets, err := parseBuckets(value)
+		if err != nil {
+			return err
+		}
+		s.HistogramBuckets = buckets
+		return nil
+	})
+	flag.DurationVar(&s.HistoryRetention, "history-retention", defaultHistoryRetention, "how long to keep metric history for /api/v1/query_range, history is disabled when 0")
+	flag.DurationVar(&s.IdempotencyTTL, "idempotency-ttl", defaultIdempotencyTTL, "how long to remember idempotency keys of applied batches")
+	flag.StringVar(&s.AlertRulesPath, "alert-rules", "", "path to alerting rules file")
+	flag.DurationVar(&s.AlertInterval, "alert-interval", defaultAlertInterval, "interval to evaluate alerting rules")
+	flag.Func("alert-webhooks", "comma separated webhook urls for alert notifications", func(value string) error {
+		s.AlertWebhooks = parseList(value)
+		return nil
+	})
+	flag.StringVar(&s.AlertLogPath, "alert-log", "", "path to file where alert notifications are appended")
+	flag.DurationVar(&s.AlertGroupWait, "alert-group-wait", defaultAlertGroupWait, "how long to group alert notifications before sending")
+	flag.StringVar(&s.GRPCAdress, "grpc-address", "", "address and port to run grpc server, empty disables grpc")
+	flag.StringVar(&s.StatsDAdress, "statsd-address", "", "udp address to receive statsd metrics, empty disables statsd")
+	flag.DurationVar(&s.StatsDFlush, "statsd-flush-interval", defaultStatsDFlush, "interval to write aggregated statsd metrics")
 	flag.StringVar(&s.configPath, "c", "", "path to json config")
 	flag.StringVar(&s.configPath, "config", "", "path to json config")
 }
@@ -106,13 +255,308 @@ func (s *ServerConfig) checkEnvAddr() {
 		s.PostgressAdress = postgresAdress
 	}
 
+	if storeFormat := os.Getenv("STORE_FORMAT"); storeFormat != "" {
+		s.StoreFormat = storeFormat
+	}
+
+	if storeKeyFile := os.Getenv("STORE_KEY_FILE"); storeKeyFile != "" {
+		s.StoreKeyFile = storeKeyFile
+	}
+
+	if envKeyFromRSA := os.Getenv("STORE_KEY_FROM_RSA"); envKeyFromRSA != "" {
+		fromRSA, err := strconv.ParseBool(envKeyFromRSA)
+		if err != nil {
+			logger.Log.Errorf("Can't parse STORE_KEY_FROM_RSA env! Error %s", err.Error())
+			return
+		}
+
+		s.StoreKeyFromRSA = fromRSA
+	}
+
+	if envAllowPlaintext := os.Getenv("STORE_ALLOW_PLAINTEXT"); envAllowPlaintext != "" {
+		allowPlaintext, err := strconv.ParseBool(envAllowPlaintext)
+		if err != nil {
+			logger.Log.Errorf("Can't parse STORE_ALLOW_PLAINTEXT env! Error %s", err.Error())
+			return
+		}
+
+		s.StoreAllowPlaintext = allowPlaintext
+	}
+
+	if envBackups := os.Getenv("SNAPSHOT_BACKUPS"); envBackups != "" {
+		backups, err := strconv.Atoi(envBackups)
+		if err != nil {
+			logger.Log.Errorf("Can't parse SNAPSHOT_BACKUPS env! Error %s", err.Error())
+			return
+		}
+
+		s.SnapshotBackups = backups
+	}
+
+	if envMaxAge := os.Getenv("SNAPSHOT_MAX_AGE"); envMaxAge != "" {
+		maxAge, err := time.ParseDuration(envMaxAge)
+		if err != nil {
+			logger.Log.Errorf("Can't parse SNAPSHOT_MAX_AGE env! Error %s", err.Error())
+			return
+		}
+
+		s.SnapshotMaxAge = maxAge
+	}
+
+	if restoreFrom := os.Getenv("RESTORE_FROM"); restoreFrom != "" {
+		s.RestoreFrom = restoreFrom
+	}
+
+	if envWALSync := os.Getenv("WAL_SYNC_INTERVAL"); envWALSync != "" {
+		interval, err := time.ParseDuration(envWALSync)
+		if err != nil {
+			logger.Log.Errorf("Can't parse WAL_SYNC_INTERVAL env! Error %s", err.Error())
+			return
+		}
+
+		s.WALSyncInterval = interval
+	}
+
+	if envMaxConns := os.Getenv("DB_MAX_CONNS"); envMaxConns != "" {
+		maxConns, err := strconv.Atoi(envMaxConns)
+		if err != nil {
+			logger.Log.Errorf("Can't parse DB_MAX_CONNS env! Error %s", err.Error())
+			return
+		}
+
+		s.DBMaxConns = maxConns
+	}
+
+	if envMinConns := os.Getenv("DB_MIN_CONNS"); envMinConns != "" {
+		minConns, err := strconv.Atoi(envMinConns)
+		if err != nil {
+			logger.Log.Errorf("Can't parse DB_MIN_CONNS env! Error %s", err.Error())
+			return
+		}
+
+		s.DBMinConns = minConns
+	}
+
+	if envTimeout := os.Getenv("DB_CONNECT_TIMEOUT"); envTimeout != "" {
+		timeout, err := time.ParseDuration(envTimeout)
+		if err != nil {
+			logger.Log.Errorf("Can't parse DB_CONNECT_TIMEOUT env! Error %s", err.Error())
+			return
+		}
+
+		s.DBConnectTimeout = timeout
+	}
+
+	if envHealthCheck := os.Getenv("DB_HEALTH_CHECK_PERIOD"); envHealthCheck != "" {
+		period, err := time.ParseDuration(envHealthCheck)
+		if err != nil {
+			logger.Log.Errorf("Can't parse DB_HEALTH_CHECK_PERIOD env! Error %s", err.Error())
+			return
+		}
+
+		s.DBHealthCheck = period
+	}
+
+	if envPingTimeout := os.Getenv("DB_PING_TIMEOUT"); envPingTimeout != "" {
+		timeout, err := time.ParseDuration(envPingTimeout)
+		if err != nil {
+			logger.Log.Errorf("Can't parse DB_PING_TIMEOUT env! Error %s", err.Error())
+			return
+		}
+
+		s.DBPingTimeout = timeout
+	}
+
+	if envStatementCache := os.Getenv("DB_STATEMENT_CACHE"); envStatementCache != "" {
+		capacity, err := strconv.Atoi(envStatementCache)
+		if err != nil {
+			logger.Log.Errorf("Can't parse DB_STATEMENT_CACHE env! Error %s", err.Error())
+			return
+		}
+
+		s.DBStatementCache = capacity
+	}
+
+	if envSelfMetrics := os.Getenv("SELF_METRICS_INTERVAL"); envSelfMetrics != "" {
+		interval, err := time.ParseDuration(envSelfMetrics)
+		if err != nil {
+			logger.Log.Errorf("Can't parse SELF_METRICS_INTERVAL env! Error %s", err.Error())
+			return
+		}
+
+		s.SelfMetricsInterval = interval
+	}
+
 	if hashKey := os.Getenv("KEY"); hashKey != "" {
 		s.HashKey = hashKey
 	}
 
+	if envSkew := os.Getenv("HASH_MAX_SKEW"); envSkew != "" {
+		skew, err := time.ParseDuration(envSkew)
+		if err != nil {
+			logger.Log.Errorf("Can't parse HASH_MAX_SKEW env! Error %s", err.Error())
+			return
+		}
+
+		s.HashMaxSkew = skew
+	}
+
+	if envNonceCache := os.Getenv("HASH_NONCE_CACHE"); envNonceCache != "" {
+		size, err := strconv.Atoi(envNonceCache)
+		if err != nil {
+			logger.Log.Errorf("Can't parse HASH_NONCE_CACHE env! Error %s", err.Error())
+			return
+		}
+
+		s.HashNonceCacheSize = size
+	}
+
+	if envStrict := os.Getenv("HASH_STRICT"); envStrict != "" {
+		strict, err := strconv.ParseBool(envStrict)
+		if err != nil {
+			logger.Log.Errorf("Can't parse HASH_STRICT env! Error %s", err.Error())
+			return
+		}
+
+		s.HashStrict = strict
+	}
+
+	if envLegacy := os.Getenv("HASH_LEGACY"); envLegacy != "" {
+		legacy, err := strconv.ParseBool(envLegacy)
+		if err != nil {
+			logger.Log.Errorf("Can't parse HASH_LEGACY env! Error %s", err.Error())
+			return
+		}
+
+		s.HashLegacy = legacy
+	}
+
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		s.AdminToken = adminToken
+	}
+
+	if grpcAdress := os.Getenv("GRPC_ADDRESS"); grpcAdress != "" {
+		s.GRPCAdress = grpcAdress
+	}
+
+	if statsdAdress := os.Getenv("STATSD_ADDRESS"); statsdAdress != "" {
+		s.StatsDAdress = statsdAdress
+	}
+
+	if envFlush := os.Getenv("STATSD_FLUSH_INTERVAL"); envFlush != "" {
+		flush, err := time.ParseDuration(envFlush)
+		if err != nil {
+			logger.Log.Errorf("Can't parse STATSD_FLUSH_INTERVAL env! Error %s", err.Error())
+			return
+		}
+
+		s.StatsDFlush = flush
+	}
+
 	if cfgPath := os.Getenv("CONFIG"); cfgPath != "" {
 		s.configPath = cfgPath
 	}
+
+	if envRetention := os.Getenv("HISTORY_RETENTION"); envRetention != "" {
+		retention, err := time.ParseDuration(envRetention)
+		if err != nil {
+			logger.Log.Errorf("Can't parse HISTORY_RETENTION env! Error %s", err.Error())
+			return
+		}
+
+		s.HistoryRetention = retention
+	}
+
+	if envTTL := os.Getenv("IDEMPOTENCY_TTL"); envTTL != "" {
+		ttl, err := time.ParseDuration(envTTL)
+		if err != nil {
+			logger.Log.Errorf("Can't parse IDEMPOTENCY_TTL env! Error %s", err.Error())
+			return
+		}
+
+		s.IdempotencyTTL = ttl
+	}
+
+	if rulesPath := os.Getenv("ALERT_RULES"); rulesPath != "" {
+		s.AlertRulesPath = rulesPath
+	}
+
+	if envInterval := os.Getenv("ALERT_EVAL_INTERVAL"); envInterval != "" {
+		interval, err := time.ParseDuration(envInterval)
+		if err != nil {
+			logger.Log.Errorf("Can't parse ALERT_EVAL_INTERVAL env! Error %s", err.Error())
+			return
+		}
+
+		s.AlertInterval = interval
+	}
+
+	if webhooks := os.Getenv("ALERT_WEBHOOKS"); webhooks != "" {
+		s.AlertWebhooks = parseList(webhooks)
+	}
+
+	if alertLog := os.Getenv("ALERT_LOG"); alertLog != "" {
+		s.AlertLogPath = alertLog
+	}
+
+	if envGroupWait := os.Getenv("ALERT_GROUP_WAIT"); envGroupWait != "" {
+		groupWait, err := time.ParseDuration(envGroupWait)
+		if err != nil {
+			logger.Log.Errorf("Can't parse ALERT_GROUP_WAIT env! Error %s", err.Error())
+			return
+		}
+
+		s.AlertGroupWait = groupWait
+	}
+
+	if envBuckets := os.Getenv("HISTOGRAM_BUCKETS"); envBuckets != "" {
+		buckets, err := parseBuckets(envBuckets)
+		if err != nil {
+			logger.Log.Errorf("Can't parse HISTOGRAM_BUCKETS env! Error %s", err.Error())
+			return
+		}
+
+		s.HistogramBuckets = buckets
+	}
+}
+
+func parseBuckets(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	buckets := make([]float64, 0, len(parts))
+	for _, part := range parts {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bound)
+	}
+	if err := validateBuckets(buckets); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// validateBuckets проверяет, что границы бакетов конечны и строго возрастают.
+func validateBuckets(buckets []float64) error {
+	for i, bound := range buckets {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("histogram bucket bound %v must be finite", bound)
+		}
+		if i > 0 && bound <= buckets[i-1] {
+			return fmt.Errorf("histogram buckets must be strictly increasing")
+		}
+	}
+	return nil
+}
+
+func parseList(value string) []string {
+	output := make([]string, 0)
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			output = append(output, part)
+		}
+	}
+	return output
 }
 
 func (s *ServerConfig) readConfigFile() {
@@ -142,8 +586,9 @@ func (s *ServerConfig) readConfigFile() {
 		s.RestoreData = cfg.RestoreData
 	}
 
-	if s.StoreInterval == 300 {
-		s.StoreInterval = cfg.StoreInterval
+	// 0 включает синхронную запись, поэтому отсутствующее в файле значение не должно его подменять
+	if s.StoreInterval == 300 && cfg.StoreInterval != nil {
+		s.StoreInterval = *cfg.StoreInterval
 	}
 
 	if s.FileStoragePath == "metrics.json" {
@@ -154,7 +599,191 @@ func (s *ServerConfig) readConfigFile() {
 		s.PostgressAdress = cfg.PostgressAdress
 	}
 
+	if s.StoreFormat == defaultStoreFormat && cfg.StoreFormat != "" {
+		s.StoreFormat = cfg.StoreFormat
+	}
+
+	if s.StoreKeyFile == "" {
+		s.StoreKeyFile = cfg.StoreKeyFile
+	}
+
+	if !s.StoreKeyFromRSA {
+		s.StoreKeyFromRSA = cfg.StoreKeyFromRSA
+	}
+
+	if !s.StoreAllowPlaintext {
+		s.StoreAllowPlaintext = cfg.StoreAllowPlaintext
+	}
+
+	if s.SnapshotBackups == 0 {
+		s.SnapshotBackups = cfg.SnapshotBackups
+	}
+
+	if s.SnapshotMaxAge == 0 && cfg.SnapshotMaxAge != "" {
+		maxAge, err := time.ParseDuration(cfg.SnapshotMaxAge)
+		if err != nil {
+			logger.Log.Errorf("error wile parse snapshot_max_age %v\n", err)
+		} else {
+			s.SnapshotMaxAge = maxAge
+		}
+	}
+
+	if s.RestoreFrom == "" {
+		s.RestoreFrom = cfg.RestoreFrom
+	}
+
+	if s.WALSyncInterval == 0 && cfg.WALSyncInterval != "" {
+		interval, err := time.ParseDuration(cfg.WALSyncInterval)
+		if err != nil {
+			logger.Log.Errorf("error wile parse wal_sync_interval %v\n", err)
+		} else {
+			s.WALSyncInterval = interval
+		}
+	}
+
 	if s.RSAPrivateKeyPath == "" {
 		s.RSAPrivateKeyPath = cfg.RSAPrivateKeyPath
 	}
+
+	if s.DBMaxConns == 0 {
+		s.DBMaxConns = cfg.DBMaxConns
+	}
+
+	if s.DBMinConns == 0 {
+		s.DBMinConns = cfg.DBMinConns
+	}
+
+	if s.DBConnectTimeout == defaultDBConnectTimeout && cfg.DBConnectTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.DBConnectTimeout)
+		if err != nil {
+			logger.Log.Errorf("error wile parse db_connect_timeout %v\n", err)
+		} else {
+			s.DBConnectTimeout = timeout
+		}
+	}
+
+	if s.DBHealthCheck == defaultDBHealthCheck && cfg.DBHealthCheck != "" {
+		period, err := time.ParseDuration(cfg.DBHealthCheck)
+		if err != nil {
+			logger.Log.Errorf("error wile parse db_health_check_period %v\n", err)
+		} else {
+			s.DBHealthCheck = period
+		}
+	}
+
+	if s.DBPingTimeout == defaultDBPingTimeout && cfg.DBPingTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.DBPingTimeout)
+		if err != nil {
+			logger.Log.Errorf("error wile parse db_ping_timeout %v\n", err)
+		} else {
+			s.DBPingTimeout = timeout
+		}
+	}
+
+	if s.SelfMetricsInterval == defaultSelfMetricsInterval && cfg.SelfMetricsInterval != "" {
+		interval, err := time.ParseDuration(cfg.SelfMetricsInterval)
+		if err != nil {
+			logger.Log.Errorf("error wile parse self_metrics_interval %v\n", err)
+		} else {
+			s.SelfMetricsInterval = interval
+		}
+	}
+
+	if s.DBStatementCache == defaultDBStatementCache && cfg.DBStatementCache != nil {
+		s.DBStatementCache = *cfg.DBStatementCache
+	}
+
+	if s.HashMaxSkew == defaultHashMaxSkew && cfg.HashMaxSkew != "" {
+		skew, err := time.ParseDuration(cfg.HashMaxSkew)
+		if err != nil {
+			logger.Log.Errorf("error wile parse hash_max_skew %v\n", err)
+		} else {
+			s.HashMaxSkew = skew
+		}
+	}
+
+	if s.HashNonceCacheSize == defaultHashNonceCacheSize && cfg.HashNonceCacheSize > 0 {
+		s.HashNonceCacheSize = cfg.HashNonceCacheSize
+	}
+
+	if !s.HashStrict {
+		s.HashStrict = cfg.HashStrict
+	}
+
+	if !s.HashLegacy {
+		s.HashLegacy = cfg.HashLegacy
+	}
+
+	if s.AdminToken == "" {
+		s.AdminToken = cfg.AdminToken
+	}
+
+	if s.GRPCAdress == "" {
+		s.GRPCAdress = cfg.GRPCAdress
+	}
+
+	if s.StatsDAdress == "" {
+		s.StatsDAdress = cfg.StatsDAdress
+	}
+
+	if s.StatsDFlush == defaultStatsDFlush && cfg.StatsDFlush != "" {
+		flush, err := time.ParseDuration(cfg.StatsDFlush)
+		if err != nil {
+			logger.Log.Errorf("error wile parse statsd_flush_interval %v\n", err)
+		} else {
+			s.StatsDFlush = flush
+		}
+	}
+
+	if s.HistoryRetention == defaultHistoryRetention && cfg.HistoryRetention != "" {
+		retention, err := time.ParseDuration(cfg.HistoryRetention)
+		if err != nil {
+			logger.Log.Errorf("error wile parse history_retention %v\n", err)
+		} else {
+			s.HistoryRetention = retention
+		}
+	}
+
+	if s.IdempotencyTTL == defaultIdempotencyTTL && cfg.IdempotencyTTL != "" {
+		ttl, err := time.ParseDuration(cfg.IdempotencyTTL)
+		if err != nil {
+			logger.Log.Errorf("error wile parse idempotency_ttl %v\n", err)
+		} else {
+			s.IdempotencyTTL = ttl
+		}
+	}
+
+	if s.AlertRulesPath == "" {
+		s.AlertRulesPath = cfg.AlertRulesPath
+	}
+
+	if s.AlertInterval == defaultAlertInterval && cfg.AlertInterval != "" {
+		interval, err := time.ParseDuration(cfg.AlertInterval)
+		if err != nil {
+			logger.Log.Errorf("error wile parse alert_interval %v\n", err)
+		} else {
+			s.AlertInterval = interval
+		}
+	}
+
+	if len(s.AlertWebhooks) == 0 {
+		s.AlertWebhooks = cfg.AlertWebhooks
+	}
+
+	if s.AlertLogPath == "" {
+		s.AlertLogPath = cfg.AlertLogPath
+	}
+
+	if s.AlertGroupWait == defaultAlertGroupWait && cfg.AlertGroupWait != "" {
+		groupWait, err := time.ParseDuration(cfg.AlertGroupWait)
+		if err != nil {
+			logger.Log.Errorf("error wile parse alert_group_wait %v\n", err)
+		} else {
+			s.AlertGroupWait = groupWait
+		}
+	}
+
+	if len(cfg.HistogramBuckets) > 0 && slices.Equal(s.HistogramBuckets, repository.DefaultHistogramBuckets) {
+		s.HistogramBuckets = cfg.HistogramBuckets
+	}
 }
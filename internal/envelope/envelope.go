@@ -0,0 +1,175 @@
+// Пакет envelope реализует гибридное шифрование тела запроса.
+//
+// Для каждого сообщения генерируется случайный ключ AES-256, данные шифруются AES-GCM,
+// а ключ шифруется RSA-OAEP (SHA-256) открытым ключом получателя.
+//
+// Формат сообщения версии 2:
+//
+//	magic "MENV" | version (1 байт) | длина id ключа (1 байт) | id ключа | длина зашифрованного ключа (2 байта, BE) | зашифрованный ключ | nonce (12 байт) | шифротекст
+//
+// В версии 1 нет id ключа, такие сообщения расшифровываются перебором всех ключей.
+// Заголовок целиком передается в AES-GCM как additional data, поэтому подмена любого его поля
+// обнаруживается при расшифровке.
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+)
+
+// Версии формата.
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+// ContentType тип тела зашифрованного запроса. Тип исходного тела передается в параметре inner.
+const ContentType = "application/vnd.metrics.envelope"
+
+const (
+	aesKeySize = 32
+	nonceSize  = 12
+)
+
+var magic = []byte("MENV")
+
+var oaepLabel = []byte("metrics-envelope")
+
+var (
+	ErrInvalidEnvelope    = errors.New("invalid envelope")
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+	ErrUnknownKey         = errors.New("unknown envelope key")
+)
+
+// Seal шифрует plaintext для владельца закрытого ключа, парного publicKey.
+// В заголовок записывается KeyID(publicKey).
+func Seal(publicKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, oaepLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	keyID := KeyID(publicKey)
+	header := make([]byte, 0, len(magic)+4+len(keyID)+len(wrappedKey)+nonceSize)
+	header = append(header, magic...)
+	header = append(header, Version2, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+	header = append(header, nonce...)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(header, nonce, plaintext, header), nil
+}
+
+// Open расшифровывает сообщение, созданное Seal, ключом из ring с id из заголовка.
+func Open(ring *KeyRing, data []byte) ([]byte, error) {
+	if len(data) < len(magic)+1 || !bytes.Equal(data[:len(magic)], magic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidEnvelope)
+	}
+
+	version := data[len(magic)]
+	offset := len(magic) + 1
+
+	var keys []*rsa.PrivateKey
+	switch version {
+	case Version1:
+		keys = ring.Keys()
+	case Version2:
+		if len(data) < offset+1 {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidEnvelope)
+		}
+		idLength := int(data[offset])
+		offset++
+		if len(data) < offset+idLength {
+			return nil, fmt.Errorf("%w: truncated header", ErrInvalidEnvelope)
+		}
+		keyID := string(data[offset : offset+idLength])
+		offset += idLength
+
+		key, ok := ring.Key(keyID)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+		}
+		keys = []*rsa.PrivateKey{key}
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	if len(data) < offset+2 {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidEnvelope)
+	}
+	keyLength := int(binary.BigEndian.Uint16(data[offset:]))
+	offset += 2
+	if len(data) < offset+keyLength+nonceSize {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidEnvelope)
+	}
+
+	wrappedKey := data[offset : offset+keyLength]
+	offset += keyLength
+	nonce := data[offset : offset+nonceSize]
+	offset += nonceSize
+	header := data[:offset]
+
+	for _, privateKey := range keys {
+		key, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, wrappedKey, oaepLabel)
+		if err != nil {
+			continue
+		}
+
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+
+		plaintext, err := gcm.Open(nil, nonce, data[offset:], header)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("%w: can't unwrap key", ErrInvalidEnvelope)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapContentType возвращает Content-Type зашифрованного тела с исходным типом inner.
+func WrapContentType(inner string) string {
+	return mime.FormatMediaType(ContentType, map[string]string{"inner": inner})
+}
+
+// InnerContentType возвращает исходный тип тела, если contentType - тип зашифрованного тела.
+func InnerContentType(contentType string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != ContentType {
+		return "", false
+	}
+	return params["inner"], true
+}
@@ -0,0 +1,103 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+// sealV1 собирает сообщение версии 1 без id ключа.
+func sealV1(t *testing.T, publicKey *rsa.PublicKey, plaintext []byte) []byte {
+	key := make([]byte, aesKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, oaepLabel)
+	require.NoError(t, err)
+	nonce := make([]byte, nonceSize)
+
+	header := append([]byte(nil), magic...)
+	header = append(header, Version1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+	header = append(header, nonce...)
+
+	gcm, err := newGCM(key)
+	require.NoError(t, err)
+	return gcm.Seal(header, nonce, plaintext, header)
+}
+
+func TestSealOpen(t *testing.T) {
+	privateKey := generateKey(t)
+	ring := NewKeyRing(privateKey)
+
+	plaintext := bytes.Repeat([]byte("metrics"), 100000)
+	sealed, err := Seal(&privateKey.PublicKey, plaintext)
+	require.NoError(t, err)
+
+	opened, err := Open(ring, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+
+	_, err = Open(NewKeyRing(generateKey(t)), sealed)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = Open(ring, tampered)
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	wrongVersion := append([]byte(nil), sealed...)
+	wrongVersion[len(magic)] = 9
+	_, err = Open(ring, wrongVersion)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	_, err = Open(ring, sealed[:10])
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := generateKey(t), generateKey(t)
+	ring := NewKeyRing(oldKey, newKey)
+	assert.Len(t, ring.IDs(), 2)
+
+	for _, key := range []*rsa.PrivateKey{oldKey, newKey} {
+		sealed, err := Seal(&key.PublicKey, []byte("payload"))
+		require.NoError(t, err)
+		opened, err := Open(ring, sealed)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("payload"), opened)
+	}
+
+	// сообщения версии 1 без id расшифровываются перебором ключей
+	opened, err := Open(ring, sealV1(t, &oldKey.PublicKey, []byte("legacy")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("legacy"), opened)
+
+	ring.Replace(newKey)
+	sealed, err := Seal(&oldKey.PublicKey, []byte("payload"))
+	require.NoError(t, err)
+	_, err = Open(ring, sealed)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestContentType(t *testing.T) {
+	contentType := WrapContentType("application/json")
+	inner, ok := InnerContentType(contentType)
+	require.True(t, ok)
+	assert.Equal(t, "application/json", inner)
+
+	_, ok = InnerContentType("application/json")
+	assert.False(t, ok)
+}
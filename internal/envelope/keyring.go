@@ -0,0 +1,90 @@
+package envelope
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"sort"
+	"sync"
+)
+
+// keyIDSize число байт отпечатка открытого ключа в идентификаторе.
+const keyIDSize = 8
+
+// KeyID возвращает идентификатор ключа - начало SHA-256 от открытого ключа в hex.
+// Агент и сервер вычисляют его независимо, по открытому и закрытому ключу соответственно.
+func KeyID(publicKey *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(publicKey))
+	return hex.EncodeToString(sum[:keyIDSize])
+}
+
+// KeyRing набор закрытых ключей сервера по идентификаторам. Безопасен для конкурентного использования.
+type KeyRing struct {
+	mx   sync.RWMutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func NewKeyRing(keys ...*rsa.PrivateKey) *KeyRing {
+	ring := &KeyRing{}
+	ring.Replace(keys...)
+	return ring
+}
+
+// Replace атомарно заменяет набор ключей.
+func (k *KeyRing) Replace(keys ...*rsa.PrivateKey) {
+	indexed := make(map[string]*rsa.PrivateKey, len(keys))
+	for _, key := range keys {
+		indexed[KeyID(&key.PublicKey)] = key
+	}
+
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.keys = indexed
+}
+
+// Key возвращает ключ по идентификатору.
+func (k *KeyRing) Key(id string) (*rsa.PrivateKey, bool) {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// Keys возвращает все ключи, отсортированные по идентификатору.
+func (k *KeyRing) Keys() []*rsa.PrivateKey {
+	ids := k.IDs()
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
+	output := make([]*rsa.PrivateKey, 0, len(ids))
+	for _, id := range ids {
+		if key, ok := k.keys[id]; ok {
+			output = append(output, key)
+		}
+	}
+	return output
+}
+
+// IDs возвращает отсортированные идентификаторы ключей.
+func (k *KeyRing) IDs() []string {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
+	output := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		output = append(output, id)
+	}
+	sort.Strings(output)
+	return output
+}
+
+// Len возвращает число ключей.
+func (k *KeyRing) Len() int {
+	if k == nil {
+		return 0
+	}
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	return len(k.keys)
+}
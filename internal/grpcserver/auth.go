@@ -0,0 +1,88 @@
+package grpcserver
+
+import (
+	"context"
+
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	pb "github.com/whynullname/go-collect-metrics/internal/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Подпись вызова передается в метаданных с теми же именами, что и HTTP заголовки подписи.
+// Unary вызов подписывается вместе с сообщением, стрим - только при открытии, поэтому в строгом режиме
+// стримы записи отклоняются: их сообщения ничем не подписаны.
+var writeMethods = map[string]bool{
+	pb.Metrics_UpdateMetrics_FullMethodName: true,
+	pb.Metrics_StreamMetrics_FullMethodName: true,
+}
+
+// auth проверяет подписи вызовов по тем же правилам, что и HTTP: время, nonce и ключ HashKey.
+type auth struct {
+	verifier *hashsign.Verifier
+	strict   bool
+}
+
+// WithAuth включает проверку подписи вызовов. В строгом режиме неподписанные вызовы,
+// изменяющие метрики, и стримы записи отклоняются, чтения проходят без подписи, как GET в HTTP.
+func WithAuth(verifier *hashsign.Verifier, strict bool) Option {
+	return func(s *Server) {
+		s.auth = &auth{verifier: verifier, strict: strict}
+	}
+}
+
+func (a *auth) check(ctx context.Context, method string, message proto.Message) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	signature := firstValue(md, hashsign.HeaderKey)
+	if signature == "" {
+		if a.strict && writeMethods[method] {
+			logger.Log.Infof("Reject unsigned grpc call %s", method)
+			return status.Error(codes.Unauthenticated, "signature required")
+		}
+		return nil
+	}
+
+	body, err := pb.SigningBody(method, message)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := a.verifier.Verify(firstValue(md, hashsign.TimestampHeaderKey), firstValue(md, hashsign.NonceHeaderKey), body, signature); err != nil {
+		logger.Log.Infof("Reject signed grpc call %s: %v", method, err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return nil
+}
+
+func (a *auth) unaryInterceptor(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	message, ok := request.(proto.Message)
+	if !ok {
+		return nil, status.Error(codes.Internal, "unexpected request type")
+	}
+	if err := a.check(ctx, info.FullMethod, message); err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func (a *auth) streamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if a.strict && writeMethods[info.FullMethod] {
+		logger.Log.Infof("Reject grpc stream %s: stream messages are not signed", info.FullMethod)
+		return status.Error(codes.Unauthenticated, "unsigned stream messages are not accepted in strict mode")
+	}
+	if err := a.check(stream.Context(), info.FullMethod, nil); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func firstValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,195 @@
+// Пакет grpcserver предоставляет gRPC сервис приема и чтения метрик.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	pb "github.com/whynullname/go-collect-metrics/internal/proto"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsService реализация pb.MetricsServer поверх MetricsUseCase.
+type MetricsService struct {
+	pb.UnimplementedMetricsServer
+	metricsUseCase *metrics.MetricsUseCase
+}
+
+func NewMetricsService(metricsUseCase *metrics.MetricsUseCase) *MetricsService {
+	return &MetricsService{metricsUseCase: metricsUseCase}
+}
+
+// IdempotencyKeyMetadata ключ метаданных с ключом идемпотентности батча, как заголовок Idempotency-Key в HTTP.
+const IdempotencyKeyMetadata = "idempotency-key"
+
+// UpdateMetrics обновить массив метрик одним батчем. Батч с уже примененным ключом идемпотентности не применяется повторно.
+func (s *MetricsService) UpdateMetrics(ctx context.Context, request *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	updated, err := s.metricsUseCase.UpdateMetricsOnce(ctx, firstValue(md, IdempotencyKeyMetadata), pb.ToMetrics(request.GetMetrics()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.UpdateMetricsResponse{Metrics: pb.FromMetrics(updated)}, nil
+}
+
+// StreamMetrics принимает поток батчей и применяет каждый сразу после получения.
+func (s *MetricsService) StreamMetrics(stream pb.Metrics_StreamMetricsServer) error {
+	var accepted uint64
+	for {
+		request, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.StreamMetricsResponse{Accepted: accepted})
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(request.GetMetrics()) == 0 {
+			continue
+		}
+
+		if _, err := s.metricsUseCase.UpdateMetrics(stream.Context(), pb.ToMetrics(request.GetMetrics())); err != nil {
+			return toStatus(err)
+		}
+		accepted += uint64(len(request.GetMetrics()))
+	}
+}
+
+// GetMetric получить метрику по имени, типу и меткам.
+func (s *MetricsService) GetMetric(ctx context.Context, request *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	metricType := pb.MetricTypeToString(request.GetType())
+	if metricType == "" {
+		return nil, status.Error(codes.InvalidArgument, types.ErrUnsupportedMetricType.Error())
+	}
+
+	metric, err := s.metricsUseCase.GetMetricWithLabels(ctx, metricType, request.GetId(), repository.Labels(request.GetLabels()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.GetMetricResponse{Metric: pb.FromMetric(metric)}, nil
+}
+
+// ListMetrics получить метрики одного или всех типов, отфильтрованные по меткам.
+func (s *MetricsService) ListMetrics(ctx context.Context, request *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	selector := repository.Labels(request.GetLabels())
+
+	var (
+		output []repository.Metric
+		err    error
+	)
+	if request.GetType() == pb.MetricType_METRIC_TYPE_UNSPECIFIED {
+		output, err = s.metricsUseCase.GetAllMetricsByLabels(ctx, selector)
+	} else {
+		metricType := pb.MetricTypeToString(request.GetType())
+		if metricType == "" {
+			return nil, status.Error(codes.InvalidArgument, types.ErrUnsupportedMetricType.Error())
+		}
+		output, err = s.metricsUseCase.GetAllMetricsByType(ctx, metricType)
+		output = repository.FilterByLabels(output, selector.Normalize())
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &pb.ListMetricsResponse{Metrics: pb.FromMetrics(output)}, nil
+}
+
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, types.ErrCantFindMetric):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, types.ErrMetricNilValue),
+		errors.Is(err, types.ErrUnsupportedMetricType),
+		errors.Is(err, types.ErrInvalidHistogram),
+		errors.Is(err, types.ErrHistogramBucketsMismatch),
+		errors.Is(err, types.ErrInvalidLabels),
+		errors.Is(err, types.ErrInvalidIdempotencyKey),
+		errors.Is(err, types.ErrNonFiniteValue):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Server gRPC сервер, который работает рядом с HTTP сервером на отдельном адресе.
+type Server struct {
+	address string
+	server  *grpc.Server
+	auth    *auth
+}
+
+// Option настраивает Server.
+type Option func(*Server)
+
+func NewServer(metricsUseCase *metrics.MetricsUseCase, address string, opts ...Option) *Server {
+	s := &Server{address: address}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	unary := []grpc.UnaryServerInterceptor{loggingUnaryInterceptor}
+	stream := []grpc.StreamServerInterceptor{loggingStreamInterceptor}
+	if s.auth != nil {
+		unary = append(unary, s.auth.unaryInterceptor)
+		stream = append(stream, s.auth.streamInterceptor)
+	}
+	s.server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
+	pb.RegisterMetricsServer(s.server, NewMetricsService(metricsUseCase))
+	return s
+}
+
+// ListenAndServe начинает принимать соединения. Блокируется до остановки сервера.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve принимает соединения на уже открытом listener.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.server.Serve(listener)
+}
+
+// Shutdown дожидается завершения активных вызовов и останавливает сервер.
+func (s *Server) Shutdown() {
+	s.server.GracefulStop()
+}
+
+func loggingUnaryInterceptor(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	response, err := handler(ctx, request)
+	logger.Log.Infow(
+		"New grpc request:",
+		zap.String("method", info.FullMethod),
+		zap.String("code", status.Code(err).String()),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return response, err
+}
+
+func loggingStreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, stream)
+	logger.Log.Infow(
+		"New grpc stream:",
+		zap.String("method", info.FullMethod),
+		zap.String("code", status.Code(err).String()),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return err
+}
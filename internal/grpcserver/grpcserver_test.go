@@ -0,0 +1,210 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/agent/grpcsender"
+	"github.com/whynullname/go-collect-metrics/internal/agent/sender"
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	pb "github.com/whynullname/go-collect-metrics/internal/proto"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func startServer(t *testing.T, opts ...Option) (*metrics.MetricsUseCase, string) {
+	logger.Initialize("info")
+	metricsUseCase := metrics.NewMetricUseCase(inmemory.NewInMemoryRepository())
+	server := NewServer(metricsUseCase, "", opts...)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(server.Shutdown)
+
+	return metricsUseCase, listener.Addr().String()
+}
+
+func TestMetricsService(t *testing.T) {
+	_, address := startServer(t)
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewMetricsClient(conn)
+	ctx := context.TODO()
+
+	response, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 2, Labels: map[string]string{"host": "a"}},
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 3, Labels: map[string]string{"host": "a"}},
+		{Id: "HeapAlloc", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 12.5},
+	}})
+	require.NoError(t, err)
+	require.Len(t, response.GetMetrics(), 3)
+	assert.Equal(t, int64(5), response.GetMetrics()[1].GetDelta())
+
+	metric, err := client.GetMetric(ctx, &pb.GetMetricRequest{
+		Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), metric.GetMetric().GetDelta())
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "Bad"}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.GetMetrics(), 2)
+
+	list, err = client.ListMetrics(ctx, &pb.ListMetricsRequest{Type: pb.MetricType_METRIC_TYPE_GAUGE})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 1)
+	assert.Equal(t, 12.5, list.GetMetrics()[0].GetValue())
+}
+
+func TestStreamMetrics(t *testing.T) {
+	metricsUseCase, address := startServer(t)
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	value := 1.5
+	delta := int64(4)
+	batch := pb.FromMetrics([]repository.Metric{
+		{ID: "HeapAlloc", MType: repository.GaugeMetricKey, Value: &value},
+		{ID: "PollCount", MType: repository.CounterMetricKey, Delta: &delta},
+	})
+	stream, err := pb.NewMetricsClient(conn).StreamMetrics(context.TODO())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: batch}))
+	require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: batch}))
+	response, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), response.GetAccepted())
+
+	counter, err := metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), counter.GetDelta())
+
+	gauge, err := metricsUseCase.GetMetric(context.TODO(), repository.GaugeMetricKey, "HeapAlloc")
+	require.NoError(t, err)
+	assert.Equal(t, value, gauge.GetValue())
+}
+
+func TestSendMetrics(t *testing.T) {
+	metricsUseCase, address := startServer(t)
+	grpcSender, err := grpcsender.NewGRPCSender(address, "")
+	require.NoError(t, err)
+	defer grpcSender.Close()
+
+	delta := int64(4)
+	batch := []repository.Metric{{ID: "PollCount", MType: repository.CounterMetricKey, Delta: &delta}}
+	require.NoError(t, grpcSender.SendMetrics("", batch))
+	require.NoError(t, grpcSender.SendMetrics("", batch))
+
+	counter, err := metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), counter.GetDelta())
+
+	// повтор батча с тем же ключом, например из очереди на диске, не применяется второй раз
+	require.NoError(t, grpcSender.SendMetrics("batch-1", batch))
+	require.NoError(t, grpcSender.SendMetrics("batch-1", batch))
+	counter, err = metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), counter.GetDelta())
+
+	// батч, который сервер не принял, не считается доставленным
+	err = grpcSender.SendMetrics("", []repository.Metric{{ID: "Bad", MType: "unknown"}})
+	assert.ErrorIs(t, err, sender.ErrRejected)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddress := listener.Addr().String()
+	listener.Close()
+	unavailable, err := grpcsender.NewGRPCSender(closedAddress, "")
+	require.NoError(t, err)
+	defer unavailable.Close()
+	assert.ErrorIs(t, unavailable.SendMetrics("", batch), sender.ErrServerUnavailable)
+}
+
+func TestAuth(t *testing.T) {
+	const hashKey = "secret"
+	verifier := hashsign.NewVerifier(hashKey, time.Minute, 100)
+	metricsUseCase, address := startServer(t, WithAuth(verifier, true))
+
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewMetricsClient(conn)
+	request := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 2}}}
+
+	// в строгом режиме неподписанная запись отклоняется, чтение проходит
+	_, err = client.UpdateMetrics(context.TODO(), request)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListMetrics(context.TODO(), &pb.ListMetricsRequest{})
+	assert.NoError(t, err)
+
+	// сообщения стрима не подписаны, в строгом режиме стрим записи отклоняется даже с подписанным открытием
+	streamBody, err := pb.SigningBody(pb.Metrics_StreamMetrics_FullMethodName, nil)
+	require.NoError(t, err)
+	streamPairs := make([]string, 0)
+	for name, value := range hashsign.RequestHeaders(hashKey, streamBody, time.Now()) {
+		streamPairs = append(streamPairs, name, value)
+	}
+	stream, err := client.StreamMetrics(metadata.AppendToOutgoingContext(context.TODO(), streamPairs...))
+	require.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	body, err := pb.SigningBody(pb.Metrics_UpdateMetrics_FullMethodName, request)
+	require.NoError(t, err)
+	headers := hashsign.RequestHeaders(hashKey, body, time.Now())
+	pairs := make([]string, 0, len(headers)*2)
+	for name, value := range headers {
+		pairs = append(pairs, name, value)
+	}
+	signed := metadata.AppendToOutgoingContext(context.TODO(), pairs...)
+	_, err = client.UpdateMetrics(signed, request)
+	require.NoError(t, err)
+	_, err = client.UpdateMetrics(signed, request)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "replayed nonce")
+
+	// подпись покрывает сообщение
+	headers = hashsign.RequestHeaders(hashKey, body, time.Now())
+	pairs = pairs[:0]
+	for name, value := range headers {
+		pairs = append(pairs, name, value)
+	}
+	tampered := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 100}}}
+	_, err = client.UpdateMetrics(metadata.AppendToOutgoingContext(context.TODO(), pairs...), tampered)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	other, err := grpcsender.NewGRPCSender(address, "other")
+	require.NoError(t, err)
+	_, err = other.UpdateMetrics(context.TODO(), pb.ToMetrics(request.GetMetrics()))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	other.Close()
+
+	grpcSender, err := grpcsender.NewGRPCSender(address, hashKey)
+	require.NoError(t, err)
+	_, err = grpcSender.UpdateMetrics(context.TODO(), pb.ToMetrics(request.GetMetrics()))
+	require.NoError(t, err)
+	require.NoError(t, grpcSender.SendMetrics("", pb.ToMetrics(request.GetMetrics())))
+	require.NoError(t, grpcSender.Close())
+
+	counter, err := metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), counter.GetDelta())
+}
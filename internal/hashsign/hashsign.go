@@ -0,0 +1,90 @@
+// Пакет hashsign содержит общую схему подписи тел запросов HMAC-SHA256 с ключом HashKey.
+package hashsign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+const (
+	// HeaderKey заголовок, в котором передается подпись.
+	HeaderKey = "HashSHA256"
+	// TimestampHeaderKey заголовок с unix временем подписи в секундах.
+	TimestampHeaderKey = "HashSHA256-Timestamp"
+	// NonceHeaderKey заголовок с одноразовым случайным значением.
+	NonceHeaderKey = "HashSHA256-Nonce"
+)
+
+const nonceSize = 16
+
+// Sign возвращает hex представление HMAC-SHA256 от data.
+func Sign(key string, data []byte) string {
+	return hex.EncodeToString(sum(key, data))
+}
+
+// Verify проверяет, что signature является подписью data.
+func Verify(key string, data []byte, signature string) bool {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(decoded, sum(key, data))
+}
+
+// SignRequest подписывает тело запроса вместе со временем и nonce,
+// поэтому перехваченный запрос нельзя повторить с другим временем или nonce.
+func SignRequest(key string, timestamp int64, nonce string, body []byte) string {
+	return Sign(key, requestMaterial(timestamp, nonce, body))
+}
+
+// VerifyRequest проверяет подпись, сделанную SignRequest.
+func VerifyRequest(key string, timestamp int64, nonce string, body []byte, signature string) bool {
+	return Verify(key, requestMaterial(timestamp, nonce, body), signature)
+}
+
+// RequestHeaders возвращает заголовки подписи тела body: время, nonce и саму подпись.
+func RequestHeaders(key string, body []byte, now time.Time) map[string]string {
+	timestamp := now.Unix()
+	nonce := NewNonce()
+	return map[string]string{
+		TimestampHeaderKey: strconv.FormatInt(timestamp, 10),
+		NonceHeaderKey:     nonce,
+		HeaderKey:          SignRequest(key, timestamp, nonce, body),
+	}
+}
+
+// HTTPBody возвращает подписываемые данные HTTP запроса: метод и RequestURI перед телом,
+// поэтому подпись нельзя перенести на запрос с другим путем, например на POST /update/counter/X/5.
+func HTTPBody(method, requestURI string, body []byte) []byte {
+	material := make([]byte, 0, len(method)+len(requestURI)+len(body)+2)
+	material = append(material, method...)
+	material = append(material, ' ')
+	material = append(material, requestURI...)
+	material = append(material, '\n')
+	return append(material, body...)
+}
+
+// NewNonce возвращает случайное hex значение для заголовка NonceHeaderKey.
+func NewNonce() string {
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+func requestMaterial(timestamp int64, nonce string, body []byte) []byte {
+	material := strconv.AppendInt(nil, timestamp, 10)
+	material = append(material, '\n')
+	material = append(material, nonce...)
+	material = append(material, '\n')
+	return append(material, body...)
+}
+
+func sum(key string, data []byte) []byte {
+	hash := hmac.New(sha256.New, []byte(key))
+	hash.Write(data)
+	return hash.Sum(nil)
+}
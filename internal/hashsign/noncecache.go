@@ -0,0 +1,41 @@
+package hashsign
+
+import "sync"
+
+// nonceCache помнит последние size nonce. Когда кеш заполнен, вытесняется самый старый nonce.
+// Запросы старше окна допустимого расхождения часов отклоняются по времени,
+// поэтому кеш должен вмещать все nonce, пришедшие за это окно.
+type nonceCache struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []string
+	next  int
+}
+
+func newNonceCache(size int) *nonceCache {
+	size = max(size, 1)
+	return &nonceCache{
+		seen:  make(map[string]struct{}, size),
+		order: make([]string, 0, size),
+	}
+}
+
+// add запоминает nonce. Возвращает false, если nonce уже встречался.
+func (c *nonceCache) add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+
+	if len(c.order) < cap(c.order) {
+		c.order = append(c.order, nonce)
+	} else {
+		delete(c.seen, c.order[c.next])
+		c.order[c.next] = nonce
+		c.next = (c.next + 1) % len(c.order)
+	}
+	c.seen[nonce] = struct{}{}
+	return true
+}
@@ -0,0 +1,60 @@
+package hashsign
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// maxNonceLength ограничивает размер nonce, который попадает в кеш.
+const maxNonceLength = 64
+
+var (
+	ErrBadTimestamp = errors.New("bad signature timestamp")
+	ErrBadNonce     = errors.New("bad signature nonce")
+	ErrBadSignature = errors.New("bad signature")
+	ErrClockSkew    = errors.New("signed request is outside of clock skew window")
+	ErrReplay       = errors.New("replayed request")
+)
+
+// Verifier проверяет подписи SignRequest: подпись, расхождение часов и повтор nonce.
+// Один Verifier должен обслуживать все транспорты с общим ключом, чтобы nonce не повторялся между ними.
+type Verifier struct {
+	key     string
+	maxSkew time.Duration
+	nonces  *nonceCache
+}
+
+// NewVerifier создает Verifier, который помнит nonceCacheSize последних nonce.
+func NewVerifier(key string, maxSkew time.Duration, nonceCacheSize int) *Verifier {
+	return &Verifier{
+		key:     key,
+		maxSkew: maxSkew,
+		nonces:  newNonceCache(nonceCacheSize),
+	}
+}
+
+// Verify проверяет подпись body со временем timestamp (unix секунды строкой) и nonce.
+func (v *Verifier) Verify(timestamp, nonce string, body []byte, signature string) error {
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadTimestamp
+	}
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return ErrBadNonce
+	}
+
+	if !VerifyRequest(v.key, unixTime, nonce, body, signature) {
+		return ErrBadSignature
+	}
+
+	if skew := time.Since(time.Unix(unixTime, 0)).Abs(); skew > v.maxSkew {
+		return ErrClockSkew
+	}
+
+	// nonce запоминается только после проверки подписи, иначе чужие запросы могли бы занять кеш
+	if !v.nonces.add(nonce) {
+		return ErrReplay
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Пакет influx разбирает строки в формате InfluxDB line protocol.
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+var ErrInvalidLine = errors.New("invalid line protocol")
+
+// ParseLines разбирает тело запроса, по одной точке на строку, и возвращает метрики.
+//
+// Каждое поле точки становится отдельной метрикой с ID measurement_field, теги - метками.
+// Дробные и логические поля записываются как gauge, целые (суффиксы i и u) как counter,
+// строковые поля пропускаются. Временная метка точки не используется.
+func ParseLines(body []byte) ([]repository.Metric, error) {
+	output := make([]repository.Metric, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		metrics, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		output = append(output, metrics...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func parseLine(line string) ([]repository.Metric, error) {
+	sections := split(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("%w: expected measurement, fields and optional timestamp", ErrInvalidLine)
+	}
+
+	if len(sections) == 3 {
+		if _, err := strconv.ParseInt(sections[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: bad timestamp %q", ErrInvalidLine, sections[2])
+		}
+	}
+
+	keyParts := split(sections[0], ',')
+	measurement := unescape(keyParts[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("%w: empty measurement", ErrInvalidLine)
+	}
+
+	var labels repository.Labels
+	for _, tag := range keyParts[1:] {
+		pair := split(tag, '=')
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("%w: bad tag %q", ErrInvalidLine, tag)
+		}
+		if labels == nil {
+			labels = make(repository.Labels)
+		}
+		labels[unescape(pair[0])] = unescape(pair[1])
+	}
+
+	output := make([]repository.Metric, 0)
+	for _, field := range split(sections[1], ',') {
+		pair := split(field, '=')
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("%w: bad field %q", ErrInvalidLine, field)
+		}
+
+		metric, ok, err := parseField(measurement+"_"+unescape(pair[0]), pair[1])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		metric.Labels = labels
+		output = append(output, metric)
+	}
+	return output, nil
+}
+
+// parseField возвращает метрику для значения поля. ok == false для строковых полей.
+func parseField(id string, value string) (metric repository.Metric, ok bool, err error) {
+	metric.ID = id
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+			return metric, false, fmt.Errorf("%w: unterminated string in %s", ErrInvalidLine, id)
+		}
+		return metric, false, nil
+	case strings.HasSuffix(value, "i"):
+		delta, err := strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64)
+		if err != nil {
+			return metric, false, fmt.Errorf("%w: bad integer %s=%s", ErrInvalidLine, id, value)
+		}
+		metric.MType = repository.CounterMetricKey
+		metric.Delta = &delta
+	case strings.HasSuffix(value, "u"):
+		unsigned, err := strconv.ParseUint(strings.TrimSuffix(value, "u"), 10, 64)
+		if err != nil || unsigned > math.MaxInt64 {
+			return metric, false, fmt.Errorf("%w: bad unsigned integer %s=%s", ErrInvalidLine, id, value)
+		}
+		delta := int64(unsigned)
+		metric.MType = repository.CounterMetricKey
+		metric.Delta = &delta
+	default:
+		gauge, err := parseFloatOrBool(value)
+		if err != nil || math.IsNaN(gauge) || math.IsInf(gauge, 0) {
+			return metric, false, fmt.Errorf("%w: bad value %s=%s", ErrInvalidLine, id, value)
+		}
+		metric.MType = repository.GaugeMetricKey
+		metric.Value = &gauge
+	}
+	return metric, true, nil
+}
+
+func parseFloatOrBool(value string) (float64, error) {
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// split делит s по sep, пропуская экранированные символы и содержимое строк в кавычках.
+func split(s string, sep byte) []string {
+	output := make([]string, 0)
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				output = append(output, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(output, s[start:])
+}
+
+// unescape убирает экранирование запятых, пробелов и знаков равенства.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		builder.WriteByte(s[i])
+	}
+	return builder.String()
+}
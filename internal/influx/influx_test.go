@@ -0,0 +1,70 @@
+package influx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+func gauge(id string, value float64, labels repository.Labels) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.GaugeMetricKey, Value: &value, Labels: labels}
+}
+
+func counter(id string, delta int64, labels repository.Labels) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.CounterMetricKey, Delta: &delta, Labels: labels}
+}
+
+func TestParseLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []repository.Metric
+		wantErr bool
+	}{
+		{
+			name: "fields and tags",
+			body: "cpu,host=web-1,cpu=cpu0 usage_idle=97.5,usage_user=1.25 1700000000000000000",
+			want: []repository.Metric{
+				gauge("cpu_usage_idle", 97.5, repository.Labels{"host": "web-1", "cpu": "cpu0"}),
+				gauge("cpu_usage_user", 1.25, repository.Labels{"host": "web-1", "cpu": "cpu0"}),
+			},
+		},
+		{
+			name: "integer, unsigned, bool and string fields",
+			body: "net bytes_recv=42i,drops=3u,up=true,iface=\"eth0, main\"",
+			want: []repository.Metric{
+				counter("net_bytes_recv", 42, nil),
+				counter("net_drops", 3, nil),
+				gauge("net_up", 1, nil),
+			},
+		},
+		{
+			name: "escaped names and comments",
+			body: "# comment\n\nmy\\ disk,path=/var\\,log used\\=pct=12\n",
+			want: []repository.Metric{
+				gauge("my disk_used=pct", 12, repository.Labels{"path": "/var,log"}),
+			},
+		},
+		{name: "missing fields", body: "cpu", wantErr: true},
+		{name: "bad value", body: "cpu usage=abc", wantErr: true},
+		{name: "NaN value", body: "cpu usage=NaN", wantErr: true},
+		{name: "infinite value", body: "cpu usage=-Inf", wantErr: true},
+		{name: "bad integer", body: "cpu count=1.5i", wantErr: true},
+		{name: "bad tag", body: "cpu,host usage=1", wantErr: true},
+		{name: "bad timestamp", body: "cpu usage=1 yesterday", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics, err := ParseLines([]byte(test.body))
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, metrics)
+		})
+	}
+}
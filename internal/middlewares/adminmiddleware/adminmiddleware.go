@@ -0,0 +1,34 @@
+// Пакет adminmiddleware защищает административные эндпоинты сервера.
+package adminmiddleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	config "github.com/whynullname/go-collect-metrics/internal/configs/serverconfig"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+const bearerPrefix = "Bearer "
+
+// AdminToken пропускает только запросы с заголовком Authorization: Bearer <AdminToken>.
+// Если AdminToken не задан, административные эндпоинты выключены и отвечают 404.
+func AdminToken(cfg *config.ServerConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.AdminToken == "" {
+				http.Error(w, "admin api is disabled", http.StatusNotFound)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+				logger.Log.Infof("Admin request %s without valid token", r.URL.Path)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -67,6 +67,8 @@ func (c *compressReader) Close() error {
 	return c.zr.Close()
 }
 
+// GZIP распаковывает тело запроса с Content-Encoding: gzip независимо от его типа, например line protocol
+// от Telegraf. Ответ сжимается, только если клиент принимает gzip и ждет text/html или application/json.
 func GZIP(next http.Handler) http.Handler {
 	acceptedContentTypes := []string{
 		"text/html",
@@ -76,6 +78,22 @@ func GZIP(next http.Handler) http.Handler {
 	acceptedContentEncoding := "gzip"
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentEncoding := r.Header.Values("Content-Encoding")
+		for _, encodingType := range contentEncoding {
+			if encodingType == acceptedContentEncoding {
+				cr, err := newCompressReader(r.Body)
+				if err != nil {
+					logger.Log.Infof("error %s", err.Error())
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				r.Body = cr
+				defer cr.Close()
+				break
+			}
+		}
+
 		acceptType := r.Header.Values("Accept")
 		hasAsseptedContentType := false
 		for _, contentType := range acceptType {
@@ -87,36 +105,16 @@ func GZIP(next http.Handler) http.Handler {
 			}
 		}
 
-		if !hasAsseptedContentType {
-			next.ServeHTTP(w, r)
-			return
-		}
-
 		ow := w
-
-		acceptEncoding := r.Header.Values("Accept-Encoding")
-		for _, encodingType := range acceptEncoding {
-			if encodingType == acceptedContentEncoding {
-				cw := newCompressWriter(w)
-				ow = cw
-				defer cw.Close()
-				break
-			}
-		}
-
-		contentEncoding := r.Header.Values("Content-Encoding")
-		for _, encodingType := range contentEncoding {
-			if encodingType == acceptedContentEncoding {
-				cr, err := newCompressReader(r.Body)
-				if err != nil {
-					logger.Log.Infof("error %s", err.Error())
-					w.WriteHeader(http.StatusInternalServerError)
-					return
+		if hasAsseptedContentType {
+			acceptEncoding := r.Header.Values("Accept-Encoding")
+			for _, encodingType := range acceptEncoding {
+				if encodingType == acceptedContentEncoding {
+					cw := newCompressWriter(w)
+					ow = cw
+					defer cw.Close()
+					break
 				}
-
-				r.Body = cr
-				defer cr.Close()
-				break
 			}
 		}
 
@@ -2,43 +2,57 @@ package encryptionmiddleware
 
 import (
 	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
+	"errors"
 	"io"
 	"net/http"
 
 	config "github.com/whynullname/go-collect-metrics/internal/configs/serverconfig"
+	"github.com/whynullname/go-collect-metrics/internal/envelope"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 )
 
+// RSAMiddleware расшифровывает тела запросов с Content-Type envelope.ContentType.
+// Остальные запросы передаются дальше без изменений.
 func RSAMiddleware(cfg *config.ServerConfig) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
-		return rsaDecryptionMiddleware(next, cfg.RSAKey)
+		return rsaDecryptionMiddleware(next, cfg.RSAKeys)
 	}
 }
 
-func rsaDecryptionMiddleware(next http.Handler, privateKey *rsa.PrivateKey) http.Handler {
+func rsaDecryptionMiddleware(next http.Handler, keys *envelope.KeyRing) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if privateKey == nil {
+		innerContentType, encrypted := envelope.InnerContentType(r.Header.Get("Content-Type"))
+		if !encrypted {
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		if keys.Len() == 0 {
+			logger.Log.Infof("Got encrypted body, but server has no private key")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
 		bodyBytes, err := io.ReadAll(r.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-		decryptedBody, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, bodyBytes)
+		decryptedBody, err := envelope.Open(keys, bodyBytes)
 		if err != nil {
 			logger.Log.Errorf("Error while decrypt body %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			if errors.Is(err, envelope.ErrUnsupportedVersion) {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+
 		r.Body = io.NopCloser(bytes.NewReader(decryptedBody))
 		r.ContentLength = int64(len(decryptedBody))
+		r.Header.Set("Content-Type", innerContentType)
 		next.ServeHTTP(w, r)
 	})
 }
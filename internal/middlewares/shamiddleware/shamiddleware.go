@@ -2,54 +2,106 @@ package shamiddleware
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"io"
 	"net/http"
 
 	config "github.com/whynullname/go-collect-metrics/internal/configs/serverconfig"
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 )
 
-const headerKey = "HashSHA256"
+const headerKey = hashsign.HeaderKey
 
-func HashSHA256(cfg *config.ServerConfig) func(http.Handler) http.Handler {
+// HashSHA256 проверяет подпись запроса до вызова обработчика и подписывает тело ответа.
+// Без HashKey запросы пропускаются как есть. В строгом режиме неподписанные запросы,
+// кроме GET и HEAD, отклоняются. Подпись только тела без времени и nonce от старых агентов
+// принимается лишь с HashLegacy и не в строгом режиме: такой запрос можно повторить.
+// verifier проверяет подписи со временем и nonce, его стоит делить с другими транспортами того же ключа.
+func HashSHA256(cfg *config.ServerConfig, verifier *hashsign.Verifier) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
-		return hashSHA256Middleware(next, cfg)
+		return hashSHA256Middleware(next, cfg, verifier)
 	}
 }
 
-func hashSHA256Middleware(next http.Handler, cfg *config.ServerConfig) http.Handler {
+func hashSHA256Middleware(next http.Handler, cfg *config.ServerConfig, verifier *hashsign.Verifier) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		headerHash := r.Header.Get(headerKey)
-		if headerHash == "" {
-			logger.Log.Infof("Header hash empty")
+		if cfg.HashKey == "" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		decodedHash, err := hex.DecodeString(headerHash)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+
+		headerHash := r.Header.Get(headerKey)
+		if headerHash == "" {
+			if cfg.HashStrict && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				logger.Log.Infof("Reject unsigned request %s %s", r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			logger.Log.Infof("Header hash empty")
+			serveSigned(next, w, r, cfg.HashKey)
 			return
 		}
+
 		bodyBytes, err := io.ReadAll(r.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-
 		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-		encodedBody := hmac.New(sha256.New, []byte(cfg.HashKey))
-		encodedBody.Write(bodyBytes)
-		next.ServeHTTP(w, r)
-		if !hmac.Equal(decodedHash, encodedBody.Sum(nil)) {
+
+		var valid bool
+		switch {
+		case r.Header.Get(hashsign.TimestampHeaderKey) != "":
+			err := verifier.Verify(r.Header.Get(hashsign.TimestampHeaderKey), r.Header.Get(hashsign.NonceHeaderKey),
+				hashsign.HTTPBody(r.Method, r.RequestURI, bodyBytes), headerHash)
+			if err != nil {
+				logger.Log.Infof("Reject signed request: %v", err)
+			}
+			valid = err == nil
+		case cfg.HashLegacy && !cfg.HashStrict:
+			valid = hashsign.Verify(cfg.HashKey, bodyBytes, headerHash)
+		default:
+			logger.Log.Infof("Reject request signed without timestamp and nonce")
+		}
+		if !valid {
 			logger.Log.Infof("Bad header hash.\n")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		logger.Log.Infof("New best request with sha hash!\n")
-		w.Header().Set(headerKey, headerHash)
-		w.WriteHeader(http.StatusOK)
+
+		serveSigned(next, w, r, cfg.HashKey)
 	})
 }
+
+// serveSigned вызывает обработчик, буферизует ответ и отправляет его с подписью тела в заголовке HashSHA256.
+func serveSigned(next http.Handler, w http.ResponseWriter, r *http.Request, key string) {
+	sw := &signedWriter{ResponseWriter: w}
+	next.ServeHTTP(sw, r)
+
+	w.Header().Set(headerKey, hashsign.Sign(key, sw.body.Bytes()))
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	w.WriteHeader(sw.status)
+	w.Write(sw.body.Bytes())
+}
+
+// signedWriter копит статус и тело ответа, чтобы подписать тело целиком до отправки.
+type signedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signedWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *signedWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
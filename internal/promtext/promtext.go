@@ -0,0 +1,206 @@
+// Пакет promtext формирует метрики в текстовом формате экспозиции Prometheus.
+package promtext
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// ContentType значение заголовка Content-Type для текстового формата Prometheus.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Write записывает метрики в формате Prometheus.
+// Метрики группируются по имени, для каждой группы пишется строка # TYPE.
+// Если после нормализации имя совпало с метрикой другого типа, метрика пропускается.
+// Если совпали имя и метки метрик одного типа, например a.b и a_b, остается одна серия:
+// метрика, чей ID уже был допустимым именем, иначе с наименьшим ID.
+func Write(w io.Writer, metrics []repository.Metric) error {
+	families := make(map[string][]series)
+	familyTypes := make(map[string]string)
+	names := make([]string, 0)
+
+	for _, metric := range metrics {
+		name := SanitizeName(metric.ID)
+		familyType, ok := familyTypes[name]
+		if !ok {
+			familyTypes[name] = metric.MType
+			names = append(names, name)
+		} else if familyType != metric.MType {
+			continue
+		}
+		labels := exportLabels(&metric)
+		families[name] = append(families[name], series{metric: metric, labels: labels, key: formatLabels(labels, "", "")})
+	}
+
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		family := families[name]
+		sort.Slice(family, func(i, j int) bool {
+			if family[i].key != family[j].key {
+				return family[i].key < family[j].key
+			}
+			if exact := family[i].metric.ID == name; exact != (family[j].metric.ID == name) {
+				return exact
+			}
+			return family[i].metric.ID < family[j].metric.ID
+		})
+
+		bw.WriteString("# TYPE " + name + " " + familyTypes[name] + "\n")
+		for i, s := range family {
+			if i > 0 && family[i-1].key == s.key {
+				continue
+			}
+			writeSample(bw, name, s)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// series метрика с метками в том виде, в котором они попадут в вывод.
+type series struct {
+	metric repository.Metric
+	labels []label
+	key    string
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+// exportLabels приводит имена меток к виду Prometheus. У гистограмм метка le занята границей бакета,
+// поэтому пользовательская le переименовывается в exported_le. Если после этого имена совпали,
+// остается метка с меньшим исходным именем.
+func exportLabels(metric *repository.Metric) []label {
+	names := metric.Labels.Names()
+	labels := make([]label, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		exported := SanitizeLabelName(name)
+		if exported == histogramBucketLabel && metric.MType == repository.HistogramMetricKey {
+			exported = "exported_" + histogramBucketLabel
+		}
+		if seen[exported] {
+			continue
+		}
+		seen[exported] = true
+		labels = append(labels, label{name: exported, value: metric.Labels[name]})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	return labels
+}
+
+// histogramBucketLabel метка с верхней границей бакета гистограммы.
+const histogramBucketLabel = "le"
+
+func writeSample(w *bufio.Writer, name string, s series) {
+	metric := s.metric
+	labels := s.key
+	switch metric.MType {
+	case repository.GaugeMetricKey:
+		w.WriteString(name + labels + " " + FormatFloat(metric.GetValue()) + "\n")
+	case repository.CounterMetricKey:
+		w.WriteString(name + labels + " " + strconv.FormatInt(metric.GetDelta(), 10) + "\n")
+	case repository.HistogramMetricKey:
+		cumulative := metric.CumulativeCounts()
+		for i, bound := range metric.Buckets {
+			w.WriteString(name + "_bucket" + formatLabels(s.labels, histogramBucketLabel, FormatFloat(bound)) + " " + strconv.FormatUint(cumulative[i], 10) + "\n")
+		}
+		w.WriteString(name + "_bucket" + formatLabels(s.labels, histogramBucketLabel, "+Inf") + " " + strconv.FormatUint(metric.GetCount(), 10) + "\n")
+		w.WriteString(name + "_sum" + labels + " " + FormatFloat(metric.GetSum()) + "\n")
+		w.WriteString(name + "_count" + labels + " " + strconv.FormatUint(metric.GetCount(), 10) + "\n")
+	}
+}
+
+// formatLabels формирует блок {name="value",...}. Если extraName не пустой,
+// метка extraName добавляется последней (используется для le у гистограмм).
+func formatLabels(labels []label, extraName string, extraValue string) string {
+	if len(labels) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label.name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(label.value))
+		b.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(labels) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(extraValue))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+// SanitizeName приводит имя метрики к виду [a-zA-Z_:][a-zA-Z0-9_:]*,
+// заменяя недопустимые символы на подчеркивание.
+func SanitizeName(name string) string {
+	if name == "" {
+		return "_"
+	}
+
+	var b strings.Builder
+	b.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// SanitizeLabelName приводит имя метки к виду [a-zA-Z_][a-zA-Z0-9_]*.
+func SanitizeLabelName(name string) string {
+	return strings.ReplaceAll(SanitizeName(name), ":", "_")
+}
+
+// FormatFloat форматирует значение так, как его ожидает Prometheus: NaN, +Inf и -Inf
+// пишутся словами, остальные числа в кратчайшем представлении.
+func FormatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,113 @@
+package promtext
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "valid name", in: "HeapAlloc", want: "HeapAlloc"},
+		{name: "colon and underscore", in: "job:http_total", want: "job:http_total"},
+		{name: "leading digit", in: "1minute", want: "_1minute"},
+		{name: "invalid symbols", in: "cpu.load-avg 1", want: "cpu_load_avg_1"},
+		{name: "empty name", in: "", want: "_"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, SanitizeName(test.in))
+		})
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	assert.Equal(t, "NaN", FormatFloat(math.NaN()))
+	assert.Equal(t, "+Inf", FormatFloat(math.Inf(1)))
+	assert.Equal(t, "-Inf", FormatFloat(math.Inf(-1)))
+	assert.Equal(t, "0.25", FormatFloat(0.25))
+	assert.Equal(t, "1.5e+10", FormatFloat(1.5e10))
+}
+
+func TestWrite(t *testing.T) {
+	value := 12.5
+	delta := int64(7)
+	collision := int64(1)
+	metrics := []repository.Metric{
+		{ID: "PollCount", MType: repository.CounterMetricKey, Delta: &delta},
+		{ID: "Heap.Alloc", MType: repository.GaugeMetricKey, Value: &value},
+		{ID: "Heap-Alloc", MType: repository.CounterMetricKey, Delta: &collision},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, metrics))
+	want := "# TYPE Heap_Alloc gauge\n" +
+		"Heap_Alloc 12.5\n" +
+		"# TYPE PollCount counter\n" +
+		"PollCount 7\n"
+	assert.Equal(t, want, buf.String())
+}
+
+func TestWriteLabels(t *testing.T) {
+	first := 1.0
+	second := 2.0
+	histogram := repository.NewHistogram("latency", []float64{0.5})
+	histogram.Labels = repository.Labels{"host": "b"}
+	histogram.Observe(0.1)
+	metrics := []repository.Metric{
+		{ID: "Alloc", MType: repository.GaugeMetricKey, Value: &second, Labels: repository.Labels{"host": "b", "path": "a\"b\\c"}},
+		{ID: "Alloc", MType: repository.GaugeMetricKey, Value: &first, Labels: repository.Labels{"host": "a"}},
+		*histogram,
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, metrics))
+	want := "# TYPE Alloc gauge\n" +
+		"Alloc{host=\"a\"} 1\n" +
+		"Alloc{host=\"b\",path=\"a\\\"b\\\\c\"} 2\n" +
+		"# TYPE latency histogram\n" +
+		"latency_bucket{host=\"b\",le=\"0.5\"} 1\n" +
+		"latency_bucket{host=\"b\",le=\"+Inf\"} 1\n" +
+		"latency_sum{host=\"b\"} 0.1\n" +
+		"latency_count{host=\"b\"} 1\n"
+	assert.Equal(t, want, buf.String())
+}
+
+func TestWriteCollisions(t *testing.T) {
+	dotted, underscored, other := 1.0, 2.0, 3.0
+	histogram := repository.NewHistogram("latency", []float64{0.5})
+	histogram.Labels = repository.Labels{"le": "user", "host": "a"}
+	histogram.Observe(0.1)
+	metrics := []repository.Metric{
+		// a.b и a_b дают одно имя a_b, вторая серия с теми же метками сломала бы весь scrape
+		{ID: "a.b", MType: repository.GaugeMetricKey, Value: &dotted},
+		{ID: "a_b", MType: repository.GaugeMetricKey, Value: &underscored},
+		{ID: "a-b", MType: repository.GaugeMetricKey, Value: &other, Labels: repository.Labels{"host": "a"}},
+		// метки host.name и host_name тоже совпадают после нормализации
+		{ID: "c", MType: repository.GaugeMetricKey, Value: &other, Labels: repository.Labels{"host.name": "x", "host_name": "y"}},
+		*histogram,
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, metrics))
+	want := "# TYPE a_b gauge\n" +
+		"a_b 2\n" +
+		"a_b{host=\"a\"} 3\n" +
+		"# TYPE c gauge\n" +
+		"c{host_name=\"x\"} 3\n" +
+		"# TYPE latency histogram\n" +
+		"latency_bucket{exported_le=\"user\",host=\"a\",le=\"0.5\"} 1\n" +
+		"latency_bucket{exported_le=\"user\",host=\"a\",le=\"+Inf\"} 1\n" +
+		"latency_sum{exported_le=\"user\",host=\"a\"} 0.1\n" +
+		"latency_count{exported_le=\"user\",host=\"a\"} 1\n"
+	assert.Equal(t, want, buf.String())
+}
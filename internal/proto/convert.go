@@ -0,0 +1,101 @@
+// Пакет proto содержит gRPC сервис метрик и преобразования между protobuf и repository.Metric.
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
+
+import (
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// MetricTypeFromString возвращает protobuf тип по строковому типу метрики.
+func MetricTypeFromString(metricType string) MetricType {
+	switch metricType {
+	case repository.GaugeMetricKey:
+		return MetricType_METRIC_TYPE_GAUGE
+	case repository.CounterMetricKey:
+		return MetricType_METRIC_TYPE_COUNTER
+	case repository.HistogramMetricKey:
+		return MetricType_METRIC_TYPE_HISTOGRAM
+	}
+	return MetricType_METRIC_TYPE_UNSPECIFIED
+}
+
+// MetricTypeToString возвращает строковый тип метрики, для неизвестного типа пустую строку.
+func MetricTypeToString(metricType MetricType) string {
+	switch metricType {
+	case MetricType_METRIC_TYPE_GAUGE:
+		return repository.GaugeMetricKey
+	case MetricType_METRIC_TYPE_COUNTER:
+		return repository.CounterMetricKey
+	case MetricType_METRIC_TYPE_HISTOGRAM:
+		return repository.HistogramMetricKey
+	}
+	return ""
+}
+
+// FromMetric преобразует repository.Metric в protobuf сообщение.
+func FromMetric(metric *repository.Metric) *Metric {
+	output := &Metric{
+		Id:     metric.ID,
+		Type:   MetricTypeFromString(metric.MType),
+		Labels: metric.Labels,
+	}
+
+	switch metric.MType {
+	case repository.GaugeMetricKey:
+		output.Value = metric.GetValue()
+	case repository.CounterMetricKey:
+		output.Delta = metric.GetDelta()
+	case repository.HistogramMetricKey:
+		output.Buckets = metric.Buckets
+		output.Counts = metric.Counts
+		output.Sum = metric.GetSum()
+		output.Count = metric.GetCount()
+	}
+	return output
+}
+
+// ToMetric преобразует protobuf сообщение в repository.Metric.
+// Заполняются только поля, которые имеют смысл для типа метрики.
+func ToMetric(metric *Metric) repository.Metric {
+	output := repository.Metric{
+		ID:     metric.GetId(),
+		MType:  MetricTypeToString(metric.GetType()),
+		Labels: repository.Labels(metric.GetLabels()),
+	}
+
+	switch metric.GetType() {
+	case MetricType_METRIC_TYPE_GAUGE:
+		value := metric.GetValue()
+		output.Value = &value
+	case MetricType_METRIC_TYPE_COUNTER:
+		delta := metric.GetDelta()
+		output.Delta = &delta
+	case MetricType_METRIC_TYPE_HISTOGRAM:
+		sum := metric.GetSum()
+		count := metric.GetCount()
+		output.Buckets = metric.GetBuckets()
+		output.Counts = metric.GetCounts()
+		output.Sum = &sum
+		output.Count = &count
+	}
+	return output
+}
+
+// FromMetrics преобразует слайс repository.Metric в protobuf сообщения.
+func FromMetrics(metrics []repository.Metric) []*Metric {
+	output := make([]*Metric, 0, len(metrics))
+	for i := range metrics {
+		output = append(output, FromMetric(&metrics[i]))
+	}
+	return output
+}
+
+// ToMetrics преобразует protobuf сообщения в слайс repository.Metric.
+func ToMetrics(metrics []*Metric) []repository.Metric {
+	output := make([]repository.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		output = append(output, ToMetric(metric))
+	}
+	return output
+}
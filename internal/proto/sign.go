@@ -0,0 +1,15 @@
+package proto
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// SigningBody возвращает данные, которые подписываются HashKey при вызове method с сообщением message.
+// Для стрима message равен nil, подписывается только его открытие.
+func SigningBody(method string, message proto.Message) ([]byte, error) {
+	body := []byte(method + "\n")
+	if message == nil {
+		return body, nil
+	}
+	return proto.MarshalOptions{Deterministic: true}.MarshalAppend(body, message)
+}
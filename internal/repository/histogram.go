@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+// DefaultHistogramBuckets границы бакетов по умолчанию, совпадают с границами клиентов Prometheus.
+var DefaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// NewHistogram создает пустую гистограмму с заданными границами бакетов.
+func NewHistogram(id string, buckets []float64) *Metric {
+	sum := float64(0)
+	count := uint64(0)
+	return &Metric{
+		ID:      id,
+		MType:   HistogramMetricKey,
+		Buckets: append([]float64(nil), buckets...),
+		Counts:  make([]uint64, len(buckets)+1),
+		Sum:     &sum,
+		Count:   &count,
+	}
+}
+
+// Observe добавляет в гистограмму одно наблюдение.
+func (m *Metric) Observe(v float64) {
+	index := sort.SearchFloat64s(m.Buckets, v)
+	m.Counts[index]++
+	sum := m.GetSum() + v
+	count := m.GetCount() + 1
+	m.Sum = &sum
+	m.Count = &count
+}
+
+// ValidateHistogram проверяет, что границы бакетов возрастают,
+// число счетчиков на единицу больше числа границ, а Count равен сумме счетчиков.
+func (m *Metric) ValidateHistogram() error {
+	if m.Sum == nil || m.Count == nil {
+		return types.ErrMetricNilValue
+	}
+	if math.IsNaN(*m.Sum) || math.IsInf(*m.Sum, 0) {
+		return types.ErrNonFiniteValue
+	}
+
+	if len(m.Counts) != len(m.Buckets)+1 {
+		return fmt.Errorf("%w: expected %d counts, got %d", types.ErrInvalidHistogram, len(m.Buckets)+1, len(m.Counts))
+	}
+
+	for i, bound := range m.Buckets {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("%w: bucket bound must be finite", types.ErrInvalidHistogram)
+		}
+		if i > 0 && bound <= m.Buckets[i-1] {
+			return fmt.Errorf("%w: bucket bounds must be strictly increasing", types.ErrInvalidHistogram)
+		}
+	}
+
+	total := uint64(0)
+	for _, count := range m.Counts {
+		total += count
+	}
+	if total != *m.Count {
+		return fmt.Errorf("%w: count %d doesn't match buckets total %d", types.ErrInvalidHistogram, *m.Count, total)
+	}
+
+	return nil
+}
+
+// MergeHistogram возвращает новую гистограмму, в которой к текущим значениям прибавлены значения delta.
+// Границы бакетов обеих гистограмм должны совпадать.
+func (m *Metric) MergeHistogram(delta *Metric) (*Metric, error) {
+	if len(m.Buckets) != len(delta.Buckets) || len(m.Counts) != len(delta.Counts) {
+		return nil, types.ErrHistogramBucketsMismatch
+	}
+	for i := range m.Buckets {
+		if m.Buckets[i] != delta.Buckets[i] {
+			return nil, types.ErrHistogramBucketsMismatch
+		}
+	}
+
+	merged := m.Clone()
+	for i := range merged.Counts {
+		merged.Counts[i] += delta.Counts[i]
+	}
+	sum := m.GetSum() + delta.GetSum()
+	count := m.GetCount() + delta.GetCount()
+	merged.Sum = &sum
+	merged.Count = &count
+	return &merged, nil
+}
+
+// CumulativeCounts возвращает накопленные значения бакетов, как их отдает Prometheus.
+func (m *Metric) CumulativeCounts() []uint64 {
+	output := make([]uint64, len(m.Counts))
+	total := uint64(0)
+	for i, count := range m.Counts {
+		total += count
+		output[i] = total
+	}
+	return output
+}
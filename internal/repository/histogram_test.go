@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	histogram := NewHistogram("latency", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	assert.Equal(t, []uint64{2, 1, 1}, histogram.Counts)
+	assert.Equal(t, []uint64{2, 3, 4}, histogram.CumulativeCounts())
+	assert.Equal(t, uint64(4), histogram.GetCount())
+	assert.InDelta(t, 3.65, histogram.GetSum(), 1e-9)
+	assert.NoError(t, histogram.ValidateHistogram())
+}
+
+func TestHistogramValidate(t *testing.T) {
+	sum := 1.0
+	count := uint64(2)
+	tests := []struct {
+		name    string
+		metric  Metric
+		wantErr error
+	}{
+		{
+			name:    "counts length mismatch",
+			metric:  Metric{Buckets: []float64{1, 2}, Counts: []uint64{1, 1}, Sum: &sum, Count: &count},
+			wantErr: types.ErrInvalidHistogram,
+		},
+		{
+			name:    "bounds not increasing",
+			metric:  Metric{Buckets: []float64{2, 1}, Counts: []uint64{1, 1, 0}, Sum: &sum, Count: &count},
+			wantErr: types.ErrInvalidHistogram,
+		},
+		{
+			name:    "count doesn't match buckets",
+			metric:  Metric{Buckets: []float64{1}, Counts: []uint64{1, 0}, Sum: &sum, Count: &count},
+			wantErr: types.ErrInvalidHistogram,
+		},
+		{
+			name:    "nil sum",
+			metric:  Metric{Buckets: []float64{1}, Counts: []uint64{1, 1}, Count: &count},
+			wantErr: types.ErrMetricNilValue,
+		},
+		{
+			name:   "valid histogram",
+			metric: Metric{Buckets: []float64{1}, Counts: []uint64{1, 1}, Sum: &sum, Count: &count},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.metric.ValidateHistogram()
+			if test.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	saved := NewHistogram("latency", []float64{1})
+	saved.Observe(0.5)
+	delta := NewHistogram("latency", []float64{1})
+	delta.Observe(2)
+
+	merged, err := saved.MergeHistogram(delta)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 1}, merged.Counts)
+	assert.Equal(t, uint64(2), merged.GetCount())
+	assert.Equal(t, 2.5, merged.GetSum())
+	assert.Equal(t, uint64(1), saved.GetCount(), "source histogram must stay unchanged")
+
+	_, err = saved.MergeHistogram(NewHistogram("latency", []float64{2}))
+	assert.ErrorIs(t, err, types.ErrHistogramBucketsMismatch)
+}
@@ -2,88 +2,229 @@ package inmemory
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/whynullname/go-collect-metrics/internal/repository"
 	"github.com/whynullname/go-collect-metrics/internal/repository/types"
 )
 
+// InMemoryRepo хранит метрики в памяти. Ключ в каждой мапе - имя метрики вместе с метками.
 type InMemoryRepo struct {
-	mx             sync.RWMutex
-	counterMetrics map[string]int64
-	gaugeMetrics   map[string]float64
+	mx               sync.RWMutex
+	counterMetrics   map[string]repository.Metric
+	gaugeMetrics     map[string]repository.Metric
+	histogramMetrics map[string]repository.Metric
+	recordHistory    bool
+	history          map[string][]repository.Sample
+	// idempotencyMx держится все время применения батча с ключом, чтобы повтор ждал первую попытку.
+	idempotencyMx sync.Mutex
+	applied       map[string]appliedBatch
 }
 
-func NewInMemoryRepository() *InMemoryRepo {
-	return &InMemoryRepo{
-		counterMetrics: make(map[string]int64, 0),
-		gaugeMetrics:   make(map[string]float64, 0),
+// appliedBatch результат применения батча с ключом идемпотентности.
+type appliedBatch struct {
+	output    []repository.Metric
+	appliedAt time.Time
+}
+
+// Option настраивает InMemoryRepo.
+type Option func(*InMemoryRepo)
+
+// WithHistory включает сохранение истории значений gauge и counter метрик.
+func WithHistory() Option {
+	return func(i *InMemoryRepo) {
+		i.recordHistory = true
+	}
+}
+
+func NewInMemoryRepository(opts ...Option) *InMemoryRepo {
+	repo := &InMemoryRepo{
+		counterMetrics:   make(map[string]repository.Metric, 0),
+		gaugeMetrics:     make(map[string]repository.Metric, 0),
+		histogramMetrics: make(map[string]repository.Metric, 0),
+		history:          make(map[string][]repository.Sample, 0),
+		applied:          make(map[string]appliedBatch, 0),
+	}
+	for _, opt := range opts {
+		opt(repo)
+	}
+	return repo
+}
+
+func historyKey(metricType string, seriesKey string) string {
+	return metricType + ":" + seriesKey
+}
+
+// appendSample сохраняет текущее значение метрики в историю. Вызывается под блокировкой на запись.
+func (i *InMemoryRepo) appendSample(metric *repository.Metric) {
+	if !i.recordHistory {
+		return
 	}
+
+	value, ok := metric.SampleValue()
+	if !ok {
+		return
+	}
+
+	key := historyKey(metric.MType, metric.Key())
+	i.history[key] = append(i.history[key], repository.Sample{
+		Timestamp: time.Now(),
+		Value:     value,
+	})
 }
 
 func (i *InMemoryRepo) UpdateMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
 	i.mx.Lock()
 	defer i.mx.Unlock()
 
-	switch metric.MType {
-	case repository.GaugeMetricKey:
-		i.gaugeMetrics[metric.ID] = *metric.Value
-	case repository.CounterMetricKey:
-		metricValue, ok := i.counterMetrics[metric.ID]
-		if !ok {
-			i.counterMetrics[metric.ID] = *metric.Delta
-		} else {
-			sum := metricValue + (*metric.Delta)
-			i.counterMetrics[metric.ID] = sum
-			metric.Delta = &sum
-		}
+	output, err := i.applyBatch([]repository.Metric{*metric})
+	if err != nil {
+		return nil, err
 	}
-
-	return metric, nil
+	return &output[0], nil
 }
 
+// UpdateMetrics применяет батч атомарно: если одну из метрик применить нельзя, не меняется ни одна.
 func (i *InMemoryRepo) UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
-	output := make([]repository.Metric, 0)
-	for _, metric := range metrics {
-		updatedMetric, err := i.UpdateMetric(ctx, &metric)
+	i.mx.Lock()
+	defer i.mx.Unlock()
+
+	return i.applyBatch(metrics)
+}
+
+// UpdateMetricsOnce применяет батч только при первом вызове с key, повторные вызовы возвращают сохраненный результат.
+// Батч применяется и ключ запоминается под одной блокировкой, так что ключ есть ровно у примененных батчей.
+func (i *InMemoryRepo) UpdateMetricsOnce(ctx context.Context, key string, metrics []repository.Metric) ([]repository.Metric, error) {
+	i.idempotencyMx.Lock()
+	defer i.idempotencyMx.Unlock()
+
+	if batch, ok := i.applied[key]; ok {
+		return cloneMetrics(batch.output), nil
+	}
+
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	output, err := i.applyBatch(metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	i.applied[key] = appliedBatch{output: cloneMetrics(output), appliedAt: time.Now()}
+	return output, nil
+}
+
+// applyBatch сначала вычисляет состояния всех метрик батча и только потом сохраняет их,
+// поэтому ошибка в середине батча ничего не меняет. Вызывается под блокировкой на запись.
+func (i *InMemoryRepo) applyBatch(metrics []repository.Metric) ([]repository.Metric, error) {
+	pending := make(map[string]repository.Metric, len(metrics))
+	output := make([]repository.Metric, 0, len(metrics))
+	for idx := range metrics {
+		metric := &metrics[idx]
+		stateKey := historyKey(metric.MType, metric.Key())
+		saved, ok := pending[stateKey]
+		if !ok {
+			saved, ok = i.storage(metric.MType)[metric.Key()]
+		}
+
+		next, err := nextState(saved, ok, metric)
 		if err != nil {
 			return nil, err
 		}
-		output = append(output, *updatedMetric)
+		pending[stateKey] = next
+		output = append(output, next)
+	}
+
+	for idx := range output {
+		storage := i.storage(output[idx].MType)
+		if storage == nil {
+			continue
+		}
+		storage[output[idx].Key()] = output[idx].Clone()
+		i.appendSample(&output[idx])
 	}
 	return output, nil
 }
 
-func (i *InMemoryRepo) GetMetric(ctx context.Context, metricName string, metricType string) (*repository.Metric, error) {
-	i.mx.RLock()
-	defer i.mx.RUnlock()
+// storage возвращает мапу метрик типа metricType, для неизвестного типа nil.
+func (i *InMemoryRepo) storage(metricType string) map[string]repository.Metric {
+	switch metricType {
+	case repository.GaugeMetricKey:
+		return i.gaugeMetrics
+	case repository.CounterMetricKey:
+		return i.counterMetrics
+	case repository.HistogramMetricKey:
+		return i.histogramMetrics
+	}
+	return nil
+}
+
+// nextState возвращает состояние метрики после применения к ней metric. exists false, если метрики еще нет.
+func nextState(saved repository.Metric, exists bool, metric *repository.Metric) (repository.Metric, error) {
+	if !exists {
+		return metric.Clone(), nil
+	}
+
+	switch metric.MType {
+	case repository.CounterMetricKey:
+		next := metric.Clone()
+		sum := saved.GetDelta() + metric.GetDelta()
+		next.Delta = &sum
+		return next, nil
+	case repository.HistogramMetricKey:
+		merged, err := saved.MergeHistogram(metric)
+		if err != nil {
+			return repository.Metric{}, err
+		}
+		return *merged, nil
+	}
+	return metric.Clone(), nil
+}
 
-	outputMetric := repository.Metric{
-		MType: metricType,
-		ID:    metricName,
+func (i *InMemoryRepo) DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) error {
+	i.idempotencyMx.Lock()
+	defer i.idempotencyMx.Unlock()
+
+	for key, batch := range i.applied {
+		if batch.appliedAt.Before(before) {
+			delete(i.applied, key)
+		}
+	}
+	return nil
+}
+
+func cloneMetrics(metrics []repository.Metric) []repository.Metric {
+	output := make([]repository.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		output = append(output, metric.Clone())
 	}
-	var err error
+	return output
+}
+
+func (i *InMemoryRepo) GetMetric(ctx context.Context, metricName string, metricType string, labels repository.Labels) (*repository.Metric, error) {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
 
+	var storage map[string]repository.Metric
 	switch metricType {
 	case repository.GaugeMetricKey:
-		metricValue, ok := i.gaugeMetrics[metricName]
-		if ok {
-			outputMetric.Value = &metricValue
-		} else {
-			err = types.ErrCantFindMetric
-		}
+		storage = i.gaugeMetrics
 	case repository.CounterMetricKey:
-		metricValue, ok := i.counterMetrics[metricName]
-		if ok {
-			outputMetric.Delta = &metricValue
-		} else {
-			err = types.ErrCantFindMetric
-		}
+		storage = i.counterMetrics
+	case repository.HistogramMetricKey:
+		storage = i.histogramMetrics
 	default:
-		err = types.ErrUnsupportedMetricType
+		return &repository.Metric{ID: metricName, MType: metricType}, types.ErrUnsupportedMetricType
 	}
 
-	return &outputMetric, err
+	saved, ok := storage[repository.SeriesKey(metricName, labels)]
+	if !ok {
+		return &repository.Metric{ID: metricName, MType: metricType}, types.ErrCantFindMetric
+	}
+
+	output := saved.Clone()
+	return &output, nil
 }
 
 func (i *InMemoryRepo) GetAllMetricsByType(ctx context.Context, metricType string) ([]repository.Metric, error) {
@@ -91,28 +232,65 @@ func (i *InMemoryRepo) GetAllMetricsByType(ctx context.Context, metricType strin
 	defer i.mx.RUnlock()
 	output := make([]repository.Metric, 0)
 
+	var storage map[string]repository.Metric
 	switch metricType {
 	case repository.GaugeMetricKey:
-		for name, value := range i.gaugeMetrics {
-			output = append(output, repository.Metric{
-				ID:    name,
-				MType: repository.GaugeMetricKey,
-				Value: &value,
-			})
-		}
+		storage = i.gaugeMetrics
 	case repository.CounterMetricKey:
-		for name, delta := range i.counterMetrics {
-			output = append(output, repository.Metric{
-				ID:    name,
-				MType: repository.CounterMetricKey,
-				Delta: &delta,
-			})
-		}
+		storage = i.counterMetrics
+	case repository.HistogramMetricKey:
+		storage = i.histogramMetrics
+	}
+
+	for _, metric := range storage {
+		output = append(output, metric.Clone())
 	}
 
 	return output, nil
 }
 
+func (i *InMemoryRepo) GetMetricHistory(ctx context.Context, metricName, metricType string, labels repository.Labels, from, to time.Time) ([]repository.Sample, error) {
+	if metricType != repository.GaugeMetricKey && metricType != repository.CounterMetricKey {
+		return nil, types.ErrUnsupportedMetricType
+	}
+
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+
+	samples := i.history[historyKey(metricType, repository.SeriesKey(metricName, labels))]
+	start := sort.Search(len(samples), func(index int) bool {
+		return !samples[index].Timestamp.Before(from)
+	})
+	end := sort.Search(len(samples), func(index int) bool {
+		return samples[index].Timestamp.After(to)
+	})
+
+	output := make([]repository.Sample, 0)
+	if start < end {
+		output = append(output, samples[start:end]...)
+	}
+	return output, nil
+}
+
+func (i *InMemoryRepo) DeleteHistoryBefore(ctx context.Context, before time.Time) error {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+
+	for key, samples := range i.history {
+		start := sort.Search(len(samples), func(index int) bool {
+			return !samples[index].Timestamp.Before(before)
+		})
+		if start == len(samples) {
+			delete(i.history, key)
+			continue
+		}
+		if start > 0 {
+			i.history[key] = append([]repository.Sample(nil), samples[start:]...)
+		}
+	}
+	return nil
+}
+
 func (i *InMemoryRepo) CloseRepository() {
 
 }
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+// Labels набор меток метрики, например host или service.
+// Вместе с ID и типом метки определяют, какую метрику обновлять.
+type Labels map[string]string
+
+// Normalize удаляет метки с пустым значением. Для пустого набора возвращает nil.
+func (l Labels) Normalize() Labels {
+	if len(l) == 0 {
+		return nil
+	}
+
+	output := make(Labels, len(l))
+	for name, value := range l {
+		if value != "" {
+			output[name] = value
+		}
+	}
+
+	if len(output) == 0 {
+		return nil
+	}
+	return output
+}
+
+// Validate проверяет, что имена меток соответствуют [a-zA-Z_][a-zA-Z0-9_]*.
+func (l Labels) Validate() error {
+	for name := range l {
+		if !isValidLabelName(name) {
+			return fmt.Errorf("%w: %q", types.ErrInvalidLabels, name)
+		}
+	}
+	return nil
+}
+
+// Matches сообщает, содержит ли набор все метки из selector с теми же значениями.
+func (l Labels) Matches(selector Labels) bool {
+	for name, value := range selector {
+		if l[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Names возвращает отсортированные имена меток.
+func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String возвращает каноническое представление меток: name="value" через запятую, по возрастанию имени.
+func (l Labels) String() string {
+	var b strings.Builder
+	for i, name := range l.Names() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[name]))
+	}
+	return b.String()
+}
+
+// SeriesKey возвращает ключ, однозначно определяющий метрику по имени и меткам.
+// Имя и метки экранируются strconv.Quote, поэтому ID вида a{b="c"} не совпадет с ID a и меткой b="c".
+func SeriesKey(id string, labels Labels) string {
+	key := strconv.Quote(id)
+	if len(labels) == 0 {
+		return key
+	}
+
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteByte('{')
+	for i, name := range labels.Names() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Quote(name))
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Key возвращает ключ метрики по имени и меткам.
+func (m *Metric) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// FilterByLabels возвращает метрики, метки которых содержат selector.
+func FilterByLabels(metrics []Metric, selector Labels) []Metric {
+	if len(selector) == 0 {
+		return metrics
+	}
+
+	output := make([]Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.Labels.Matches(selector) {
+			output = append(output, metric)
+		}
+	}
+	return output
+}
+
+func isValidLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
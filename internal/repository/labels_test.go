@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+func TestLabelsString(t *testing.T) {
+	labels := Labels{"service": "api", "host": "web-1"}
+	assert.Equal(t, `host="web-1",service="api"`, labels.String())
+	assert.Equal(t, `"Alloc"{"host"="web-1","service"="api"}`, SeriesKey("Alloc", labels))
+	assert.Equal(t, `"Alloc"`, SeriesKey("Alloc", nil))
+	// ID с фигурными скобками не совпадает с ID с метками
+	assert.NotEqual(t, SeriesKey(`Alloc{host="web-1"}`, nil), SeriesKey("Alloc", Labels{"host": "web-1"}))
+	assert.NotEqual(t, SeriesKey(`Alloc"{"host"="web-1"}`, nil), SeriesKey("Alloc", Labels{"host": "web-1"}))
+}
+
+func TestLabelsNormalize(t *testing.T) {
+	assert.Nil(t, Labels{}.Normalize())
+	assert.Nil(t, Labels{"host": ""}.Normalize())
+	assert.Equal(t, Labels{"host": "a"}, Labels{"host": "a", "dc": ""}.Normalize())
+}
+
+func TestLabelsValidate(t *testing.T) {
+	assert.NoError(t, Labels{"host": "a", "_zone1": "b"}.Validate())
+	assert.ErrorIs(t, Labels{"1host": "a"}.Validate(), types.ErrInvalidLabels)
+	assert.ErrorIs(t, Labels{"host-name": "a"}.Validate(), types.ErrInvalidLabels)
+}
+
+func TestFilterByLabels(t *testing.T) {
+	metrics := []Metric{
+		{ID: "Alloc", Labels: Labels{"host": "a", "service": "api"}},
+		{ID: "Alloc", Labels: Labels{"host": "b", "service": "api"}},
+		{ID: "Alloc"},
+	}
+
+	assert.Len(t, FilterByLabels(metrics, nil), 3)
+	assert.Len(t, FilterByLabels(metrics, Labels{"service": "api"}), 2)
+	filtered := FilterByLabels(metrics, Labels{"host": "b"})
+	assert.Len(t, filtered, 1)
+	assert.Equal(t, "b", filtered[0].Labels["host"])
+}
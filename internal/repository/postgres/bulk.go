@@ -0,0 +1,185 @@
+package postgres
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+// Массивы передаются одним параметром и разворачиваются через unnest,
+// так батч любого размера записывается одним запросом без ограничения на число параметров.
+const (
+	bulkUpsertGaugesQuery = `INSERT INTO gauge_metrics (metric_id, metric_value, metric_labels)
+	SELECT id, value, labels::jsonb FROM unnest($1::text[], $2::float8[], $3::text[]) AS t(id, value, labels)
+	ON CONFLICT (metric_id, metric_labels) DO UPDATE SET metric_value = EXCLUDED.metric_value`
+	// ordinality нужна, чтобы сопоставить итоговые значения с входными строками.
+	bulkUpsertCountersQuery = `WITH input AS (
+		SELECT * FROM unnest($1::text[], $2::int8[], $3::text[]) WITH ORDINALITY AS t(id, delta, labels, n)
+	), upserted AS (
+		INSERT INTO counter_metrics (metric_id, metric_value, metric_labels)
+		SELECT id, delta, labels::jsonb FROM input
+		ON CONFLICT (metric_id, metric_labels) DO UPDATE SET metric_value = counter_metrics.metric_value + EXCLUDED.metric_value
+		RETURNING metric_id, metric_labels, metric_value
+	)
+	SELECT input.n, upserted.metric_value FROM upserted
+	JOIN input ON input.id = upserted.metric_id AND input.labels::jsonb = upserted.metric_labels`
+	bulkInsertSamplesQuery = `INSERT INTO metric_samples (metric_type, metric_id, metric_labels, sampled_at, metric_value)
+	SELECT metric_type, id, labels::jsonb, now(), value
+	FROM unnest($1::text[], $2::text[], $3::text[], $4::float8[]) AS t(metric_type, id, labels, value)`
+)
+
+// bulkRow одна строка таблицы после схлопывания повторов метрики внутри батча.
+type bulkRow struct {
+	key     string
+	id      string
+	labels  string
+	value   float64
+	delta   int64
+	indexes []int // позиции метрики во входном батче
+}
+
+// groupRows схлопывает метрики с одинаковым идентификатором: INSERT ... ON CONFLICT не может
+// обновить одну строку дважды. Gauge получает последнее значение, counter сумму Delta.
+// Строки сортируются по ключу, чтобы параллельные батчи блокировали строки в одном порядке.
+func groupRows(metrics []repository.Metric, indexes []int) []*bulkRow {
+	byKey := make(map[string]*bulkRow, len(indexes))
+	rows := make([]*bulkRow, 0, len(indexes))
+	for _, i := range indexes {
+		metric := &metrics[i]
+		key := metric.Key()
+		row, ok := byKey[key]
+		if !ok {
+			row = &bulkRow{key: key, id: metric.ID, labels: labelsJSON(metric.Labels)}
+			byKey[key] = row
+			rows = append(rows, row)
+		}
+		row.value = metric.GetValue()
+		row.delta += metric.GetDelta()
+		row.indexes = append(row.indexes, i)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].key < rows[j].key
+	})
+	return rows
+}
+
+// updateMetricsWithTx записывает все gauge батча одним запросом и все counter другим.
+// Гистограммы объединяются в Go, поэтому пишутся по одной.
+// Результат совпадает с поочередным применением: для counter возвращается накопленное значение после каждой метрики.
+func (p *Postgres) updateMetricsWithTx(ctx context.Context, tx pgx.Tx, metrics []repository.Metric) ([]repository.Metric, error) {
+	output := make([]repository.Metric, len(metrics))
+	var gauges, counters []int
+	for i := range metrics {
+		switch metrics[i].MType {
+		case repository.GaugeMetricKey:
+			gauges = append(gauges, i)
+			output[i] = metrics[i].Clone()
+		case repository.CounterMetricKey:
+			counters = append(counters, i)
+			output[i] = metrics[i].Clone()
+		case repository.HistogramMetricKey:
+			histogram, err := p.UpdateHistogramMetricWithTx(ctx, tx, &metrics[i])
+			if err != nil {
+				return nil, err
+			}
+			output[i] = *histogram
+		default:
+			return nil, types.ErrUnsupportedMetricType
+		}
+	}
+
+	if err := p.bulkUpsertGauges(ctx, tx, groupRows(metrics, gauges)); err != nil {
+		return nil, err
+	}
+	if err := p.bulkUpsertCounters(ctx, tx, groupRows(metrics, counters), output); err != nil {
+		return nil, err
+	}
+	if err := p.bulkInsertSamples(ctx, tx, output); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (p *Postgres) bulkUpsertGauges(ctx context.Context, tx pgx.Tx, rows []*bulkRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	ids, values, labels := make([]string, len(rows)), make([]float64, len(rows)), make([]string, len(rows))
+	for i, row := range rows {
+		ids[i], values[i], labels[i] = row.id, row.value, row.labels
+	}
+	_, err := tx.Exec(ctx, bulkUpsertGaugesQuery, ids, values, labels)
+	return err
+}
+
+// bulkUpsertCounters прибавляет суммы Delta и проставляет в output накопленные значения.
+func (p *Postgres) bulkUpsertCounters(ctx context.Context, tx pgx.Tx, rows []*bulkRow, output []repository.Metric) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	ids, deltas, labels := make([]string, len(rows)), make([]int64, len(rows)), make([]string, len(rows))
+	for i, row := range rows {
+		ids[i], deltas[i], labels[i] = row.id, row.delta, row.labels
+	}
+
+	result, err := tx.Query(ctx, bulkUpsertCountersQuery, ids, deltas, labels)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var n int
+		var total int64
+		if err := result.Scan(&n, &total); err != nil {
+			return err
+		}
+
+		setCounterTotals(rows[n-1], total, output)
+	}
+	return result.Err()
+}
+
+// setCounterTotals заменяет Delta метрик строки row накопленными значениями.
+// Итоговое значение относится к последней метрике, для предыдущих из него вычитаются более поздние Delta.
+func setCounterTotals(row *bulkRow, total int64, output []repository.Metric) {
+	for j := len(row.indexes) - 1; j >= 0; j-- {
+		metric := &output[row.indexes[j]]
+		delta := metric.GetDelta()
+		value := total
+		metric.Delta = &value
+		total -= delta
+	}
+}
+
+func (p *Postgres) bulkInsertSamples(ctx context.Context, tx pgx.Tx, metrics []repository.Metric) error {
+	if !p.recordHistory {
+		return nil
+	}
+
+	var metricTypes, ids, labels []string
+	var values []float64
+	for i := range metrics {
+		value, ok := metrics[i].SampleValue()
+		if !ok {
+			continue
+		}
+		metricTypes = append(metricTypes, metrics[i].MType)
+		ids = append(ids, metrics[i].ID)
+		labels = append(labels, labelsJSON(metrics[i].Labels))
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx, bulkInsertSamplesQuery, metricTypes, ids, labels, values)
+	return err
+}
@@ -0,0 +1,101 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+func counter(id string, delta int64, labels repository.Labels) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.CounterMetricKey, Delta: &delta, Labels: labels}
+}
+
+func gauge(id string, value float64) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.GaugeMetricKey, Value: &value}
+}
+
+func TestGroupRows(t *testing.T) {
+	metrics := []repository.Metric{
+		counter("PollCount", 1, nil),
+		gauge("Alloc", 1),
+		counter("PollCount", 2, repository.Labels{"host": "a"}),
+		counter("PollCount", 3, nil),
+		gauge("Alloc", 2),
+	}
+
+	counters := groupRows(metrics, []int{0, 2, 3})
+	require.Len(t, counters, 2)
+	assert.Equal(t, int64(4), counters[0].delta)
+	assert.Equal(t, []int{0, 3}, counters[0].indexes)
+	assert.Equal(t, `{"host":"a"}`, counters[1].labels)
+
+	gauges := groupRows(metrics, []int{1, 4})
+	require.Len(t, gauges, 1)
+	assert.Equal(t, 2.0, gauges[0].value, "last value wins")
+}
+
+func TestSetCounterTotals(t *testing.T) {
+	output := []repository.Metric{counter("PollCount", 1, nil), counter("PollCount", 3, nil), counter("PollCount", 5, nil)}
+	row := &bulkRow{indexes: []int{0, 1, 2}}
+
+	// в базе было 10, батч добавил 9
+	setCounterTotals(row, 19, output)
+	assert.Equal(t, int64(11), output[0].GetDelta())
+	assert.Equal(t, int64(14), output[1].GetDelta())
+	assert.Equal(t, int64(19), output[2].GetDelta())
+}
+
+// BenchmarkUpdateMetrics сравнивает поштучную запись и запись батчем из 10000 метрик.
+// Нужна база в DATABASE_DSN, без нее бенчмарк пропускается.
+func BenchmarkUpdateMetrics(b *testing.B) {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("DATABASE_DSN is not set")
+	}
+
+	repo, err := NewPostgresRepo(dsn)
+	require.NoError(b, err)
+	defer repo.CloseRepository()
+
+	const batchSize = 10000
+	batch := make([]repository.Metric, 0, batchSize)
+	for i := 0; i < batchSize/2; i++ {
+		batch = append(batch, gauge("BenchGauge"+strconv.Itoa(i), float64(i)))
+		batch = append(batch, counter("BenchCounter"+strconv.Itoa(i), 1, nil))
+	}
+	ctx := context.Background()
+
+	b.Run("row_by_row", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tx, err := repo.pool.Begin(ctx)
+			require.NoError(b, err)
+			for j := range batch {
+				metric := batch[j]
+				if metric.MType == repository.GaugeMetricKey {
+					_, err = repo.UpdateGaugeMetricWithTx(ctx, tx, &metric)
+				} else {
+					_, err = repo.UpdateCounterMetricValueWithTx(ctx, tx, &metric)
+				}
+				require.NoError(b, err)
+			}
+			require.NoError(b, tx.Commit(ctx))
+		}
+	})
+
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := repo.UpdateMetrics(ctx, batch)
+			require.NoError(b, err)
+		}
+	})
+
+	_, err = repo.pool.Exec(ctx, "DELETE FROM gauge_metrics WHERE metric_id LIKE 'BenchGauge%'")
+	require.NoError(b, err)
+	_, err = repo.pool.Exec(ctx, "DELETE FROM counter_metrics WHERE metric_id LIKE 'BenchCounter%'")
+	require.NoError(b, err)
+}
@@ -0,0 +1,285 @@
+// Пакет migrations содержит версионные миграции схемы Postgres и их применение.
+// Файлы миграций встраиваются в бинарник и называются <версия>_<имя>.up.sql и <версия>_<имя>.down.sql.
+// Примененные версии хранятся в таблице schema_migrations.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockKey ключ advisory lock, чтобы несколько серверов не применяли миграции одновременно.
+const lockKey = 7243001
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+var (
+	// ErrInvalidMigrations набор файлов миграций некорректен.
+	ErrInvalidMigrations = errors.New("invalid migrations")
+	// ErrUnknownVersion в базе применена версия, о которой не знает бинарник.
+	ErrUnknownVersion = errors.New("unknown schema version")
+	// ErrInvalidSteps число шагов отката не положительное или больше числа примененных миграций.
+	ErrInvalidSteps = errors.New("invalid rollback steps")
+)
+
+// Migration одна версия схемы.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Load читает встроенные миграции, отсортированные по версии.
+func Load() ([]Migration, error) {
+	return load(files, "sql")
+}
+
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := fileNamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%w: bad file name %s", ErrInvalidMigrations, entry.Name())
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("%w: bad version in %s", ErrInvalidMigrations, entry.Name())
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("%w: version %d has different names", ErrInvalidMigrations, version)
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	output := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("%w: version %d needs both up and down files", ErrInvalidMigrations, migration.Version)
+		}
+		output = append(output, *migration)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Version < output[j].Version
+	})
+	return output, nil
+}
+
+// Migrator применяет и откатывает миграции.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator создает Migrator со встроенными миграциями.
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Latest последняя известная версия схемы.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version возвращает текущую версию схемы, 0 если миграции не применялись.
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	if err := m.ensureTable(ctx, m.db); err != nil {
+		return 0, err
+	}
+	return currentVersion(ctx, m.db)
+}
+
+// Up применяет все непримененные миграции.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down откатывает steps последних примененных миграций.
+// Как и To, отказывается работать с неизвестной версией в базе и не откатывает больше, чем применено.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSteps, steps)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		version, err := m.knownVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		applied := m.index(version) + 1
+		if steps > applied {
+			return fmt.Errorf("%w: %d steps requested, %d migrations applied", ErrInvalidSteps, steps, applied)
+		}
+		target := int64(0)
+		if applied > steps {
+			target = m.migrations[applied-steps-1].Version
+		}
+		return m.migrate(ctx, conn, version, target)
+	})
+}
+
+// To приводит схему к версии target, применяя или откатывая миграции.
+func (m *Migrator) To(ctx context.Context, target int64) error {
+	if target != 0 && m.index(target) < 0 {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, target)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		version, err := m.knownVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		return m.migrate(ctx, conn, version, target)
+	})
+}
+
+// knownVersion возвращает текущую версию схемы и проверяет, что бинарник о ней знает.
+func (m *Migrator) knownVersion(ctx context.Context, conn *sql.Conn) (int64, error) {
+	version, err := currentVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if version != 0 && m.index(version) < 0 {
+		return 0, fmt.Errorf("%w: database is at %d, latest known is %d", ErrUnknownVersion, version, m.Latest())
+	}
+	return version, nil
+}
+
+// migrate применяет или откатывает миграции от version до target. Вызывается под withLock.
+func (m *Migrator) migrate(ctx context.Context, conn *sql.Conn, version, target int64) error {
+	for _, migration := range m.migrations {
+		if migration.Version > version && migration.Version <= target {
+			if err := m.apply(ctx, conn, migration, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= version && migration.Version > target {
+			if err := m.apply(ctx, conn, migration, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) index(version int64) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply выполняет up или down миграции вместе с записью в schema_migrations в одной транзакции.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query, direction := migration.Up, "up"
+	if !up {
+		query, direction = migration.Down, "down"
+	}
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("migration %d_%s %s: %w", migration.Version, migration.Name, direction, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.Log.Infof("Migration %d_%s %s applied", migration.Version, migration.Name, direction)
+	return nil
+}
+
+// withLock выполняет operation на отдельном соединении под advisory lock.
+func (m *Migrator) withLock(ctx context.Context, operation func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	if err := m.ensureTable(ctx, conn); err != nil {
+		return err
+	}
+	return operation(conn)
+}
+
+// execQueryer общий интерфейс *sql.DB и *sql.Conn.
+type execQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, db execQueryer) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+	(version bigint PRIMARY KEY, name varchar(150) NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())`)
+	return err
+}
+
+func currentVersion(ctx context.Context, db execQueryer) (int64, error) {
+	var version int64
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEmbedded(t *testing.T) {
+	migrations, err := Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	assert.Equal(t, int64(1), migrations[0].Version)
+	assert.Contains(t, migrations[0].Up, "UNIQUE (metric_id, metric_labels)")
+
+	for i := 1; i < len(migrations); i++ {
+		assert.Greater(t, migrations[i].Version, migrations[i-1].Version)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		wantErr  bool
+		versions []int64
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"sql/0010_second.up.sql":   {Data: []byte("up 10")},
+				"sql/0010_second.down.sql": {Data: []byte("down 10")},
+				"sql/0002_first.up.sql":    {Data: []byte("up 2")},
+				"sql/0002_first.down.sql":  {Data: []byte("down 2")},
+			},
+			versions: []int64{2, 10},
+		},
+		{
+			name: "missing down file",
+			files: fstest.MapFS{
+				"sql/0001_first.up.sql": {Data: []byte("up")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "bad file name",
+			files: fstest.MapFS{
+				"sql/first.up.sql": {Data: []byte("up")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "different names for one version",
+			files: fstest.MapFS{
+				"sql/0001_first.up.sql":     {Data: []byte("up")},
+				"sql/0001_renamed.down.sql": {Data: []byte("down")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migrations, err := load(test.files, "sql")
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidMigrations)
+				return
+			}
+			require.NoError(t, err)
+
+			versions := make([]int64, 0, len(migrations))
+			for _, migration := range migrations {
+				versions = append(versions, migration.Version)
+			}
+			assert.Equal(t, test.versions, versions)
+			assert.Equal(t, "up 2", migrations[0].Up)
+			assert.Equal(t, "down 2", migrations[0].Down)
+		})
+	}
+}
+
+func TestDownSteps(t *testing.T) {
+	migrator, err := NewMigrator(nil)
+	require.NoError(t, err)
+	// число шагов проверяется до обращения к базе
+	assert.ErrorIs(t, migrator.Down(context.Background(), 0), ErrInvalidSteps)
+	assert.ErrorIs(t, migrator.Down(context.Background(), -1), ErrInvalidSteps)
+}
@@ -0,0 +1,8 @@
+-- Таблицы метрик существовали до появления миграций, поэтому откат их не удаляет,
+-- а снимает только то, что добавила миграция: уникальность, индекс серий, историю и ключи идемпотентности.
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_metric_id_key;
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_metric_id_key;
+ALTER TABLE histogram_metrics DROP CONSTRAINT IF EXISTS histogram_metrics_metric_id_key;
+DROP INDEX IF EXISTS metric_samples_series_idx;
+DROP TABLE IF EXISTS metric_samples;
+DROP TABLE IF EXISTS idempotency_keys;
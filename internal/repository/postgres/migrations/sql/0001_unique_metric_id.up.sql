@@ -0,0 +1,42 @@
+-- Таблицы, которые раньше создавались через CREATE TABLE IF NOT EXISTS при старте сервера.
+CREATE TABLE IF NOT EXISTS gauge_metrics
+(metric_id varchar(150) NOT NULL, metric_value double precision NOT NULL, metric_labels jsonb NOT NULL DEFAULT '{}'::jsonb);
+ALTER TABLE gauge_metrics ADD COLUMN IF NOT EXISTS metric_labels jsonb NOT NULL DEFAULT '{}'::jsonb;
+
+CREATE TABLE IF NOT EXISTS counter_metrics
+(metric_id varchar(150) NOT NULL, metric_value BIGINT NOT NULL, metric_labels jsonb NOT NULL DEFAULT '{}'::jsonb);
+ALTER TABLE counter_metrics ADD COLUMN IF NOT EXISTS metric_labels jsonb NOT NULL DEFAULT '{}'::jsonb;
+
+CREATE TABLE IF NOT EXISTS histogram_metrics
+(metric_id varchar(150) NOT NULL, metric_value jsonb NOT NULL, metric_labels jsonb NOT NULL DEFAULT '{}'::jsonb);
+ALTER TABLE histogram_metrics ADD COLUMN IF NOT EXISTS metric_labels jsonb NOT NULL DEFAULT '{}'::jsonb;
+
+CREATE TABLE IF NOT EXISTS metric_samples
+(metric_type varchar(20) NOT NULL, metric_id varchar(150) NOT NULL, metric_labels jsonb NOT NULL DEFAULT '{}'::jsonb,
+sampled_at timestamptz NOT NULL, metric_value double precision NOT NULL);
+-- Серия определяется и метками, индекс мог остаться от старых версий без них.
+DROP INDEX IF EXISTS metric_samples_series_idx;
+CREATE INDEX metric_samples_series_idx ON metric_samples (metric_type, metric_id, metric_labels, sampled_at);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(idempotency_key varchar(128) PRIMARY KEY, result jsonb, applied_at timestamptz NOT NULL DEFAULT now());
+
+-- Метки входят в идентификатор метрики, поэтому уникальна пара (metric_id, metric_labels).
+-- Из гонок старых версий могли остаться дубли, оставляем последнюю записанную строку.
+-- Дубли счетчика хранят части одной суммы, поэтому оставшаяся строка получает их общую сумму.
+DELETE FROM gauge_metrics a USING gauge_metrics b
+WHERE a.metric_id = b.metric_id AND a.metric_labels = b.metric_labels AND a.ctid < b.ctid;
+CREATE TEMPORARY TABLE counter_totals AS
+SELECT metric_id, metric_labels, sum(metric_value) AS total FROM counter_metrics
+GROUP BY metric_id, metric_labels HAVING count(*) > 1;
+DELETE FROM counter_metrics a USING counter_metrics b
+WHERE a.metric_id = b.metric_id AND a.metric_labels = b.metric_labels AND a.ctid < b.ctid;
+UPDATE counter_metrics c SET metric_value = t.total FROM counter_totals t
+WHERE c.metric_id = t.metric_id AND c.metric_labels = t.metric_labels;
+DROP TABLE counter_totals;
+DELETE FROM histogram_metrics a USING histogram_metrics b
+WHERE a.metric_id = b.metric_id AND a.metric_labels = b.metric_labels AND a.ctid < b.ctid;
+
+ALTER TABLE gauge_metrics ADD CONSTRAINT gauge_metrics_metric_id_key UNIQUE (metric_id, metric_labels);
+ALTER TABLE counter_metrics ADD CONSTRAINT counter_metrics_metric_id_key UNIQUE (metric_id, metric_labels);
+ALTER TABLE histogram_metrics ADD CONSTRAINT histogram_metrics_metric_id_key UNIQUE (metric_id, metric_labels);
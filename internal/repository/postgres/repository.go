@@ -2,241 +2,514 @@ package postgres
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/postgres/migrations"
 	"github.com/whynullname/go-collect-metrics/internal/repository/types"
 )
 
 type Postgres struct {
-	db *sql.DB
+	pool          *pgxpool.Pool
+	poolConfig    PoolConfig
+	recordHistory bool
 }
 
-func NewPostgresRepo(adress string) (*Postgres, error) {
-	db, err := sql.Open("pgx", adress)
-	if err != nil {
-		return nil, err
+// PoolConfig настройки пула соединений. Нулевые значения оставляют настройки pgxpool по умолчанию.
+type PoolConfig struct {
+	MaxConns          int32
+	MinConns          int32
+	ConnectTimeout    time.Duration
+	HealthCheckPeriod time.Duration
+	PingTimeout       time.Duration
+	// StatementCacheCapacity сколько подготовленных запросов кешировать на соединение, 0 отключает кеш.
+	StatementCacheCapacity int
+}
+
+// DefaultPoolConfig настройки пула по умолчанию.
+var DefaultPoolConfig = PoolConfig{
+	ConnectTimeout:         5 * time.Second,
+	HealthCheckPeriod:      time.Minute,
+	PingTimeout:            time.Second,
+	StatementCacheCapacity: 512,
+}
+
+// Option настраивает Postgres репозиторий.
+type Option func(*Postgres)
+
+// WithHistory включает сохранение истории значений gauge и counter метрик в таблицу metric_samples.
+func WithHistory() Option {
+	return func(p *Postgres) {
+		p.recordHistory = true
 	}
+}
+
+// WithPoolConfig задает настройки пула соединений.
+func WithPoolConfig(config PoolConfig) Option {
+	return func(p *Postgres) {
+		p.poolConfig = config
+	}
+}
 
-	err = MigrateTable(db, "gauge_metrics", "double precision")
+func NewPostgresRepo(adress string, opts ...Option) (*Postgres, error) {
+	instance := Postgres{
+		poolConfig: DefaultPoolConfig,
+	}
+	for _, opt := range opts {
+		opt(&instance)
+	}
+
+	config, err := pgxpool.ParseConfig(adress)
 	if err != nil {
 		return nil, err
 	}
+	instance.poolConfig.apply(config)
 
-	err = MigrateTable(db, "counter_metrics", "BIGINT")
+	instance.pool, err = pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		return nil, err
 	}
 
-	instance := Postgres{
-		db: db,
+	if err := instance.migrate(); err != nil {
+		instance.pool.Close()
+		return nil, err
 	}
 	return &instance, nil
 }
 
-func MigrateTable(db *sql.DB, tableName string, valueType string) error {
-	_, err := db.ExecContext(context.TODO(), "CREATE TABLE IF NOT EXISTS "+tableName+
-		"(metric_id varchar(150) NOT NULL, metric_value "+valueType+" NOT NULL)")
+func (c PoolConfig) apply(config *pgxpool.Config) {
+	if c.MaxConns > 0 {
+		config.MaxConns = c.MaxConns
+	}
+	if c.MinConns > 0 {
+		config.MinConns = c.MinConns
+	}
+	if c.ConnectTimeout > 0 {
+		config.ConnConfig.ConnectTimeout = c.ConnectTimeout
+	}
+	if c.HealthCheckPeriod > 0 {
+		config.HealthCheckPeriod = c.HealthCheckPeriod
+	}
+
+	config.ConnConfig.StatementCacheCapacity = max(c.StatementCacheCapacity, 0)
+	if c.StatementCacheCapacity <= 0 {
+		// без кеша запросы не подготавливаются, типы параметров берутся из Go значений и приведений в SQL
+		config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeExec
+	}
+}
+
+// migrate применяет миграции схемы. Мигратор работает через database/sql поверх того же пула.
+func (p *Postgres) migrate() error {
+	db := stdlib.OpenDBFromPool(p.pool)
+	defer db.Close()
+
+	migrator, err := migrations.NewMigrator(db)
 	if err != nil {
-		logger.Log.Error(err)
 		return err
 	}
 
+	err = migrator.Up(context.TODO())
+	if err != nil {
+		logger.Log.Error(err)
+		return err
+	}
 	return nil
 }
 
+// execer общий интерфейс *pgxpool.Pool и pgx.Tx для выполнения запросов.
+type execer interface {
+	Exec(ctx context.Context, query string, args ...any) (pgconn.CommandTag, error)
+}
+
+// insertSample сохраняет текущее значение метрики в историю, если она включена.
+func (p *Postgres) insertSample(ctx context.Context, db execer, metric *repository.Metric) error {
+	if !p.recordHistory {
+		return nil
+	}
+
+	value, ok := metric.SampleValue()
+	if !ok {
+		return nil
+	}
+
+	_, err := db.Exec(ctx, `INSERT INTO metric_samples
+	(metric_type, metric_id, metric_labels, sampled_at, metric_value)
+	VALUES ($1, $2, $3::jsonb, now(), $4)`, metric.MType, metric.ID, labelsJSON(metric.Labels), value)
+	return err
+}
+
+// labelsJSON кодирует метки для колонки metric_labels. Пустой набор хранится как {}.
+func labelsJSON(labels repository.Labels) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+func scanLabels(data []byte) (repository.Labels, error) {
+	var labels repository.Labels
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, err
+	}
+	return labels.Normalize(), nil
+}
+
 func (p *Postgres) UpdateMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
+	var output *repository.Metric
+	err := retry(ctx, func() error {
+		var err error
+		output, err = p.updateMetric(ctx, metric)
+		return err
+	})
+	return output, err
+}
+
+func (p *Postgres) updateMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
 	switch metric.MType {
 	case repository.GaugeMetricKey:
 		return p.UpdateGaugeMetric(ctx, metric)
 	case repository.CounterMetricKey:
 		return p.UpdateCounterMetricValue(ctx, metric)
+	case repository.HistogramMetricKey:
+		return p.UpdateHistogramMetric(ctx, metric)
 	}
 	return nil, types.ErrUnsupportedMetricType
 }
 
 func (p *Postgres) UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
-	output := metrics
-	var err error
-	retry(3, 1*time.Second, func() error {
+	var output []repository.Metric
+	err := retry(ctx, func() error {
+		var err error
 		output, err = p.UpdateWithRetries(ctx, metrics)
-		if err != nil && isRetriableError(err) {
-			return err
-		}
-		return nil
+		return err
 	})
 	return output, err
 }
 
-func retry(attempts int, delay time.Duration, operation func() error) error {
-	for i := 0; i < attempts; i++ {
-		err := operation()
-		if err != nil {
-			time.Sleep(delay)
-			delay += 2 * time.Second
-			continue
+const (
+	retryAttempts   = 4
+	retryFirstDelay = 100 * time.Millisecond
+	retryMaxDelay   = 2 * time.Second
+)
+
+// retry повторяет operation с экспоненциальной задержкой, пока ошибка временная.
+func retry(ctx context.Context, operation func() error) error {
+	delay := retryFirstDelay
+	var err error
+	for i := 0; i < retryAttempts; i++ {
+		err = operation()
+		if err == nil || !isRetriableError(err) || i == retryAttempts-1 {
+			return err
 		}
-		return err
+
+		logger.Log.Infof("Retry postgres operation in %s after error: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, retryMaxDelay)
 	}
-	return fmt.Errorf("retry failed after %d attempts", attempts)
+	return err
 }
 
+// isRetriableError ошибки, после которых запрос можно безопасно повторить: транзакция откатилась
+// или запрос не дошел до сервера.
 func isRetriableError(err error) bool {
 	var pgErr *pgconn.PgError
-	return errors.As(err, &pgErr) && pgerrcode.IsIntegrityConstraintViolation(pgErr.Code)
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) ||
+			pgErr.Code == pgerrcode.SerializationFailure ||
+			pgErr.Code == pgerrcode.DeadlockDetected ||
+			pgerrcode.IsConnectionException(pgErr.Code)
+	}
+
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr) || pgconn.SafeToRetry(err)
 }
 
 func (p *Postgres) UpdateWithRetries(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
-	output := make([]repository.Metric, 0)
-	tx, err := p.db.Begin()
+	tx, err := p.pool.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback(ctx)
 
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
+	output, err := p.updateMetricsWithTx(ctx, tx, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return output, tx.Commit(ctx)
+}
 
-	for _, metric := range metrics {
-		var ouputMetric *repository.Metric
-		switch metric.MType {
-		case repository.GaugeMetricKey:
-			ouputMetric, err = p.UpdateGaugeMetricWithTx(ctx, tx, &metric)
-		case repository.CounterMetricKey:
-			ouputMetric, err = p.UpdateCounterMetricValueWithTx(ctx, tx, &metric)
-		}
+// UpdateMetricsOnce применяет батч только при первом вызове с key, повторные вызовы возвращают сохраненный результат.
+// Ключ вставляется в той же транзакции, что и метрики, поэтому одновременный повтор ждет завершения первой попытки.
+func (p *Postgres) UpdateMetricsOnce(ctx context.Context, key string, metrics []repository.Metric) ([]repository.Metric, error) {
+	var output []repository.Metric
+	err := retry(ctx, func() error {
+		var err error
+		output, err = p.updateMetricsOnce(ctx, key, metrics)
+		return err
+	})
+	return output, err
+}
+
+func (p *Postgres) updateMetricsOnce(ctx context.Context, key string, metrics []repository.Metric) ([]repository.Metric, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := tx.Exec(ctx, "INSERT INTO idempotency_keys (idempotency_key) VALUES ($1) ON CONFLICT DO NOTHING", key)
+	if err != nil {
+		return nil, err
+	}
 
+	if res.RowsAffected() == 0 {
+		var result []byte
+		err := tx.QueryRow(ctx, "SELECT result FROM idempotency_keys WHERE idempotency_key = $1", key).Scan(&result)
 		if err != nil {
 			return nil, err
-		} else {
-			output = append(output, *ouputMetric)
 		}
+
+		var output []repository.Metric
+		if err := json.Unmarshal(result, &output); err != nil {
+			return nil, err
+		}
+		return output, tx.Commit(ctx)
+	}
+
+	output, err := p.updateMetricsWithTx(ctx, tx, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := json.Marshal(output)
+	if err != nil {
+		return nil, err
 	}
+	_, err = tx.Exec(ctx, "UPDATE idempotency_keys SET result = $1 WHERE idempotency_key = $2", result, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return output, tx.Commit(ctx)
+}
+
+func (p *Postgres) DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) error {
+	_, err := p.pool.Exec(ctx, "DELETE FROM idempotency_keys WHERE applied_at < $1", before)
+	return err
+}
 
-	return output, nil
+const (
+	upsertGaugeQuery = `INSERT INTO gauge_metrics (metric_id, metric_value, metric_labels) VALUES ($1, $2, $3::jsonb)
+	ON CONFLICT (metric_id, metric_labels) DO UPDATE SET metric_value = EXCLUDED.metric_value`
+	upsertCounterQuery = `INSERT INTO counter_metrics (metric_id, metric_value, metric_labels) VALUES ($1, $2, $3::jsonb)
+	ON CONFLICT (metric_id, metric_labels) DO UPDATE SET metric_value = counter_metrics.metric_value + EXCLUDED.metric_value
+	RETURNING metric_value`
+)
+
+// querier общий интерфейс *pgxpool.Pool и pgx.Tx для запросов, которые возвращают строку.
+type querier interface {
+	execer
+	QueryRow(ctx context.Context, query string, args ...any) pgx.Row
 }
 
 func (p *Postgres) UpdateGaugeMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
-	res, err := p.db.ExecContext(ctx, `UPDATE gauge_metrics
-	SET metric_value = $1 WHERE metric_id = $2`, metric.Value, metric.ID)
+	return p.inTx(ctx, metric, p.UpdateGaugeMetricWithTx)
+}
+
+func (p *Postgres) UpdateGaugeMetricWithTx(ctx context.Context, tx pgx.Tx, metric *repository.Metric) (*repository.Metric, error) {
+	return p.upsertGauge(ctx, tx, metric)
+}
+
+func (p *Postgres) upsertGauge(ctx context.Context, db querier, metric *repository.Metric) (*repository.Metric, error) {
+	_, err := db.Exec(ctx, upsertGaugeQuery, metric.ID, metric.Value, labelsJSON(metric.Labels))
 	if err != nil {
 		return nil, err
 	}
 
-	if rows, _ := res.RowsAffected(); rows == 0 {
-		_, err = p.db.ExecContext(ctx, `INSERT INTO gauge_metrics 
-		(metric_id, metric_value) 
-		VALUES ($1, $2)`, metric.ID, metric.Value)
-		if err != nil {
-			return nil, err
-		}
+	if err := p.insertSample(ctx, db, metric); err != nil {
+		return nil, err
 	}
 
 	return metric, nil
 }
 
-func (p *Postgres) UpdateGaugeMetricWithTx(ctx context.Context, tx *sql.Tx, metric *repository.Metric) (*repository.Metric, error) {
-	res, err := tx.ExecContext(ctx, `UPDATE gauge_metrics 
-	SET metric_value = $1 WHERE metric_id = $2`, metric.Value, metric.ID)
+func (p *Postgres) UpdateCounterMetricValue(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
+	return p.inTx(ctx, metric, p.UpdateCounterMetricValueWithTx)
+}
+
+func (p *Postgres) UpdateCounterMetricValueWithTx(ctx context.Context, tx pgx.Tx, metric *repository.Metric) (*repository.Metric, error) {
+	return p.upsertCounter(ctx, tx, metric)
+}
+
+// upsertCounter прибавляет Delta к сохраненному значению одним запросом и возвращает метрику с новым значением.
+func (p *Postgres) upsertCounter(ctx context.Context, db querier, metric *repository.Metric) (*repository.Metric, error) {
+	var total int64
+	err := db.QueryRow(ctx, upsertCounterQuery, metric.ID, metric.GetDelta(), labelsJSON(metric.Labels)).Scan(&total)
 	if err != nil {
 		return nil, err
 	}
 
-	if rows, _ := res.RowsAffected(); rows == 0 {
-		_, err = tx.ExecContext(ctx, `INSERT INTO gauge_metrics 
-		(metric_id, metric_value) 
-		VALUES ($1, $2)`, metric.ID, metric.Value)
-		if err != nil {
-			return nil, err
-		}
+	output := metric.Clone()
+	output.Delta = &total
+	if err := p.insertSample(ctx, db, &output); err != nil {
+		return nil, err
 	}
 
-	return metric, nil
+	return &output, nil
 }
 
-func (p *Postgres) UpdateCounterMetricValue(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
-	val, err := p.GetMetric(ctx, metric.ID, metric.MType)
+// histogramValue представление гистограммы в колонке metric_value.
+type histogramValue struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
 
-	if err != nil {
-		val = metric
-		_, err := p.db.ExecContext(ctx, "INSERT INTO counter_metrics (metric_id, metric_value) VALUES ($1, $2)", val.ID, *val.Delta)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		newDelta := metric.GetDelta() + val.GetDelta()
-		val.Delta = &newDelta
-		_, err := p.db.ExecContext(ctx, "UPDATE counter_metrics SET metric_value = $1 WHERE metric_id = $2", *val.Delta, val.ID)
-		if err != nil {
-			return nil, err
-		}
+func marshalHistogram(metric *repository.Metric) ([]byte, error) {
+	return json.Marshal(histogramValue{
+		Buckets: metric.Buckets,
+		Counts:  metric.Counts,
+		Sum:     metric.GetSum(),
+		Count:   metric.GetCount(),
+	})
+}
+
+func unmarshalHistogram(data []byte, metric *repository.Metric) error {
+	var value histogramValue
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
 	}
 
-	return val, nil
+	metric.Buckets = value.Buckets
+	metric.Counts = value.Counts
+	metric.Sum = &value.Sum
+	metric.Count = &value.Count
+	return nil
 }
 
-func (p *Postgres) UpdateCounterMetricValueWithTx(ctx context.Context, tx *sql.Tx, metric *repository.Metric) (*repository.Metric, error) {
-	val, err := p.GetMetricWithTX(ctx, tx, metric.ID, metric.MType, "counter_metrics")
+func (p *Postgres) UpdateHistogramMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
+	return p.inTx(ctx, metric, p.UpdateHistogramMetricWithTx)
+}
 
+// inTx выполняет update в отдельной транзакции, чтобы значение и запись истории применялись вместе
+// и повтор после ошибки не прибавлял Delta counter второй раз.
+func (p *Postgres) inTx(ctx context.Context, metric *repository.Metric,
+	update func(context.Context, pgx.Tx, *repository.Metric) (*repository.Metric, error)) (*repository.Metric, error) {
+	tx, err := p.pool.Begin(ctx)
 	if err != nil {
-		val = metric
-		_, err := tx.ExecContext(ctx, "INSERT INTO counter_metrics (metric_id, metric_value) VALUES ($1, $2)", val.ID, val.Delta)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	output, err := update(ctx, tx, metric)
+	if err != nil {
+		return nil, err
+	}
+	return output, tx.Commit(ctx)
+}
+
+func (p *Postgres) UpdateHistogramMetricWithTx(ctx context.Context, tx pgx.Tx, metric *repository.Metric) (*repository.Metric, error) {
+	row := tx.QueryRow(ctx, "SELECT metric_value FROM histogram_metrics WHERE metric_id = $1 AND metric_labels = $2::jsonb FOR UPDATE", metric.ID, labelsJSON(metric.Labels))
+	saved, err := p.ScanMetricByMetricType(row, repository.HistogramMetricKey)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		value, err := marshalHistogram(metric)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		newDelta := metric.GetDelta() + val.GetDelta()
-		val.Delta = &newDelta
-		_, err := tx.ExecContext(ctx, "UPDATE counter_metrics SET metric_value = $1 WHERE metric_id = $2", val.Delta, val.ID)
+		_, err = tx.Exec(ctx, "INSERT INTO histogram_metrics (metric_id, metric_value, metric_labels) VALUES ($1, $2, $3::jsonb)", metric.ID, value, labelsJSON(metric.Labels))
 		if err != nil {
 			return nil, err
 		}
+		return metric, nil
 	}
 
-	return val, nil
+	saved.ID = metric.ID
+	saved.MType = metric.MType
+	saved.Labels = metric.Labels
+	merged, err := saved.MergeHistogram(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := marshalHistogram(merged)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, "UPDATE histogram_metrics SET metric_value = $1 WHERE metric_id = $2 AND metric_labels = $3::jsonb", value, merged.ID, labelsJSON(merged.Labels))
+	if err != nil {
+		return nil, err
+	}
+
+	return merged, nil
 }
 
-func (p *Postgres) GetMetricWithTX(ctx context.Context, tx *sql.Tx, metricName string, metricType string, metricTableName string) (*repository.Metric, error) {
-	row := tx.QueryRowContext(ctx, "SELECT metric_value FROM "+metricTableName+" WHERE metric_id = $1", metricName)
+func (p *Postgres) GetMetricWithTX(ctx context.Context, tx pgx.Tx, metricName string, metricType string, labels repository.Labels, metricTableName string) (*repository.Metric, error) {
+	row := tx.QueryRow(ctx, "SELECT metric_value FROM "+metricTableName+" WHERE metric_id = $1 AND metric_labels = $2::jsonb", metricName, labelsJSON(labels))
 	output, err := p.ScanMetricByMetricType(row, metricType)
 	output.ID = metricName
 	output.MType = metricType
+	output.Labels = labels
 	return output, err
 }
 
-func (p *Postgres) GetMetric(ctx context.Context, metricName string, metricType string) (*repository.Metric, error) {
+func (p *Postgres) GetMetric(ctx context.Context, metricName string, metricType string, labels repository.Labels) (*repository.Metric, error) {
 	switch metricType {
 	case repository.GaugeMetricKey:
-		return p.GetMetricQurey(ctx, metricName, metricType, "gauge_metrics")
+		return p.GetMetricQurey(ctx, metricName, metricType, labels, "gauge_metrics")
 	case repository.CounterMetricKey:
-		return p.GetMetricQurey(ctx, metricName, metricType, "counter_metrics")
+		return p.GetMetricQurey(ctx, metricName, metricType, labels, "counter_metrics")
+	case repository.HistogramMetricKey:
+		return p.GetMetricQurey(ctx, metricName, metricType, labels, "histogram_metrics")
 	}
 
 	return nil, types.ErrUnsupportedMetricType
 }
 
-func (p *Postgres) GetMetricQurey(ctx context.Context, metricName string, metricType string, metricTableName string) (*repository.Metric, error) {
-	row := p.db.QueryRowContext(ctx, "SELECT metric_value FROM "+metricTableName+" WHERE metric_id = $1", metricName)
+func (p *Postgres) GetMetricQurey(ctx context.Context, metricName string, metricType string, labels repository.Labels, metricTableName string) (*repository.Metric, error) {
+	row := p.pool.QueryRow(ctx, "SELECT metric_value FROM "+metricTableName+" WHERE metric_id = $1 AND metric_labels = $2::jsonb", metricName, labelsJSON(labels))
 	output, err := p.ScanMetricByMetricType(row, metricType)
 	if err != nil {
 		return nil, types.ErrCantFindMetric
 	}
 	output.ID = metricName
 	output.MType = metricType
+	output.Labels = labels
 	return output, err
 }
 
 func (p *Postgres) GetAllMetricsByType(ctx context.Context, metricType string) ([]repository.Metric, error) {
+	var output []repository.Metric
+	err := retry(ctx, func() error {
+		var err error
+		output, err = p.getAllMetricsByType(ctx, metricType)
+		return err
+	})
+	return output, err
+}
+
+func (p *Postgres) getAllMetricsByType(ctx context.Context, metricType string) ([]repository.Metric, error) {
 	output := make([]repository.Metric, 0)
 	tableName := ""
 	switch metricType {
@@ -244,25 +517,46 @@ func (p *Postgres) GetAllMetricsByType(ctx context.Context, metricType string) (
 		tableName = "counter_metrics"
 	case repository.GaugeMetricKey:
 		tableName = "gauge_metrics"
+	case repository.HistogramMetricKey:
+		tableName = "histogram_metrics"
+	default:
+		return output, types.ErrUnsupportedMetricType
 	}
-	rows, err := p.db.QueryContext(ctx, "SELECT * FROM "+tableName)
+	rows, err := p.pool.Query(ctx, "SELECT metric_id, metric_value, metric_labels FROM "+tableName)
 	if err != nil {
 		return output, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		metric := repository.Metric{MType: metricType}
+		var labels []byte
 		switch metricType {
 		case repository.GaugeMetricKey:
-			err = rows.Scan(&metric.ID, &metric.Value)
+			err = rows.Scan(&metric.ID, &metric.Value, &labels)
 			if err != nil {
 				return output, err
 			}
 		case repository.CounterMetricKey:
-			rows.Scan(&metric.ID, &metric.Delta)
+			err = rows.Scan(&metric.ID, &metric.Delta, &labels)
 			if err != nil {
 				return output, err
 			}
+		case repository.HistogramMetricKey:
+			var value []byte
+			err = rows.Scan(&metric.ID, &value, &labels)
+			if err != nil {
+				return output, err
+			}
+			err = unmarshalHistogram(value, &metric)
+			if err != nil {
+				return output, err
+			}
+		}
+
+		metric.Labels, err = scanLabels(labels)
+		if err != nil {
+			return output, err
 		}
 
 		output = append(output, metric)
@@ -272,22 +566,81 @@ func (p *Postgres) GetAllMetricsByType(ctx context.Context, metricType string) (
 	return output, err
 }
 
+func (p *Postgres) GetMetricHistory(ctx context.Context, metricName, metricType string, labels repository.Labels, from, to time.Time) ([]repository.Sample, error) {
+	if metricType != repository.GaugeMetricKey && metricType != repository.CounterMetricKey {
+		return nil, types.ErrUnsupportedMetricType
+	}
+
+	output := make([]repository.Sample, 0)
+	rows, err := p.pool.Query(ctx, `SELECT sampled_at, metric_value FROM metric_samples
+	WHERE metric_type = $1 AND metric_id = $2 AND metric_labels = $3::jsonb AND sampled_at BETWEEN $4 AND $5
+	ORDER BY sampled_at`, metricType, metricName, labelsJSON(labels), from, to)
+	if err != nil {
+		return output, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sample repository.Sample
+		if err := rows.Scan(&sample.Timestamp, &sample.Value); err != nil {
+			return output, err
+		}
+		output = append(output, sample)
+	}
+
+	return output, rows.Err()
+}
+
+func (p *Postgres) DeleteHistoryBefore(ctx context.Context, before time.Time) error {
+	_, err := p.pool.Exec(ctx, "DELETE FROM metric_samples WHERE sampled_at < $1", before)
+	return err
+}
+
 func (p *Postgres) PingRepo() bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	timeout := p.poolConfig.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPoolConfig.PingTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	if err := p.db.PingContext(ctx); err != nil {
+	if err := p.pool.Ping(ctx); err != nil {
 		return false
 	}
 
 	return true
 }
 
+// PoolStats возвращает состояние пула соединений в виде метрик.
+// Counter метрики содержат накопленные с запуска значения, а не приращения.
+func (p *Postgres) PoolStats() []repository.Metric {
+	stat := p.pool.Stat()
+	gauge := func(id string, value int32) repository.Metric {
+		v := float64(value)
+		return repository.Metric{ID: id, MType: repository.GaugeMetricKey, Value: &v}
+	}
+	counter := func(id string, value int64) repository.Metric {
+		return repository.Metric{ID: id, MType: repository.CounterMetricKey, Delta: &value}
+	}
+
+	return []repository.Metric{
+		gauge("db_pool_acquired_conns", stat.AcquiredConns()),
+		gauge("db_pool_idle_conns", stat.IdleConns()),
+		gauge("db_pool_constructing_conns", stat.ConstructingConns()),
+		gauge("db_pool_total_conns", stat.TotalConns()),
+		gauge("db_pool_max_conns", stat.MaxConns()),
+		counter("db_pool_acquire_total", stat.AcquireCount()),
+		counter("db_pool_empty_acquire_total", stat.EmptyAcquireCount()),
+		counter("db_pool_canceled_acquire_total", stat.CanceledAcquireCount()),
+		counter("db_pool_new_conns_total", stat.NewConnsCount()),
+	}
+}
+
 func (p *Postgres) CloseRepository() {
-	p.db.Close()
+	p.pool.Close()
 }
 
-func (p *Postgres) ScanMetricByMetricType(row *sql.Row, metricType string) (output *repository.Metric, err error) {
+func (p *Postgres) ScanMetricByMetricType(row pgx.Row, metricType string) (output *repository.Metric, err error) {
 	output = &repository.Metric{}
 	switch metricType {
 	case repository.CounterMetricKey:
@@ -300,7 +653,16 @@ func (p *Postgres) ScanMetricByMetricType(row *sql.Row, metricType string) (outp
 		if err != nil {
 			return
 		}
+	case repository.HistogramMetricKey:
+		var value []byte
+		err = row.Scan(&value)
+		if err != nil {
+			return
+		}
+		err = unmarshalHistogram(value, output)
+		if err != nil {
+			return
+		}
 	}
-	err = row.Err()
 	return
 }
@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+func TestIsRetriableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unique violation", err: &pgconn.PgError{Code: pgerrcode.UniqueViolation}, want: true},
+		{name: "serialization failure", err: &pgconn.PgError{Code: pgerrcode.SerializationFailure}, want: true},
+		{name: "deadlock", err: &pgconn.PgError{Code: pgerrcode.DeadlockDetected}, want: true},
+		{name: "connection failure", err: &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, want: true},
+		{name: "wrapped", err: fmt.Errorf("update: %w", &pgconn.PgError{Code: pgerrcode.SerializationFailure}), want: true},
+		{name: "syntax error", err: &pgconn.PgError{Code: pgerrcode.SyntaxError}, want: false},
+		{name: "no rows", err: pgx.ErrNoRows, want: false},
+		{name: "plain error", err: errors.New("fail"), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, isRetriableError(test.err))
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	logger.Initialize("info")
+	retriable := &pgconn.PgError{Code: pgerrcode.SerializationFailure}
+
+	calls := 0
+	err := retry(context.Background(), func() error {
+		calls++
+		if calls < 2 {
+			return retriable
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	permanent := errors.New("fail")
+	err = retry(context.Background(), func() error {
+		calls++
+		return permanent
+	})
+	assert.ErrorIs(t, err, permanent)
+	assert.Equal(t, 1, calls)
+
+	// после отмены контекста повторов нет
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	err = retry(ctx, func() error {
+		calls++
+		return retriable
+	})
+	assert.ErrorIs(t, err, retriable)
+	assert.Equal(t, 1, calls)
+}
+
+func TestPoolConfigApply(t *testing.T) {
+	config, err := pgxpool.ParseConfig("postgres://user@localhost:5432/metrics")
+	require.NoError(t, err)
+	DefaultPoolConfig.apply(config)
+	assert.Equal(t, DefaultPoolConfig.ConnectTimeout, config.ConnConfig.ConnectTimeout)
+	assert.Equal(t, DefaultPoolConfig.HealthCheckPeriod, config.HealthCheckPeriod)
+	assert.Equal(t, DefaultPoolConfig.StatementCacheCapacity, config.ConnConfig.StatementCacheCapacity)
+	assert.Equal(t, pgx.QueryExecModeCacheStatement, config.ConnConfig.DefaultQueryExecMode)
+
+	config, err = pgxpool.ParseConfig("postgres://user@localhost:5432/metrics")
+	require.NoError(t, err)
+	PoolConfig{MaxConns: 20, MinConns: 2}.apply(config)
+	assert.Equal(t, int32(20), config.MaxConns)
+	assert.Equal(t, int32(2), config.MinConns)
+	assert.Equal(t, pgx.QueryExecModeExec, config.ConnConfig.DefaultQueryExecMode)
+}
@@ -1,28 +1,62 @@
 // Пакет repository описывает основные методы и структуры, которые нужны для репозитория.
 package repository
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 const (
-	GaugeMetricKey   = "gauge"
-	CounterMetricKey = "counter"
+	GaugeMetricKey     = "gauge"
+	CounterMetricKey   = "counter"
+	HistogramMetricKey = "histogram"
 )
 
+// MetricTypes все поддерживаемые типы метрик.
+var MetricTypes = []string{GaugeMetricKey, CounterMetricKey, HistogramMetricKey}
+
 type Repository interface {
-	UpdateMetric(ctx context.Context, metric *Metric) (*Metric, error)                    // обнолвение метрики.
-	UpdateMetrics(ctx context.Context, metrics []Metric) ([]Metric, error)                // обновление массива метрик.
-	GetMetric(ctx context.Context, metricName string, metricType string) (*Metric, error) // получить метрику.
-	GetAllMetricsByType(ctx context.Context, metricType string) ([]Metric, error)         // получить все метрики по типу.
-	PingRepo() bool                                                                       // узнать, доступен ли репозиторий и можно ли к нему обращаться.
-	CloseRepository()                                                                     // закрыть репозиторий.
+	UpdateMetric(ctx context.Context, metric *Metric) (*Metric, error)                                                        // обнолвение метрики.
+	UpdateMetrics(ctx context.Context, metrics []Metric) ([]Metric, error)                                                    // обновление массива метрик.
+	GetMetric(ctx context.Context, metricName string, metricType string, labels Labels) (*Metric, error)                      // получить метрику.
+	GetAllMetricsByType(ctx context.Context, metricType string) ([]Metric, error)                                             // получить все метрики по типу.
+	GetMetricHistory(ctx context.Context, metricName, metricType string, labels Labels, from, to time.Time) ([]Sample, error) // получить значения метрики за период.
+	DeleteHistoryBefore(ctx context.Context, before time.Time) error                                                          // удалить значения метрик старше before.
+	UpdateMetricsOnce(ctx context.Context, key string, metrics []Metric) ([]Metric, error)                                    // обновление массива метрик не больше одного раза для ключа идемпотентности.
+	DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) error                                                  // удалить ключи идемпотентности, сохраненные раньше before.
+	PingRepo() bool                                                                                                           // узнать, доступен ли репозиторий и можно ли к нему обращаться.
+	CloseRepository()                                                                                                         // закрыть репозиторий.
 }
 
 // Metric хранит всю информацию о метрике.
 type Metric struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID      string    `json:"id"`                // имя метрики
+	MType   string    `json:"type"`              // параметр, принимающий значение gauge, counter или histogram
+	Delta   *int64    `json:"delta,omitempty"`   // значение метрики в случае передачи counter
+	Value   *float64  `json:"value,omitempty"`   // значение метрики в случае передачи gauge
+	Buckets []float64 `json:"buckets,omitempty"` // верхние границы бакетов в случае передачи histogram
+	Counts  []uint64  `json:"counts,omitempty"`  // число наблюдений в каждом бакете, последний элемент - бакет +Inf
+	Sum     *float64  `json:"sum,omitempty"`     // сумма наблюдений в случае передачи histogram
+	Count   *uint64   `json:"count,omitempty"`   // общее число наблюдений в случае передачи histogram
+	Labels  Labels    `json:"labels,omitempty"`  // метки метрики, входят в ее идентификатор
+}
+
+// Sample значение метрики в момент времени. Для counter хранится накопленное значение.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// SampleValue возвращает значение, которое сохраняется в истории метрики.
+// История хранится только для gauge и counter.
+func (m *Metric) SampleValue() (float64, bool) {
+	switch m.MType {
+	case GaugeMetricKey:
+		return m.GetValue(), m.Value != nil
+	case CounterMetricKey:
+		return float64(m.GetDelta()), m.Delta != nil
+	}
+	return 0, false
 }
 
 func (m *Metric) GetValue() float64 {
@@ -38,3 +72,54 @@ func (m *Metric) GetDelta() int64 {
 	}
 	return *m.Delta
 }
+
+func (m *Metric) GetSum() float64 {
+	if m == nil || m.Sum == nil {
+		return 0
+	}
+	return *m.Sum
+}
+
+func (m *Metric) GetCount() uint64 {
+	if m == nil || m.Count == nil {
+		return 0
+	}
+	return *m.Count
+}
+
+// Clone возвращает глубокую копию метрики.
+func (m *Metric) Clone() Metric {
+	output := Metric{
+		ID:    m.ID,
+		MType: m.MType,
+	}
+	if m.Delta != nil {
+		delta := *m.Delta
+		output.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		output.Value = &value
+	}
+	if m.Sum != nil {
+		sum := *m.Sum
+		output.Sum = &sum
+	}
+	if m.Count != nil {
+		count := *m.Count
+		output.Count = &count
+	}
+	if m.Buckets != nil {
+		output.Buckets = append([]float64(nil), m.Buckets...)
+	}
+	if m.Counts != nil {
+		output.Counts = append([]uint64(nil), m.Counts...)
+	}
+	if m.Labels != nil {
+		output.Labels = make(Labels, len(m.Labels))
+		for name, value := range m.Labels {
+			output.Labels[name] = value
+		}
+	}
+	return output
+}
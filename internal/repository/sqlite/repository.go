@@ -0,0 +1,479 @@
+// Пакет sqlite реализует repository.Repository поверх встроенной базы SQLite для установок на одном узле.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+
+	_ "modernc.org/sqlite"
+)
+
+// Scheme префикс DSN, по которому выбирается SQLite, например sqlite:///var/lib/metrics.db.
+const Scheme = "sqlite://"
+
+const pingTimeout = time.Second
+
+// defaultParams параметры соединения, если они не заданы в DSN.
+// busy_timeout ждет блокировку другого процесса вместо ошибки SQLITE_BUSY,
+// а _txlock=immediate берет блокировку на запись в начале транзакции, чтобы она не падала при первом UPDATE.
+var defaultParams = url.Values{
+	"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "synchronous(NORMAL)"},
+	"_txlock": {"immediate"},
+}
+
+type SQLite struct {
+	db            *sql.DB
+	recordHistory bool
+}
+
+// Option настраивает SQLite репозиторий.
+type Option func(*SQLite)
+
+// WithHistory включает сохранение истории значений gauge и counter метрик в таблицу metric_samples.
+func WithHistory() Option {
+	return func(s *SQLite) {
+		s.recordHistory = true
+	}
+}
+
+// IsDSN сообщает, указывает ли dsn на SQLite.
+func IsDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, Scheme)
+}
+
+// driverDSN переводит sqlite:///path?params в DSN драйвера и добавляет параметры по умолчанию.
+func driverDSN(dsn string) (string, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, Scheme), "?")
+	if path == "" {
+		return "", errors.New("empty sqlite database path")
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+	for name, values := range defaultParams {
+		if _, ok := params[name]; !ok {
+			params[name] = values
+		}
+	}
+	return "file:" + path + "?" + params.Encode(), nil
+}
+
+func NewSQLiteRepo(dsn string, opts ...Option) (*SQLite, error) {
+	instance := SQLite{}
+	for _, opt := range opts {
+		opt(&instance)
+	}
+
+	driverDSN, err := driverDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.db, err = sql.Open("sqlite", driverDSN)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite все равно пишет в один поток, одно соединение убирает ошибки блокировок внутри процесса.
+	instance.db.SetMaxOpenConns(1)
+
+	if err := migrate(context.Background(), instance.db); err != nil {
+		instance.db.Close()
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// withTx выполняет operation в транзакции. Пока она открыта, единственное соединение занято,
+// поэтому внутри operation нельзя обращаться к s.db.
+func (s *SQLite) withTx(ctx context.Context, operation func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := operation(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// labelsJSON кодирует метки для колонки metric_labels. Ключи json.Marshal сортирует,
+// поэтому одинаковые наборы меток дают одинаковую строку. Пустой набор хранится как {}.
+func labelsJSON(labels repository.Labels) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+func scanLabels(data string) (repository.Labels, error) {
+	var labels repository.Labels
+	if err := json.Unmarshal([]byte(data), &labels); err != nil {
+		return nil, err
+	}
+	return labels.Normalize(), nil
+}
+
+// insertSample сохраняет текущее значение метрики в историю, если она включена.
+func (s *SQLite) insertSample(ctx context.Context, tx *sql.Tx, metric *repository.Metric) error {
+	if !s.recordHistory {
+		return nil
+	}
+
+	value, ok := metric.SampleValue()
+	if !ok {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `INSERT INTO metric_samples
+	(metric_type, metric_id, metric_labels, sampled_at, metric_value) VALUES (?, ?, ?, ?, ?)`,
+		metric.MType, metric.ID, labelsJSON(metric.Labels), time.Now().UnixNano(), value)
+	return err
+}
+
+func (s *SQLite) UpdateMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
+	var output *repository.Metric
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		output, err = s.updateMetricWithTx(ctx, tx, metric)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// UpdateMetrics применяет весь батч в одной транзакции: при ошибке не сохраняется ни одна метрика.
+func (s *SQLite) UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
+	var output []repository.Metric
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		output, err = s.updateMetricsWithTx(ctx, tx, metrics)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (s *SQLite) updateMetricsWithTx(ctx context.Context, tx *sql.Tx, metrics []repository.Metric) ([]repository.Metric, error) {
+	output := make([]repository.Metric, 0, len(metrics))
+	for i := range metrics {
+		updated, err := s.updateMetricWithTx(ctx, tx, &metrics[i])
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, *updated)
+	}
+	return output, nil
+}
+
+func (s *SQLite) updateMetricWithTx(ctx context.Context, tx *sql.Tx, metric *repository.Metric) (*repository.Metric, error) {
+	switch metric.MType {
+	case repository.GaugeMetricKey:
+		return s.upsertGauge(ctx, tx, metric)
+	case repository.CounterMetricKey:
+		return s.upsertCounter(ctx, tx, metric)
+	case repository.HistogramMetricKey:
+		return s.updateHistogram(ctx, tx, metric)
+	}
+	return nil, types.ErrUnsupportedMetricType
+}
+
+func (s *SQLite) upsertGauge(ctx context.Context, tx *sql.Tx, metric *repository.Metric) (*repository.Metric, error) {
+	_, err := tx.ExecContext(ctx, `INSERT INTO gauge_metrics (metric_id, metric_labels, metric_value) VALUES (?, ?, ?)
+	ON CONFLICT (metric_id, metric_labels) DO UPDATE SET metric_value = excluded.metric_value`,
+		metric.ID, labelsJSON(metric.Labels), metric.GetValue())
+	if err != nil {
+		return nil, err
+	}
+
+	output := metric.Clone()
+	if err := s.insertSample(ctx, tx, &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+// upsertCounter прибавляет Delta к сохраненному значению и возвращает метрику с новым значением.
+func (s *SQLite) upsertCounter(ctx context.Context, tx *sql.Tx, metric *repository.Metric) (*repository.Metric, error) {
+	var total int64
+	err := tx.QueryRowContext(ctx, `INSERT INTO counter_metrics (metric_id, metric_labels, metric_value) VALUES (?, ?, ?)
+	ON CONFLICT (metric_id, metric_labels) DO UPDATE SET metric_value = counter_metrics.metric_value + excluded.metric_value
+	RETURNING metric_value`, metric.ID, labelsJSON(metric.Labels), metric.GetDelta()).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	output := metric.Clone()
+	output.Delta = &total
+	if err := s.insertSample(ctx, tx, &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+// histogramValue представление гистограммы в колонке metric_value.
+type histogramValue struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+func marshalHistogram(metric *repository.Metric) (string, error) {
+	data, err := json.Marshal(histogramValue{
+		Buckets: metric.Buckets,
+		Counts:  metric.Counts,
+		Sum:     metric.GetSum(),
+		Count:   metric.GetCount(),
+	})
+	return string(data), err
+}
+
+func unmarshalHistogram(data string, metric *repository.Metric) error {
+	var value histogramValue
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return err
+	}
+
+	metric.Buckets = value.Buckets
+	metric.Counts = value.Counts
+	metric.Sum = &value.Sum
+	metric.Count = &value.Count
+	return nil
+}
+
+// updateHistogram объединяет гистограмму с сохраненной. Блокировка на запись взята в начале транзакции,
+// поэтому между чтением и записью ее никто не изменит.
+func (s *SQLite) updateHistogram(ctx context.Context, tx *sql.Tx, metric *repository.Metric) (*repository.Metric, error) {
+	labels := labelsJSON(metric.Labels)
+	var saved string
+	err := tx.QueryRowContext(ctx, "SELECT metric_value FROM histogram_metrics WHERE metric_id = ? AND metric_labels = ?",
+		metric.ID, labels).Scan(&saved)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	merged := metric
+	if err == nil {
+		current := repository.Metric{ID: metric.ID, MType: metric.MType, Labels: metric.Labels}
+		if err := unmarshalHistogram(saved, &current); err != nil {
+			return nil, err
+		}
+		merged, err = current.MergeHistogram(metric)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := marshalHistogram(merged)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO histogram_metrics (metric_id, metric_labels, metric_value) VALUES (?, ?, ?)
+	ON CONFLICT (metric_id, metric_labels) DO UPDATE SET metric_value = excluded.metric_value`, metric.ID, labels, value)
+	if err != nil {
+		return nil, err
+	}
+
+	output := merged.Clone()
+	return &output, nil
+}
+
+// UpdateMetricsOnce применяет батч только при первом вызове с key, повторные вызовы возвращают сохраненный результат.
+// Ключ и метрики пишутся в одной транзакции.
+func (s *SQLite) UpdateMetricsOnce(ctx context.Context, key string, metrics []repository.Metric) ([]repository.Metric, error) {
+	var output []repository.Metric
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var result sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT result FROM idempotency_keys WHERE idempotency_key = ?", key).Scan(&result)
+		if err == nil {
+			return json.Unmarshal([]byte(result.String), &output)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		output, err = s.updateMetricsWithTx(ctx, tx, metrics)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(output)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO idempotency_keys (idempotency_key, result, applied_at) VALUES (?, ?, ?)",
+			key, string(data), time.Now().UnixNano())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (s *SQLite) DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE applied_at < ?", before.UnixNano())
+	return err
+}
+
+// tableName возвращает таблицу, в которой хранятся метрики типа metricType.
+func tableName(metricType string) (string, error) {
+	switch metricType {
+	case repository.GaugeMetricKey:
+		return "gauge_metrics", nil
+	case repository.CounterMetricKey:
+		return "counter_metrics", nil
+	case repository.HistogramMetricKey:
+		return "histogram_metrics", nil
+	}
+	return "", types.ErrUnsupportedMetricType
+}
+
+func (s *SQLite) GetMetric(ctx context.Context, metricName string, metricType string, labels repository.Labels) (*repository.Metric, error) {
+	table, err := tableName(metricType)
+	if err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRowContext(ctx, "SELECT metric_value FROM "+table+" WHERE metric_id = ? AND metric_labels = ?",
+		metricName, labelsJSON(labels))
+	output := &repository.Metric{ID: metricName, MType: metricType, Labels: labels}
+	if err := scanValue(row, output); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, types.ErrCantFindMetric
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+func (s *SQLite) GetAllMetricsByType(ctx context.Context, metricType string) ([]repository.Metric, error) {
+	output := make([]repository.Metric, 0)
+	table, err := tableName(metricType)
+	if err != nil {
+		return output, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT metric_id, metric_labels, metric_value FROM "+table)
+	if err != nil {
+		return output, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		metric := repository.Metric{MType: metricType}
+		var labels string
+		var value any
+		if err := rows.Scan(&metric.ID, &labels, &value); err != nil {
+			return output, err
+		}
+		if err := setValue(value, &metric); err != nil {
+			return output, err
+		}
+
+		metric.Labels, err = scanLabels(labels)
+		if err != nil {
+			return output, err
+		}
+		output = append(output, metric)
+	}
+
+	return output, rows.Err()
+}
+
+// scanValue читает колонку metric_value в поле метрики, соответствующее ее типу.
+func scanValue(row *sql.Row, metric *repository.Metric) error {
+	var value any
+	if err := row.Scan(&value); err != nil {
+		return err
+	}
+	return setValue(value, metric)
+}
+
+func setValue(value any, metric *repository.Metric) error {
+	switch metric.MType {
+	case repository.GaugeMetricKey:
+		var gauge sql.NullFloat64
+		if err := gauge.Scan(value); err != nil {
+			return err
+		}
+		metric.Value = &gauge.Float64
+	case repository.CounterMetricKey:
+		var counter sql.NullInt64
+		if err := counter.Scan(value); err != nil {
+			return err
+		}
+		metric.Delta = &counter.Int64
+	case repository.HistogramMetricKey:
+		var histogram sql.NullString
+		if err := histogram.Scan(value); err != nil {
+			return err
+		}
+		return unmarshalHistogram(histogram.String, metric)
+	}
+	return nil
+}
+
+func (s *SQLite) GetMetricHistory(ctx context.Context, metricName, metricType string, labels repository.Labels, from, to time.Time) ([]repository.Sample, error) {
+	if metricType != repository.GaugeMetricKey && metricType != repository.CounterMetricKey {
+		return nil, types.ErrUnsupportedMetricType
+	}
+
+	output := make([]repository.Sample, 0)
+	rows, err := s.db.QueryContext(ctx, `SELECT sampled_at, metric_value FROM metric_samples
+	WHERE metric_type = ? AND metric_id = ? AND metric_labels = ? AND sampled_at BETWEEN ? AND ?
+	ORDER BY sampled_at`, metricType, metricName, labelsJSON(labels), from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return output, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sampledAt int64
+		var sample repository.Sample
+		if err := rows.Scan(&sampledAt, &sample.Value); err != nil {
+			return output, err
+		}
+		sample.Timestamp = time.Unix(0, sampledAt)
+		output = append(output, sample)
+	}
+
+	return output, rows.Err()
+}
+
+func (s *SQLite) DeleteHistoryBefore(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM metric_samples WHERE sampled_at < ?", before.UnixNano())
+	return err
+}
+
+func (s *SQLite) PingRepo() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	return s.db.PingContext(ctx) == nil
+}
+
+func (s *SQLite) CloseRepository() {
+	s.db.Close()
+}
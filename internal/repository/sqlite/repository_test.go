@@ -0,0 +1,239 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+func newTestRepo(t *testing.T, opts ...Option) (*SQLite, string) {
+	dsn := Scheme + filepath.Join(t.TempDir(), "metrics.db")
+	repo, err := NewSQLiteRepo(dsn, opts...)
+	require.NoError(t, err)
+	t.Cleanup(repo.CloseRepository)
+	return repo, dsn
+}
+
+func counter(id string, delta int64, labels repository.Labels) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.CounterMetricKey, Delta: &delta, Labels: labels}
+}
+
+func gauge(id string, value float64) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.GaugeMetricKey, Value: &value}
+}
+
+func TestDriverDSN(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "absolute path",
+			dsn:  "sqlite:///var/lib/metrics.db",
+			want: "file:/var/lib/metrics.db?_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29&_pragma=synchronous%28NORMAL%29&_txlock=immediate",
+		},
+		{
+			name: "params override defaults",
+			dsn:  "sqlite://metrics.db?_txlock=deferred&_pragma=busy_timeout(100)",
+			want: "file:metrics.db?_pragma=busy_timeout%28100%29&_txlock=deferred",
+		},
+		{
+			name:    "empty path",
+			dsn:     "sqlite://",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := driverDSN(test.dsn)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestIsDSN(t *testing.T) {
+	assert.True(t, IsDSN("sqlite:///var/lib/metrics.db"))
+	assert.False(t, IsDSN("postgres://user@localhost/metrics"))
+	assert.False(t, IsDSN(""))
+}
+
+func TestUpdateMetric(t *testing.T) {
+	repo, _ := newTestRepo(t)
+	ctx := context.Background()
+	labels := repository.Labels{"host": "a"}
+
+	first := counter("PollCount", 2, nil)
+	output, err := repo.UpdateMetric(ctx, &first)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), output.GetDelta())
+
+	second := counter("PollCount", 3, nil)
+	output, err = repo.UpdateMetric(ctx, &second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), output.GetDelta())
+
+	// метки входят в идентификатор метрики
+	labeled := counter("PollCount", 1, labels)
+	output, err = repo.UpdateMetric(ctx, &labeled)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), output.GetDelta())
+
+	alloc := gauge("Alloc", 1.5)
+	_, err = repo.UpdateMetric(ctx, &alloc)
+	require.NoError(t, err)
+	alloc = gauge("Alloc", 2.5)
+	_, err = repo.UpdateMetric(ctx, &alloc)
+	require.NoError(t, err)
+
+	saved, err := repo.GetMetric(ctx, "Alloc", repository.GaugeMetricKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, saved.GetValue())
+
+	saved, err = repo.GetMetric(ctx, "PollCount", repository.CounterMetricKey, labels)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), saved.GetDelta())
+	assert.Equal(t, labels, saved.Labels)
+
+	_, err = repo.GetMetric(ctx, "Unknown", repository.GaugeMetricKey, nil)
+	assert.ErrorIs(t, err, types.ErrCantFindMetric)
+	_, err = repo.GetMetric(ctx, "Alloc", "summary", nil)
+	assert.ErrorIs(t, err, types.ErrUnsupportedMetricType)
+
+	counters, err := repo.GetAllMetricsByType(ctx, repository.CounterMetricKey)
+	require.NoError(t, err)
+	assert.Len(t, counters, 2)
+}
+
+func TestUpdateHistogram(t *testing.T) {
+	repo, _ := newTestRepo(t)
+	ctx := context.Background()
+	buckets := []float64{1, 5}
+
+	first := repository.NewHistogram("latency", buckets)
+	first.Observe(0.5)
+	_, err := repo.UpdateMetric(ctx, first)
+	require.NoError(t, err)
+
+	second := repository.NewHistogram("latency", buckets)
+	second.Observe(3)
+	second.Observe(10)
+	output, err := repo.UpdateMetric(ctx, second)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 1, 1}, output.Counts)
+	assert.Equal(t, uint64(3), output.GetCount())
+	assert.Equal(t, 13.5, output.GetSum())
+
+	saved, err := repo.GetMetric(ctx, "latency", repository.HistogramMetricKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, output.Counts, saved.Counts)
+
+	mismatch := repository.NewHistogram("latency", []float64{2})
+	_, err = repo.UpdateMetric(ctx, mismatch)
+	assert.ErrorIs(t, err, types.ErrHistogramBucketsMismatch)
+}
+
+func TestUpdateMetricsTransaction(t *testing.T) {
+	repo, _ := newTestRepo(t)
+	ctx := context.Background()
+
+	output, err := repo.UpdateMetrics(ctx, []repository.Metric{
+		counter("PollCount", 1, nil),
+		gauge("Alloc", 1),
+		counter("PollCount", 2, nil),
+	})
+	require.NoError(t, err)
+	require.Len(t, output, 3)
+	assert.Equal(t, int64(1), output[0].GetDelta())
+	assert.Equal(t, int64(3), output[2].GetDelta())
+
+	// ошибка в середине батча откатывает все изменения
+	histogram := repository.NewHistogram("latency", []float64{1})
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{
+		counter("PollCount", 10, nil),
+		*histogram,
+		{ID: "Broken", MType: "summary"},
+	})
+	assert.ErrorIs(t, err, types.ErrUnsupportedMetricType)
+
+	saved, err := repo.GetMetric(ctx, "PollCount", repository.CounterMetricKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), saved.GetDelta())
+	_, err = repo.GetMetric(ctx, "latency", repository.HistogramMetricKey, nil)
+	assert.ErrorIs(t, err, types.ErrCantFindMetric)
+}
+
+func TestUpdateMetricsOnce(t *testing.T) {
+	repo, _ := newTestRepo(t)
+	ctx := context.Background()
+	batch := []repository.Metric{counter("PollCount", 2, nil)}
+
+	first, err := repo.UpdateMetricsOnce(ctx, "key", batch)
+	require.NoError(t, err)
+	second, err := repo.UpdateMetricsOnce(ctx, "key", batch)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	saved, err := repo.GetMetric(ctx, "PollCount", repository.CounterMetricKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), saved.GetDelta())
+
+	require.NoError(t, repo.DeleteIdempotencyKeysBefore(ctx, time.Now().Add(time.Minute)))
+	_, err = repo.UpdateMetricsOnce(ctx, "key", batch)
+	require.NoError(t, err)
+	saved, err = repo.GetMetric(ctx, "PollCount", repository.CounterMetricKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), saved.GetDelta())
+}
+
+func TestHistory(t *testing.T) {
+	repo, _ := newTestRepo(t, WithHistory())
+	ctx := context.Background()
+	from := time.Now()
+
+	_, err := repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 1, nil), counter("PollCount", 2, nil)})
+	require.NoError(t, err)
+
+	samples, err := repo.GetMetricHistory(ctx, "PollCount", repository.CounterMetricKey, nil, from, time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, 1.0, samples[0].Value)
+	assert.Equal(t, 3.0, samples[1].Value)
+
+	require.NoError(t, repo.DeleteHistoryBefore(ctx, time.Now().Add(time.Minute)))
+	samples, err = repo.GetMetricHistory(ctx, "PollCount", repository.CounterMetricKey, nil, from, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+}
+
+func TestReopen(t *testing.T) {
+	repo, dsn := newTestRepo(t)
+	ctx := context.Background()
+
+	alloc := gauge("Alloc", 7)
+	_, err := repo.UpdateMetric(ctx, &alloc)
+	require.NoError(t, err)
+	assert.True(t, repo.PingRepo())
+	repo.CloseRepository()
+
+	reopened, err := NewSQLiteRepo(dsn)
+	require.NoError(t, err)
+	defer reopened.CloseRepository()
+
+	saved, err := reopened.GetMetric(ctx, "Alloc", repository.GaugeMetricKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, saved.GetValue())
+}
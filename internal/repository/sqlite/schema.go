@@ -0,0 +1,76 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations изменения схемы по порядку. Номер версии - индекс миграции плюс один,
+// примененная версия хранится в PRAGMA user_version. Уже выпущенные миграции не меняются, новые добавляются в конец.
+// Время хранится в наносекундах Unix, метки - в каноничном JSON, как их кодирует labelsJSON.
+var migrations = []string{
+	`CREATE TABLE gauge_metrics (
+		metric_id TEXT NOT NULL,
+		metric_labels TEXT NOT NULL DEFAULT '{}',
+		metric_value REAL NOT NULL,
+		PRIMARY KEY (metric_id, metric_labels)
+	);
+	CREATE TABLE counter_metrics (
+		metric_id TEXT NOT NULL,
+		metric_labels TEXT NOT NULL DEFAULT '{}',
+		metric_value INTEGER NOT NULL,
+		PRIMARY KEY (metric_id, metric_labels)
+	);
+	CREATE TABLE histogram_metrics (
+		metric_id TEXT NOT NULL,
+		metric_labels TEXT NOT NULL DEFAULT '{}',
+		metric_value TEXT NOT NULL,
+		PRIMARY KEY (metric_id, metric_labels)
+	);
+	CREATE TABLE metric_samples (
+		metric_type TEXT NOT NULL,
+		metric_id TEXT NOT NULL,
+		metric_labels TEXT NOT NULL DEFAULT '{}',
+		sampled_at INTEGER NOT NULL,
+		metric_value REAL NOT NULL
+	);
+	CREATE INDEX metric_samples_series_idx ON metric_samples (metric_type, metric_id, metric_labels, sampled_at);
+	CREATE INDEX metric_samples_sampled_at_idx ON metric_samples (sampled_at);
+	CREATE TABLE idempotency_keys (
+		idempotency_key TEXT PRIMARY KEY,
+		result TEXT,
+		applied_at INTEGER NOT NULL
+	);`,
+}
+
+// migrate применяет миграции новее сохраненной версии, каждую в своей транзакции.
+func migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("sqlite schema version %d is newer than supported %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("apply sqlite migration %d: %w", i+1, err)
+		}
+		// PRAGMA не принимает параметры, версия подставляется числом.
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,3 +9,9 @@ var ErrCantFindMetric error = errors.New("can't find metric")
 var ErrMetricNilValue error = errors.New("value for update metric is nill")
 var ErrUnsupportedMetricValueType error = errors.New("unsupported value type")
 var ErrWileUpdateMetric error = errors.New("eror while update metric")
+var ErrInvalidHistogram error = errors.New("invalid histogram")
+var ErrHistogramBucketsMismatch error = errors.New("histogram buckets mismatch")
+var ErrInvalidLabels error = errors.New("invalid metric labels")
+var ErrInvalidRangeQuery error = errors.New("invalid range query")
+var ErrInvalidIdempotencyKey error = errors.New("invalid idempotency key")
+var ErrNonFiniteValue error = errors.New("metric value must be finite")
@@ -5,12 +5,18 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 )
 
-var ErrEmptyKeyPath = errors.New("RSA key path is empty")
+var (
+	ErrEmptyKeyPath = errors.New("RSA key path is empty")
+	ErrNoPEMBlock   = errors.New("no PEM block found")
+)
 
 func ReadPublicRSAKey(path string) (*rsa.PublicKey, error) {
 	if path == "" {
@@ -50,6 +56,64 @@ func ReadPrivateRSAKey(path string) (*rsa.PrivateKey, error) {
 	return key, nil
 }
 
+// ReadPrivateRSAKeys читает закрытые ключи из списка путей через запятую.
+// Путь может указывать на файл или на директорию, из директории читаются все файлы *.pem и *.key.
+func ReadPrivateRSAKeys(paths string) ([]*rsa.PrivateKey, error) {
+	if strings.TrimSpace(paths) == "" {
+		return nil, ErrEmptyKeyPath
+	}
+
+	keys := make([]*rsa.PrivateKey, 0)
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		files, err := keyFiles(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			key, err := ReadPrivateRSAKey(file)
+			if err != nil {
+				return nil, fmt.Errorf("read key %s: %w", file, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA keys found in %s", paths)
+	}
+	return keys, nil
+}
+
+func keyFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.Type().IsRegular() && (ext == ".pem" || ext == ".key") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
 func readPEMFile(path string) ([]byte, error) {
 	body, err := os.ReadFile(path)
 	if err != nil {
@@ -60,7 +124,7 @@ func readPEMFile(path string) ([]byte, error) {
 	block, _ := pem.Decode(body)
 	if block == nil {
 		logger.Log.Errorf("no PEM block found in file: %s", path)
-		return nil, err
+		return nil, ErrNoPEMBlock
 	}
 
 	return block.Bytes, nil
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/whynullname/go-collect-metrics/internal/alerting"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+// AlertsSource источник текущих состояний алертов.
+type AlertsSource interface {
+	Alerts() []alerting.Alert
+}
+
+// WithAlerts подключает источник алертов для /api/v1/alerts.
+func WithAlerts(alerts AlertsSource) Option {
+	return func(h *Handlers) {
+		h.alerts = alerts
+	}
+}
+
+type alertsResponse struct {
+	Alerts []alerting.Alert `json:"alerts"`
+}
+
+// GetAlerts обработчик получения текущих состояний алертов.
+// Если алертинг не настроен, возвращается пустой список.
+func (h *Handlers) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	response := alertsResponse{Alerts: make([]alerting.Alert, 0)}
+	if h.alerts != nil {
+		response.Alerts = h.alerts.Alerts()
+	}
+
+	output, err := json.Marshal(response)
+	if err != nil {
+		logger.Log.Errorf("Error with marshal output JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
@@ -10,9 +10,12 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/promtext"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
 	"github.com/whynullname/go-collect-metrics/internal/repository/types"
 	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
@@ -29,14 +32,28 @@ const (
     <h1>Gauge data</h1>
     <ul>
         {{range $key, $value := .Gauge}}
-            <li><strong>{{$key}}:</strong> {{$value}}</li>
+            <li><strong>{{$value.ID}}{{if $value.Labels}}{ {{$value.Labels}} }{{end}}:</strong> {{$value.GetValue}}</li>
         {{end}}
     </ul>
 
     <h1>Counter data</h1>
     <ul>
         {{range $key, $value := .Counter}}
-            <li><strong>{{$key}}:</strong> {{$value}}</li>
+            <li><strong>{{$value.ID}}{{if $value.Labels}}{ {{$value.Labels}} }{{end}}:</strong> {{$value.GetDelta}}</li>
+        {{end}}
+    </ul>
+
+    <h1>Histogram data</h1>
+    <ul>
+        {{range $key, $value := .Histogram}}
+            <li><strong>{{$value.ID}}{{if $value.Labels}}{ {{$value.Labels}} }{{end}}:</strong> count {{$value.GetCount}}, sum {{$value.GetSum}}
+                <ul>
+                    {{range $index, $bound := $value.Buckets}}
+                        <li>le {{$bound}}: {{index $value.Counts $index}}</li>
+                    {{end}}
+                    <li>le +Inf: {{index $value.Counts (len $value.Buckets)}}</li>
+                </ul>
+            </li>
         {{end}}
     </ul>
 </body>
@@ -46,13 +63,24 @@ const (
 type Handlers struct {
 	metricsUseCase *metrics.MetricsUseCase
 	pingRepoFunc   func() bool
+	alerts         AlertsSource
+	snapshotter    Snapshotter
+	snapshotMx     sync.Mutex
+	lastSnapshot   time.Time
 }
 
-func NewHandlers(metricsUseCase *metrics.MetricsUseCase, pingRepoFunc func() bool) *Handlers {
-	return &Handlers{
+// Option настраивает Handlers.
+type Option func(*Handlers)
+
+func NewHandlers(metricsUseCase *metrics.MetricsUseCase, pingRepoFunc func() bool, opts ...Option) *Handlers {
+	h := &Handlers{
 		metricsUseCase: metricsUseCase,
 		pingRepoFunc:   pingRepoFunc,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // GetAllMetrics обработчик получения всех метрик.
@@ -63,20 +91,21 @@ func (h *Handlers) GetAllMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gaugeMetrics, err := h.metricsUseCase.GetAllMetricsByType(r.Context(), repository.GaugeMetricKey)
+	allMetrics, err := h.metricsUseCase.GetAllMetricsByLabels(r.Context(), labelsFromQuery(r))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	counterMetrics, err := h.metricsUseCase.GetAllMetricsByType(r.Context(), repository.CounterMetricKey)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+
+	metricsByType := make(map[string][]repository.Metric)
+	for _, metric := range allMetrics {
+		metricsByType[metric.MType] = append(metricsByType[metric.MType], metric)
 	}
 
 	data := map[string]any{
-		"Gauge":   gaugeMetrics,
-		"Counter": counterMetrics,
+		"Gauge":     metricsByType[repository.GaugeMetricKey],
+		"Counter":   metricsByType[repository.CounterMetricKey],
+		"Histogram": metricsByType[repository.HistogramMetricKey],
 	}
 	var buf bytes.Buffer
 	err = tmpl.Execute(&buf, data)
@@ -90,6 +119,26 @@ func (h *Handlers) GetAllMetrics(w http.ResponseWriter, r *http.Request) {
 	buf.WriteTo(w)
 }
 
+// GetPrometheusMetrics обработчик выдачи всех метрик в текстовом формате Prometheus.
+func (h *Handlers) GetPrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	allMetrics, err := h.metricsUseCase.GetAllMetricsByLabels(r.Context(), labelsFromQuery(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := promtext.Write(&buf, allMetrics); err != nil {
+		logger.Log.Errorf("Error with write prometheus metrics: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", promtext.ContentType)
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
 // UpdateMetric обработчик обнолвение метрики через POST.
 func (h *Handlers) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
@@ -103,6 +152,11 @@ func (h *Handlers) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	metricName := chi.URLParam(r, "merticName")
 	metricValue := chi.URLParam(r, "metricValue")
 
+	if metricType == repository.HistogramMetricKey {
+		h.observeHistogram(w, r, metricName, metricValue)
+		return
+	}
+
 	var metricObject repository.Metric
 	switch metricType {
 	case repository.CounterMetricKey:
@@ -113,9 +167,10 @@ func (h *Handlers) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		metricObject = repository.Metric{
-			MType: repository.CounterMetricKey,
-			Delta: &value,
-			ID:    metricName,
+			MType:  repository.CounterMetricKey,
+			Delta:  &value,
+			ID:     metricName,
+			Labels: labelsFromQuery(r),
 		}
 	case repository.GaugeMetricKey:
 		value, err := strconv.ParseFloat(metricValue, 64)
@@ -125,9 +180,10 @@ func (h *Handlers) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		metricObject = repository.Metric{
-			MType: repository.GaugeMetricKey,
-			Value: &value,
-			ID:    metricName,
+			MType:  repository.GaugeMetricKey,
+			Value:  &value,
+			ID:     metricName,
+			Labels: labelsFromQuery(r),
 		}
 	default:
 		w.WriteHeader(http.StatusBadRequest)
@@ -138,7 +194,31 @@ func (h *Handlers) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	_, err := h.metricsUseCase.UpdateMetric(r.Context(), &metricObject)
 	if err != nil {
 		logger.Log.Errorf("Error with update metrics: %w", err)
-		if errors.Is(err, types.ErrMetricNilValue) || errors.Is(err, types.ErrUnsupportedMetricType) {
+		if isBadMetricError(err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handlers) observeHistogram(w http.ResponseWriter, r *http.Request, metricName string, metricValue string) {
+	value, err := strconv.ParseFloat(metricValue, 64)
+	if err != nil {
+		logger.Log.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logger.Log.Infof("Data received! Key %s, metricaName %s, metricValue %s \n", repository.HistogramMetricKey, metricName, metricValue)
+	_, err = h.metricsUseCase.ObserveHistogram(r.Context(), metricName, labelsFromQuery(r), value)
+	if err != nil {
+		logger.Log.Errorf("Error with update metrics: %w", err)
+		if isBadMetricError(err) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -150,6 +230,31 @@ func (h *Handlers) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// labelsFromQuery собирает метки из query параметров запроса, например ?host=a&service=b.
+func labelsFromQuery(r *http.Request) repository.Labels {
+	query := r.URL.Query()
+	if len(query) == 0 {
+		return nil
+	}
+
+	labels := make(repository.Labels, len(query))
+	for name := range query {
+		labels[name] = query.Get(name)
+	}
+	return labels
+}
+
+// isBadMetricError сообщает, что ошибка вызвана некорректной метрикой в запросе.
+func isBadMetricError(err error) bool {
+	return errors.Is(err, types.ErrMetricNilValue) ||
+		errors.Is(err, types.ErrUnsupportedMetricType) ||
+		errors.Is(err, types.ErrInvalidHistogram) ||
+		errors.Is(err, types.ErrHistogramBucketsMismatch) ||
+		errors.Is(err, types.ErrInvalidLabels) ||
+		errors.Is(err, types.ErrInvalidIdempotencyKey) ||
+		errors.Is(err, types.ErrNonFiniteValue)
+}
+
 // UpdateMetricFromJSON обработчик обновление метрики в формате JSON.
 func (h *Handlers) UpdateMetricFromJSON(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -179,7 +284,7 @@ func (h *Handlers) UpdateMetricFromJSON(w http.ResponseWriter, r *http.Request)
 	updatedMetric, err := h.metricsUseCase.UpdateMetric(r.Context(), &metricJSON)
 	if err != nil {
 		logger.Log.Errorf("Error with update metrics: %w", err)
-		if errors.Is(err, types.ErrMetricNilValue) || errors.Is(err, types.ErrUnsupportedMetricType) {
+		if isBadMetricError(err) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -199,6 +304,9 @@ func (h *Handlers) UpdateMetricFromJSON(w http.ResponseWriter, r *http.Request)
 	w.Write(output)
 }
 
+// IdempotencyKeyHeader заголовок с ключом идемпотентности батча. Батч с уже примененным ключом не применяется повторно.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 // UpdateArrayJSONMetrics обработчик массива JSON метрик.
 func (h *Handlers) UpdateArrayJSONMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -223,11 +331,11 @@ func (h *Handlers) UpdateArrayJSONMetrics(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	outputMetrics, err := h.metricsUseCase.UpdateMetrics(r.Context(), metrics)
+	outputMetrics, err := h.metricsUseCase.UpdateMetricsOnce(r.Context(), r.Header.Get(IdempotencyKeyHeader), metrics)
 	if err != nil {
 		logger.Log.Errorf("Error with update metrics: %w", err)
 
-		if errors.Is(err, types.ErrMetricNilValue) || errors.Is(err, types.ErrUnsupportedMetricType) {
+		if isBadMetricError(err) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -252,7 +360,7 @@ func (h *Handlers) GetMetricByName(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "metricType")
 	metricName := chi.URLParam(r, "metricName")
 
-	val, err := h.metricsUseCase.GetMetric(r.Context(), metricType, metricName)
+	val, err := h.metricsUseCase.GetMetricWithLabels(r.Context(), metricType, metricName, labelsFromQuery(r))
 	if err != nil {
 		if errors.Is(err, types.ErrCantFindMetric) {
 			w.WriteHeader(http.StatusNotFound)
@@ -269,7 +377,20 @@ func (h *Handlers) GetMetricByName(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, fmt.Sprintf("%d", *val.Delta))
 	case repository.GaugeMetricKey:
 		io.WriteString(w, strconv.FormatFloat(*val.Value, 'f', -1, 64))
+	case repository.HistogramMetricKey:
+		writeHistogramText(w, val)
+	}
+}
+
+// writeHistogramText пишет гистограмму построчно: накопленные значения бакетов, сумму и количество.
+func writeHistogramText(w io.Writer, histogram *repository.Metric) {
+	cumulative := histogram.CumulativeCounts()
+	for i, bound := range histogram.Buckets {
+		fmt.Fprintf(w, "%s %d\n", strconv.FormatFloat(bound, 'f', -1, 64), cumulative[i])
 	}
+	fmt.Fprintf(w, "+Inf %d\n", cumulative[len(cumulative)-1])
+	fmt.Fprintf(w, "sum %s\n", strconv.FormatFloat(histogram.GetSum(), 'f', -1, 64))
+	fmt.Fprintf(w, "count %d\n", histogram.GetCount())
 }
 
 // GetMetricByNameFromJSON обработчик получения метрики через JSON input.
@@ -297,7 +418,7 @@ func (h *Handlers) GetMetricByNameFromJSON(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	ouputMetric, err := h.metricsUseCase.GetMetric(r.Context(), metricJSON.MType, metricJSON.ID)
+	ouputMetric, err := h.metricsUseCase.GetMetricWithLabels(r.Context(), metricJSON.MType, metricJSON.ID, metricJSON.Labels)
 	if err != nil {
 		if errors.Is(err, types.ErrCantFindMetric) {
 			w.WriteHeader(http.StatusNotFound)
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/whynullname/go-collect-metrics/internal/influx"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+type influxError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// WriteInflux обработчик записи метрик в формате InfluxDB line protocol, совместим с /api/v2/write.
+// Все точки запроса записываются одним вызовом UpdateMetrics.
+func (h *Handlers) WriteInflux(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Log.Errorf("Error while read influx body: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	metrics, err := influx.ParseLines(body)
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+		return
+	}
+
+	if len(metrics) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if _, err := h.metricsUseCase.UpdateMetrics(r.Context(), metrics); err != nil {
+		if isBadMetricError(err) {
+			writeInfluxError(w, http.StatusBadRequest, "invalid", err)
+			return
+		}
+		logger.Log.Errorf("Error while write influx metrics: %v", err)
+		writeInfluxError(w, http.StatusInternalServerError, "internal error", errors.New("can't write metrics"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeInfluxError(w http.ResponseWriter, status int, code string, err error) {
+	output, marshalErr := json.Marshal(influxError{Code: code, Message: err.Error()})
+	if marshalErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+const (
+	defaultRangeDuration = time.Hour
+	defaultRangeStep     = 15 * time.Second
+)
+
+// queryRangeParams параметры запроса, которые не считаются метками.
+var queryRangeParams = map[string]bool{"id": true, "type": true, "from": true, "to": true, "step": true}
+
+type queryRangeResponse struct {
+	ID      string              `json:"id"`
+	MType   string              `json:"type"`
+	Labels  repository.Labels   `json:"labels,omitempty"`
+	From    time.Time           `json:"from"`
+	To      time.Time           `json:"to"`
+	Step    string              `json:"step"`
+	Samples []repository.Sample `json:"samples"`
+}
+
+// QueryRange обработчик получения истории метрики за период.
+// Параметры: id, type, from и to (RFC3339 или unix время в секундах), step (например 15s или 15).
+// Остальные query параметры считаются метками.
+func (h *Handlers) QueryRange(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	metricName := query.Get("id")
+	metricType := query.Get("type")
+	if metricName == "" || metricType == "" {
+		http.Error(w, "id and type are required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	to, err := parseTimeParam(query.Get("to"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(query.Get("from"), to.Add(-defaultRangeDuration))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := parseStepParam(query.Get("step"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	labels := make(repository.Labels)
+	for name := range query {
+		if !queryRangeParams[name] {
+			labels[name] = query.Get(name)
+		}
+	}
+	labels = labels.Normalize()
+
+	samples, err := h.metricsUseCase.QueryRange(r.Context(), metricType, metricName, labels, from, to, step)
+	if err != nil {
+		if errors.Is(err, types.ErrInvalidRangeQuery) || errors.Is(err, types.ErrUnsupportedMetricType) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Log.Errorf("Error with query range: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(queryRangeResponse{
+		ID:      metricName,
+		MType:   metricType,
+		Labels:  labels,
+		From:    from,
+		To:      to,
+		Step:    step.String(),
+		Samples: samples,
+	})
+	if err != nil {
+		logger.Log.Errorf("Error with marshal output JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
+
+// parseTimeParam разбирает время в формате RFC3339 или unix время в секундах.
+func parseTimeParam(value string, defaultValue time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*float64(time.Second))), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't parse time %q", value)
+	}
+	return t, nil
+}
+
+// parseStepParam разбирает шаг в формате time.Duration или в секундах.
+func parseStepParam(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultRangeStep, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	step, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse step %q", value)
+	}
+	return step, nil
+}
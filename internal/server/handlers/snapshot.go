@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+)
+
+// minSnapshotInterval минимальный интервал между снимками по запросу.
+// Копии снимков ротируются по количеству, и частые вызовы вытеснили бы все прежние копии.
+const minSnapshotInterval = time.Minute
+
+// ErrSnapshotUnavailable снимок сейчас сделать нельзя, например хранилище уже закрыто при остановке сервера.
+var ErrSnapshotUnavailable = errors.New("snapshot unavailable")
+
+// Snapshot сохраненная копия снимка метрик.
+type Snapshot struct {
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+// Snapshotter сохраняет снимок метрик по запросу.
+type Snapshotter interface {
+	Snapshot() (Snapshot, error)
+}
+
+// WithSnapshots подключает сохранение снимка метрик по запросу для /api/v1/admin/snapshot.
+func WithSnapshots(snapshotter Snapshotter) Option {
+	return func(h *Handlers) {
+		h.snapshotter = snapshotter
+	}
+}
+
+// CreateSnapshot обработчик немедленного сохранения снимка метрик, например перед рискованным обновлением.
+// В ответе путь и время сохраненной копии снимка. Снимки чаще minSnapshotInterval отклоняются с 429.
+func (h *Handlers) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	if h.snapshotter == nil {
+		http.Error(w, "snapshots are not configured", http.StatusNotFound)
+		return
+	}
+
+	h.snapshotMx.Lock()
+	defer h.snapshotMx.Unlock()
+	if wait := minSnapshotInterval - time.Since(h.lastSnapshot); !h.lastSnapshot.IsZero() && wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	snapshot, err := h.snapshotter.Snapshot()
+	if err != nil {
+		logger.Log.Errorf("Can't write metrics snapshot: %v", err)
+		if errors.Is(err, ErrSnapshotUnavailable) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.lastSnapshot = time.Now()
+
+	output, err := json.Marshal(snapshot)
+	if err != nil {
+		logger.Log.Errorf("Error with marshal output JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
@@ -9,9 +9,12 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	config "github.com/whynullname/go-collect-metrics/internal/configs/serverconfig"
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/middlewares"
+	"github.com/whynullname/go-collect-metrics/internal/middlewares/adminmiddleware"
 	"github.com/whynullname/go-collect-metrics/internal/middlewares/compressmiddleware"
+	"github.com/whynullname/go-collect-metrics/internal/middlewares/encryptionmiddleware"
 	"github.com/whynullname/go-collect-metrics/internal/middlewares/shamiddleware"
 	"github.com/whynullname/go-collect-metrics/internal/server/handlers"
 	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
@@ -21,13 +24,16 @@ type Server struct {
 	Config   *config.ServerConfig
 	Router   chi.Router
 	Handlers *handlers.Handlers
+	// Verifier проверяет подписи HashKey, его же использует gRPC сервер, чтобы nonce нельзя было повторить через другой транспорт.
+	Verifier *hashsign.Verifier
 	server   *http.Server
 }
 
-func NewServer(metricsUseCase *metrics.MetricsUseCase, config *config.ServerConfig, pingRepoFunc func() bool) *Server {
+func NewServer(metricsUseCase *metrics.MetricsUseCase, config *config.ServerConfig, pingRepoFunc func() bool, opts ...handlers.Option) *Server {
 	serverInstance := &Server{
 		Config:   config,
-		Handlers: handlers.NewHandlers(metricsUseCase, pingRepoFunc),
+		Handlers: handlers.NewHandlers(metricsUseCase, pingRepoFunc, opts...),
+		Verifier: hashsign.NewVerifier(config.HashKey, config.HashMaxSkew, config.HashNonceCacheSize),
 	}
 	serverInstance.Router = serverInstance.createRouter()
 	return serverInstance
@@ -40,6 +46,7 @@ func (s *Server) createRouter() chi.Router {
 	r.Route("/", func(r chi.Router) {
 		r.Get("/", s.Handlers.GetAllMetrics)
 		r.Get("/ping", s.Handlers.PingRepository)
+		r.Get("/metrics", s.Handlers.GetPrometheusMetrics)
 		r.Route("/value", func(r chi.Router) {
 			r.Post("/", s.Handlers.GetMetricByNameFromJSON)
 			r.Get("/{metricType}/{metricName}", s.Handlers.GetMetricByName)
@@ -51,14 +58,23 @@ func (s *Server) createRouter() chi.Router {
 		r.Route("/updates", func(r chi.Router) {
 			r.Post("/", s.Handlers.UpdateArrayJSONMetrics)
 		})
+		r.Route("/api/v1", func(r chi.Router) {
+			r.Get("/query_range", s.Handlers.QueryRange)
+			r.Get("/alerts", s.Handlers.GetAlerts)
+			r.With(adminmiddleware.AdminToken(s.Config)).Post("/admin/snapshot", s.Handlers.CreateSnapshot)
+		})
+		r.Route("/api/v2", func(r chi.Router) {
+			r.Post("/write", s.Handlers.WriteInflux)
+		})
 	})
 	return r
 }
 
 func (s *Server) registerMiddlewares(r chi.Router) {
 	r.Use(middlewares.Logging)
+	r.Use(encryptionmiddleware.RSAMiddleware(s.Config))
 	r.Use(compressmiddleware.GZIP)
-	r.Use(shamiddleware.HashSHA256(s.Config))
+	r.Use(shamiddleware.HashSHA256(s.Config, s.Verifier))
 }
 
 func (s *Server) ListenAndServe(exit chan os.Signal, idleConn chan struct{}) error {
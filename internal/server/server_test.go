@@ -1,19 +1,35 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/whynullname/go-collect-metrics/internal/agent"
+	"github.com/whynullname/go-collect-metrics/internal/agent/sender"
+	"github.com/whynullname/go-collect-metrics/internal/alerting"
 	configAgent "github.com/whynullname/go-collect-metrics/internal/configs/agentconfig"
 	configServer "github.com/whynullname/go-collect-metrics/internal/configs/serverconfig"
+	"github.com/whynullname/go-collect-metrics/internal/envelope"
+	"github.com/whynullname/go-collect-metrics/internal/hashsign"
 	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
 	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+	"github.com/whynullname/go-collect-metrics/internal/server/handlers"
+	"github.com/whynullname/go-collect-metrics/internal/storage/filestorage"
 	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
 )
 
@@ -67,6 +83,20 @@ func TestUpdateData(t *testing.T) {
 			methodType:  http.MethodPost,
 			wantCode:    http.StatusBadRequest,
 		},
+		{
+			name:        "positive test #3 - histogram observation",
+			targetURL:   "/update/histogram/someMetrics/0.3",
+			contentType: "text/plain",
+			methodType:  http.MethodPost,
+			wantCode:    http.StatusOK,
+		},
+		{
+			name:        "test bad histogram value",
+			targetURL:   "/update/histogram/someMetrics/badValue",
+			contentType: "text/plain",
+			methodType:  http.MethodPost,
+			wantCode:    http.StatusBadRequest,
+		},
 		{
 			name:        "test bad gauge value",
 			targetURL:   "/update/gauge/someMetric/badValue",
@@ -74,6 +104,27 @@ func TestUpdateData(t *testing.T) {
 			methodType:  http.MethodPost,
 			wantCode:    http.StatusBadRequest,
 		},
+		{
+			name:        "test NaN gauge value",
+			targetURL:   "/update/gauge/someMetric/NaN",
+			contentType: "text/plain",
+			methodType:  http.MethodPost,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:        "test infinite gauge value",
+			targetURL:   "/update/gauge/someMetric/+Inf",
+			contentType: "text/plain",
+			methodType:  http.MethodPost,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:        "test infinite histogram value",
+			targetURL:   "/update/histogram/someMetrics/-Inf",
+			contentType: "text/plain",
+			methodType:  http.MethodPost,
+			wantCode:    http.StatusBadRequest,
+		},
 	}
 	logger.Initialize("info")
 	repo := inmemory.NewInMemoryRepository()
@@ -170,3 +221,630 @@ func TestGetData(t *testing.T) {
 		})
 	}
 }
+
+func TestPrometheusMetrics(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository()
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	value := 1.5
+	delta := int64(3)
+	metricsUseCase.UpdateMetric(context.TODO(), &repository.Metric{ID: "Alloc", MType: repository.GaugeMetricKey, Value: &value})
+	metricsUseCase.UpdateMetric(context.TODO(), &repository.Metric{ID: "PollCount", MType: repository.CounterMetricKey, Delta: &delta})
+
+	resp, err := client.Client().Get(client.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE Alloc gauge\nAlloc 1.5\n# TYPE PollCount counter\nPollCount 3\n", string(data))
+}
+
+func TestUpdateHistogramJSON(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository()
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "new histogram",
+			body:     `{"id":"latency","type":"histogram","buckets":[0.1,1],"counts":[1,2,0],"sum":1.05,"count":3}`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "merge histogram",
+			body:     `{"id":"latency","type":"histogram","buckets":[0.1,1],"counts":[0,0,1],"sum":4,"count":1}`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "buckets mismatch",
+			body:     `{"id":"latency","type":"histogram","buckets":[0.5],"counts":[0,1],"sum":4,"count":1}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "inconsistent count",
+			body:     `{"id":"latency","type":"histogram","buckets":[0.1,1],"counts":[0,0,1],"sum":4,"count":5}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Client().Post(client.URL+"/update/", "application/json", strings.NewReader(test.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.wantCode, resp.StatusCode)
+		})
+	}
+
+	resp, err := client.Client().Get(client.URL + "/value/histogram/latency")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "0.1 1\n1 3\n+Inf 4\nsum 5.05\ncount 4\n", string(data))
+
+	indexResp, err := client.Client().Get(client.URL + "/")
+	require.NoError(t, err)
+	defer indexResp.Body.Close()
+	require.Equal(t, http.StatusOK, indexResp.StatusCode)
+	page, err := io.ReadAll(indexResp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(page), "<strong>latency:</strong> count 4, sum 5.05")
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository()
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	updates := []string{
+		`[{"id":"Alloc","type":"gauge","value":1,"labels":{"host":"a"}},{"id":"Alloc","type":"gauge","value":2,"labels":{"host":"b"}}]`,
+		`[{"id":"PollCount","type":"counter","delta":1,"labels":{"host":"a"}},{"id":"PollCount","type":"counter","delta":5,"labels":{"host":"b"}}]`,
+	}
+	for _, body := range updates {
+		resp, err := client.Client().Post(client.URL+"/updates/", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err := client.Client().Post(client.URL+"/update/", "application/json", strings.NewReader(`{"id":"Alloc","type":"gauge","value":1,"labels":{"bad-name":"a"}}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+		response string
+	}{
+		{name: "gauge host a", url: "/value/gauge/Alloc?host=a", wantCode: http.StatusOK, response: "1"},
+		{name: "gauge host b", url: "/value/gauge/Alloc?host=b", wantCode: http.StatusOK, response: "2"},
+		{name: "counter host b", url: "/value/counter/PollCount?host=b", wantCode: http.StatusOK, response: "5"},
+		{name: "unlabeled series", url: "/value/gauge/Alloc", wantCode: http.StatusNotFound, response: ""},
+		{name: "prometheus filter", url: "/metrics?host=b", wantCode: http.StatusOK, response: "# TYPE Alloc gauge\nAlloc{host=\"b\"} 2\n# TYPE PollCount counter\nPollCount{host=\"b\"} 5\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Client().Get(client.URL + test.url)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, test.wantCode, resp.StatusCode)
+
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.response, string(data))
+		})
+	}
+
+	resp, err = client.Client().Post(client.URL+"/value/", "application/json", strings.NewReader(`{"id":"PollCount","type":"counter","labels":{"host":"a"}}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":1,"labels":{"host":"a"}}`, string(data))
+}
+
+func TestQueryRange(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository(inmemory.WithHistory())
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	value := 42.0
+	_, err := metricsUseCase.UpdateMetric(context.TODO(), &repository.Metric{
+		ID: "HeapAlloc", MType: repository.GaugeMetricKey, Value: &value, Labels: repository.Labels{"host": "a"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+	}{
+		{name: "missing id", url: "/api/v1/query_range?type=gauge", wantCode: http.StatusBadRequest},
+		{name: "bad step", url: "/api/v1/query_range?id=HeapAlloc&type=gauge&step=abc", wantCode: http.StatusBadRequest},
+		{name: "unsupported type", url: "/api/v1/query_range?id=HeapAlloc&type=histogram", wantCode: http.StatusBadRequest},
+		{name: "valid query", url: "/api/v1/query_range?id=HeapAlloc&type=gauge&host=a&step=1s&from=" +
+			strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10), wantCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Client().Get(client.URL + test.url)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.wantCode, resp.StatusCode)
+		})
+	}
+
+	resp, err := client.Client().Get(client.URL + "/api/v1/query_range?id=HeapAlloc&type=gauge&host=a&step=1s")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var body struct {
+		Samples []repository.Sample `json:"samples"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.NotEmpty(t, body.Samples)
+	assert.Equal(t, value, body.Samples[len(body.Samples)-1].Value)
+}
+
+func TestAlerts(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository()
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+
+	value := 95.0
+	_, err := metricsUseCase.UpdateMetric(context.TODO(), &repository.Metric{
+		ID: "CPUutilization1", MType: repository.GaugeMetricKey, Value: &value,
+	})
+	require.NoError(t, err)
+
+	rule, err := alerting.ParseRule("HighCPU: gauge CPUutilization1 > 90")
+	require.NoError(t, err)
+	manager := alerting.NewManager([]alerting.Rule{rule}, metricsUseCase, time.Second)
+	manager.Evaluate(context.TODO(), time.Now())
+
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo, handlers.WithAlerts(manager))
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	resp, err := client.Client().Get(client.URL + "/api/v1/alerts")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body struct {
+		Alerts []alerting.Alert `json:"alerts"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Alerts, 1)
+	assert.Equal(t, "HighCPU", body.Alerts[0].Name)
+	assert.Equal(t, alerting.StateFiring, body.Alerts[0].State)
+}
+
+type fileSnapshotter struct {
+	storage *filestorage.FileStorage
+	repo    repository.Repository
+}
+
+func (s fileSnapshotter) Snapshot() (handlers.Snapshot, error) {
+	backup, err := s.storage.Snapshot(s.repo)
+	return handlers.Snapshot{Path: backup.Path, Time: backup.Time}, err
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository()
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+
+	storage, err := filestorage.NewFileStorage(filepath.Join(t.TempDir(), "metrics.json"), filestorage.WithBackups(2, 0))
+	require.NoError(t, err)
+	defer storage.Close()
+	snapshots := handlers.WithSnapshots(fileSnapshotter{storage: storage, repo: repo})
+
+	post := func(serv *Server, token string) *http.Response {
+		client := httptest.NewServer(serv.Router)
+		defer client.Close()
+		request, err := http.NewRequest(http.MethodPost, client.URL+"/api/v1/admin/snapshot", nil)
+		require.NoError(t, err)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Client().Do(request)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// без admin-token административные эндпоинты выключены
+	assert.Equal(t, http.StatusNotFound, post(NewServer(metricsUseCase, cfg, repo.PingRepo, snapshots), "").StatusCode)
+
+	// без файлового хранилища снимок сделать нельзя
+	cfg.AdminToken = "admin"
+	assert.Equal(t, http.StatusNotFound, post(NewServer(metricsUseCase, cfg, repo.PingRepo), "admin").StatusCode)
+
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo, snapshots)
+	assert.Equal(t, http.StatusUnauthorized, post(serv, "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, post(serv, "wrong").StatusCode)
+
+	resp := post(serv, "admin")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var snapshot handlers.Snapshot
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&snapshot))
+	backups, err := storage.Backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, backups[0].Path, snapshot.Path)
+
+	// частые снимки вытеснили бы прежние копии из ротации
+	resp = post(serv, "admin")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	backups, err = storage.Backups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 1)
+}
+
+func TestInfluxWrite(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository()
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{name: "valid points", body: "cpu,host=a usage_idle=97.5\nnet,host=a bytes_recv=10i\nnet,host=a bytes_recv=5i", wantCode: http.StatusNoContent},
+		{name: "invalid line", body: "cpu usage_idle", wantCode: http.StatusBadRequest},
+		{name: "NaN value", body: "cpu usage_idle=NaN", wantCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Client().Post(client.URL+"/api/v2/write", "text/plain", strings.NewReader(test.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.wantCode, resp.StatusCode)
+		})
+	}
+
+	// Telegraf сжимает тело gzip и не присылает Accept
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("net,host=a bytes_recv=5i"))
+	require.NoError(t, gz.Close())
+	request, err := http.NewRequest(http.MethodPost, client.URL+"/api/v2/write", &compressed)
+	require.NoError(t, err)
+	request.Header.Set("Content-Encoding", "gzip")
+	resp, err := client.Client().Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	counter, err := metricsUseCase.GetMetricWithLabels(context.TODO(), repository.CounterMetricKey, "net_bytes_recv", repository.Labels{"host": "a"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), counter.GetDelta())
+
+	gauge, err := metricsUseCase.GetMetricWithLabels(context.TODO(), repository.GaugeMetricKey, "cpu_usage_idle", repository.Labels{"host": "a"})
+	require.NoError(t, err)
+	assert.Equal(t, 97.5, gauge.GetValue())
+}
+
+func TestEncryptedBatch(t *testing.T) {
+	logger.Initialize("info")
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	repo := inmemory.NewInMemoryRepository()
+	serverCfg := configServer.NewServerConfig()
+	serverCfg.RSAKeys.Replace(privateKey)
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, serverCfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	agentCfg := configAgent.NewAgentConfig()
+	agentCfg.EndPointAdress = strings.TrimPrefix(client.URL, "http://")
+	agentCfg.RSAKey = &privateKey.PublicKey
+	agentSender := sender.NewAgentSender(nil, agentCfg)
+
+	// батч заметно больше, чем можно зашифровать одним RSA блоком
+	batch := make([]repository.Metric, 0, 200)
+	for i := 0; i < 200; i++ {
+		value := float64(i)
+		batch = append(batch, repository.Metric{ID: "Gauge" + strconv.Itoa(i), MType: repository.GaugeMetricKey, Value: &value})
+	}
+	require.NoError(t, agentSender.SendBatch(batch))
+
+	saved, err := metricsUseCase.GetMetric(context.TODO(), repository.GaugeMetricKey, "Gauge199")
+	require.NoError(t, err)
+	assert.Equal(t, 199.0, saved.GetValue())
+
+	tests := []struct {
+		name     string
+		body     []byte
+		wantCode int
+	}{
+		{name: "tampered body", body: []byte("MENV\x01garbage"), wantCode: http.StatusBadRequest},
+		{name: "unknown version", body: []byte("MENV\x09garbage"), wantCode: http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Client().Post(client.URL+"/updates", envelope.WrapContentType("application/json"), bytes.NewReader(test.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.wantCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestSignedReplay(t *testing.T) {
+	logger.Initialize("info")
+	const hashKey = "secret"
+
+	repo := inmemory.NewInMemoryRepository()
+	serverCfg := configServer.NewServerConfig()
+	serverCfg.HashKey = hashKey
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, serverCfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	body := []byte(`{"id":"Replayed","type":"counter","delta":5}`)
+	post := func(headers map[string]string) int {
+		return postSigned(t, client, "/update", body, headers)
+	}
+	sign := func(now time.Time) map[string]string {
+		return hashsign.RequestHeaders(hashKey, hashsign.HTTPBody(http.MethodPost, "/update", body), now)
+	}
+
+	signed := sign(time.Now())
+	assert.Equal(t, http.StatusOK, post(signed))
+	assert.Equal(t, http.StatusBadRequest, post(signed), "replayed nonce")
+
+	stale := sign(time.Now().Add(-2 * serverCfg.HashMaxSkew))
+	assert.Equal(t, http.StatusBadRequest, post(stale), "timestamp outside of skew window")
+
+	forged := sign(time.Now())
+	forged[hashsign.TimestampHeaderKey] = strconv.FormatInt(time.Now().Unix()+1, 10)
+	assert.Equal(t, http.StatusBadRequest, post(forged), "timestamp is covered by signature")
+
+	legacy := hashsign.RequestHeaders(hashKey, body, time.Now())
+	assert.Equal(t, http.StatusBadRequest, post(legacy), "method and path are covered by signature")
+
+	rewritten := hashsign.RequestHeaders(hashKey, hashsign.HTTPBody(http.MethodPost, "/update/counter/Replayed/5", nil), time.Now())
+	assert.Equal(t, http.StatusBadRequest, postSigned(t, client, "/update/counter/Replayed/500", nil, rewritten), "rewritten path")
+
+	counter, err := metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "Replayed")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), counter.GetDelta())
+
+	agentCfg := configAgent.NewAgentConfig()
+	agentCfg.EndPointAdress = strings.TrimPrefix(client.URL, "http://")
+	agentCfg.HashKey = hashKey
+	agentSender := sender.NewAgentSender(nil, agentCfg)
+	delta := int64(1)
+	require.NoError(t, agentSender.SendBatch([]repository.Metric{{ID: "Replayed", MType: repository.CounterMetricKey, Delta: &delta}}))
+	require.NoError(t, agentSender.SendBatch([]repository.Metric{{ID: "Replayed", MType: repository.CounterMetricKey, Delta: &delta}}))
+
+	counter, err = metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "Replayed")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), counter.GetDelta())
+}
+
+func postSigned(t *testing.T, client *httptest.Server, path string, body []byte, headers map[string]string) int {
+	request, err := http.NewRequest(http.MethodPost, client.URL+path, bytes.NewReader(body))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	resp, err := client.Client().Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSignedRetry(t *testing.T) {
+	logger.Initialize("info")
+	const hashKey = "secret"
+
+	// первая попытка падает с 5xx, ретрай должен уйти с новым nonce и пройти проверку повтора
+	repo := inmemory.NewInMemoryRepository()
+	serverCfg := configServer.NewServerConfig()
+	serverCfg.HashKey = hashKey
+	serv := NewServer(metrics.NewMetricUseCase(repo), serverCfg, repo.PingRepo)
+	nonces := make([]string, 0)
+	client := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, r.Header.Get(hashsign.NonceHeaderKey))
+		if len(nonces) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		serv.Router.ServeHTTP(w, r)
+	}))
+	defer client.Close()
+
+	agentCfg := configAgent.NewAgentConfig()
+	agentCfg.EndPointAdress = strings.TrimPrefix(client.URL, "http://")
+	agentCfg.HashKey = hashKey
+	agentSender := sender.NewAgentSender(nil, agentCfg)
+	delta := int64(1)
+	require.NoError(t, agentSender.SendBatch([]repository.Metric{{ID: "Retried", MType: repository.CounterMetricKey, Delta: &delta}}))
+
+	require.Len(t, nonces, 2)
+	assert.NotEqual(t, nonces[0], nonces[1])
+}
+
+func TestHashSignature(t *testing.T) {
+	logger.Initialize("info")
+	const hashKey = "secret"
+
+	body := []byte(`{"id":"Signed","type":"counter","delta":5}`)
+	tests := []struct {
+		name      string
+		strict    bool
+		legacy    bool
+		method    string
+		path      string
+		signature string
+		wantCode  int
+		wantDelta int64
+	}{
+		{name: "valid signature", legacy: true, method: http.MethodPost, path: "/update", signature: hashsign.Sign(hashKey, body), wantCode: http.StatusOK, wantDelta: 5},
+		{name: "tampered body", legacy: true, method: http.MethodPost, path: "/update", signature: hashsign.Sign(hashKey, []byte(`{"id":"Signed","type":"counter","delta":1}`)), wantCode: http.StatusBadRequest},
+		{name: "signed by other key", legacy: true, method: http.MethodPost, path: "/update", signature: hashsign.Sign("other", body), wantCode: http.StatusBadRequest},
+		{name: "broken signature", legacy: true, method: http.MethodPost, path: "/update", signature: "not hex", wantCode: http.StatusBadRequest},
+		{name: "legacy signature without compatibility", method: http.MethodPost, path: "/update", signature: hashsign.Sign(hashKey, body), wantCode: http.StatusBadRequest},
+		{name: "legacy signature in strict mode", strict: true, legacy: true, method: http.MethodPost, path: "/update", signature: hashsign.Sign(hashKey, body), wantCode: http.StatusBadRequest},
+		{name: "missing signature", method: http.MethodPost, path: "/update", wantCode: http.StatusOK, wantDelta: 5},
+		{name: "missing signature in strict mode", strict: true, method: http.MethodPost, path: "/update", wantCode: http.StatusBadRequest},
+		{name: "unsigned get in strict mode", strict: true, method: http.MethodGet, path: "/", wantCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := inmemory.NewInMemoryRepository()
+			cfg := configServer.NewServerConfig()
+			cfg.HashKey = hashKey
+			cfg.HashStrict = test.strict
+			cfg.HashLegacy = test.legacy
+			metricsUseCase := metrics.NewMetricUseCase(repo)
+			serv := NewServer(metricsUseCase, cfg, repo.PingRepo)
+			client := httptest.NewServer(serv.Router)
+			defer client.Close()
+
+			var requestBody io.Reader
+			if test.method == http.MethodPost {
+				requestBody = bytes.NewReader(body)
+			}
+			request, err := http.NewRequest(test.method, client.URL+test.path, requestBody)
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", "application/json")
+			if test.signature != "" {
+				request.Header.Set(hashsign.HeaderKey, test.signature)
+			}
+
+			resp, err := client.Client().Do(request)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.wantCode, resp.StatusCode)
+
+			if resp.StatusCode == http.StatusOK {
+				respBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.True(t, hashsign.Verify(hashKey, respBody, resp.Header.Get(hashsign.HeaderKey)), "response must be signed")
+			}
+
+			if test.method != http.MethodPost {
+				return
+			}
+			counter, err := metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "Signed")
+			if test.wantDelta == 0 {
+				assert.Error(t, err, "rejected request must not reach handler")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.wantDelta, counter.GetDelta())
+		})
+	}
+}
+
+func TestResponseSignature(t *testing.T) {
+	logger.Initialize("info")
+	const hashKey = "secret"
+
+	responseSignature := ""
+	client := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hashsign.HeaderKey, responseSignature)
+		w.Write([]byte("{}"))
+	}))
+	defer client.Close()
+
+	agentCfg := configAgent.NewAgentConfig()
+	agentCfg.EndPointAdress = strings.TrimPrefix(client.URL, "http://")
+	agentCfg.HashKey = hashKey
+	agentSender := sender.NewAgentSender(nil, agentCfg)
+	delta := int64(1)
+	batch := []repository.Metric{{ID: "Signed", MType: repository.CounterMetricKey, Delta: &delta}}
+
+	assert.ErrorIs(t, agentSender.SendBatch(batch), sender.ErrInvalidResponseSignature)
+
+	responseSignature = hashsign.Sign("other", []byte("{}"))
+	assert.ErrorIs(t, agentSender.SendBatch(batch), sender.ErrInvalidResponseSignature)
+
+	responseSignature = hashsign.Sign(hashKey, []byte("{}"))
+	assert.NoError(t, agentSender.SendBatch(batch))
+}
+
+func TestIdempotentBatch(t *testing.T) {
+	logger.Initialize("info")
+	repo := inmemory.NewInMemoryRepository()
+	cfg := configServer.NewServerConfig()
+	metricsUseCase := metrics.NewMetricUseCase(repo)
+	serv := NewServer(metricsUseCase, cfg, repo.PingRepo)
+	client := httptest.NewServer(serv.Router)
+	defer client.Close()
+
+	post := func(key string) []byte {
+		request, err := http.NewRequest(http.MethodPost, client.URL+"/updates", strings.NewReader(`[{"id":"PollCount","type":"counter","delta":3}]`))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set(handlers.IdempotencyKeyHeader, key)
+		resp, err := client.Client().Do(request)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return body
+	}
+
+	first := post("batch-1")
+	assert.Equal(t, first, post("batch-1"), "retry returns the original result")
+
+	counter, err := metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), counter.GetDelta())
+
+	post("batch-2")
+	counter, err = metricsUseCase.GetMetric(context.TODO(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), counter.GetDelta())
+}
@@ -0,0 +1,97 @@
+// Пакет statsd принимает метрики в формате StatsD по UDP и записывает их в репозиторий.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/whynullname/go-collect-metrics/internal/promtext"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// Типы метрик StatsD.
+const (
+	TypeCounter   = "c"
+	TypeGauge     = "g"
+	TypeTimer     = "ms"
+	TypeHistogram = "h"
+)
+
+var ErrInvalidLine = errors.New("invalid statsd line")
+
+// Sample одно значение из строки StatsD.
+type Sample struct {
+	Name       string
+	Type       string
+	Value      float64
+	SampleRate float64
+	// Relative для gauge означает, что значение со знаком нужно прибавить к текущему.
+	Relative bool
+	Labels   repository.Labels
+}
+
+// ParseLine разбирает строку вида name:value|type[|@rate][|#tag:value,...].
+// Теги в формате DogStatsD становятся метками метрики.
+func ParseLine(line string) (Sample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Sample{}, fmt.Errorf("%w: %q: missing name", ErrInvalidLine, line)
+	}
+
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return Sample{}, fmt.Errorf("%w: %q: missing type", ErrInvalidLine, line)
+	}
+
+	sample := Sample{Name: name, Type: parts[1], SampleRate: 1}
+	switch sample.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHistogram:
+	default:
+		return Sample{}, fmt.Errorf("%w: %q: unsupported type %q", ErrInvalidLine, line, sample.Type)
+	}
+
+	rawValue := parts[0]
+	if sample.Type == TypeGauge && (strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-")) {
+		sample.Relative = true
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return Sample{}, fmt.Errorf("%w: %q: bad value: %v", ErrInvalidLine, line, err)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Sample{}, fmt.Errorf("%w: %q: value is not finite", ErrInvalidLine, line)
+	}
+	sample.Value = value
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Sample{}, fmt.Errorf("%w: %q: bad sample rate %q", ErrInvalidLine, line, part)
+			}
+			sample.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			sample.Labels = parseTags(part[1:])
+		}
+	}
+
+	return sample, nil
+}
+
+// parseTags приводит имена тегов к допустимым именам меток, чтобы одна строка с тегом вроде k8s.pod
+// не ломала запись всего батча.
+func parseTags(value string) repository.Labels {
+	labels := make(repository.Labels)
+	for _, tag := range strings.Split(value, ",") {
+		name, tagValue, ok := strings.Cut(tag, ":")
+		if !ok || name == "" {
+			continue
+		}
+		labels[promtext.SanitizeLabelName(name)] = tagValue
+	}
+	return labels.Normalize()
+}
@@ -0,0 +1,276 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
+)
+
+// maxPacketSize максимальный размер UDP пакета.
+const maxPacketSize = 65535
+
+// MetricsUpdater куда записываются агрегированные метрики.
+type MetricsUpdater interface {
+	UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error)
+	GetMetricWithLabels(ctx context.Context, metricType string, metricName string, labels repository.Labels) (*repository.Metric, error)
+}
+
+type series struct {
+	name   string
+	labels repository.Labels
+}
+
+type counterState struct {
+	series
+	value float64
+}
+
+type gaugeState struct {
+	series
+	value    float64
+	absolute bool
+}
+
+// maxTimerWeight ограничивает число наблюдений, которыми учитывается одно значение timer с sample rate.
+const maxTimerWeight = 1000
+
+type timerState struct {
+	series
+	values  []float64
+	weights []uint64
+}
+
+// Receiver принимает пакеты StatsD и раз в flushInterval записывает накопленные значения.
+//
+// Counter суммируются с учетом sample rate и записываются как counter.
+// Для gauge записывается последнее значение, относительные изменения (+N, -N) прибавляются к нему.
+// Timer и histogram записываются как гистограмма, значения timer переводятся из миллисекунд в секунды.
+type Receiver struct {
+	updater       MetricsUpdater
+	address       string
+	flushInterval time.Duration
+	buckets       []float64
+
+	mx       sync.Mutex
+	counters map[string]*counterState
+	gauges   map[string]*gaugeState
+	timers   map[string]*timerState
+}
+
+// Option настраивает Receiver.
+type Option func(*Receiver)
+
+// WithHistogramBuckets задает границы бакетов для новых гистограмм из timer.
+func WithHistogramBuckets(buckets []float64) Option {
+	return func(r *Receiver) {
+		r.buckets = buckets
+	}
+}
+
+func NewReceiver(updater MetricsUpdater, address string, flushInterval time.Duration, opts ...Option) *Receiver {
+	receiver := &Receiver{
+		updater:       updater,
+		address:       address,
+		flushInterval: flushInterval,
+		buckets:       repository.DefaultHistogramBuckets,
+		counters:      make(map[string]*counterState),
+		gauges:        make(map[string]*gaugeState),
+		timers:        make(map[string]*timerState),
+	}
+	for _, opt := range opts {
+		opt(receiver)
+	}
+	return receiver
+}
+
+// ListenAndServe открывает UDP сокет и принимает пакеты до завершения ctx.
+// Перед выходом записывает все накопленные значения.
+func (r *Receiver) ListenAndServe(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", r.address)
+	if err != nil {
+		return err
+	}
+	return r.Serve(ctx, conn)
+}
+
+// Serve принимает пакеты на уже открытом соединении.
+func (r *Receiver) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	flushDone := make(chan struct{})
+	go func() {
+		defer close(flushDone)
+		r.runFlush(ctx)
+	}()
+
+	buff := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buff)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				<-flushDone
+				return nil
+			}
+			logger.Log.Errorf("Error while read statsd packet: %v", err)
+			continue
+		}
+		r.HandlePacket(buff[:n])
+	}
+}
+
+func (r *Receiver) runFlush(ctx context.Context) {
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.Flush(context.Background())
+			return
+		case <-ticker.C:
+			r.Flush(ctx)
+		}
+	}
+}
+
+// HandlePacket разбирает пакет, в котором строки StatsD разделены переводом строки.
+func (r *Receiver) HandlePacket(packet []byte) {
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		sample, err := ParseLine(line)
+		if err != nil {
+			logger.Log.Infof("Skip statsd line: %v", err)
+			continue
+		}
+		r.add(sample)
+	}
+}
+
+func (r *Receiver) add(sample Sample) {
+	key := repository.SeriesKey(sample.Name, sample.Labels)
+	current := series{name: sample.Name, labels: sample.Labels}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	switch sample.Type {
+	case TypeCounter:
+		state, ok := r.counters[key]
+		if !ok {
+			state = &counterState{series: current}
+			r.counters[key] = state
+		}
+		state.value += sample.Value / sample.SampleRate
+	case TypeGauge:
+		state, ok := r.gauges[key]
+		if !ok {
+			state = &gaugeState{series: current}
+			r.gauges[key] = state
+		}
+		if sample.Relative {
+			state.value += sample.Value
+		} else {
+			state.value = sample.Value
+			state.absolute = true
+		}
+	case TypeTimer, TypeHistogram:
+		state, ok := r.timers[key]
+		if !ok {
+			state = &timerState{series: current}
+			r.timers[key] = state
+		}
+		value := sample.Value
+		if sample.Type == TypeTimer {
+			value /= 1000
+		}
+		state.values = append(state.values, value)
+		state.weights = append(state.weights, uint64(min(math.Round(1/sample.SampleRate), maxTimerWeight)))
+	}
+}
+
+// Flush записывает накопленные за интервал значения одним вызовом UpdateMetrics.
+func (r *Receiver) Flush(ctx context.Context) {
+	r.mx.Lock()
+	counters, gauges, timers := r.counters, r.gauges, r.timers
+	r.counters = make(map[string]*counterState)
+	r.gauges = make(map[string]*gaugeState)
+	r.timers = make(map[string]*timerState)
+	r.mx.Unlock()
+
+	output := make([]repository.Metric, 0, len(counters)+len(gauges)+len(timers))
+	for _, state := range counters {
+		value := math.Round(state.value)
+		if math.Abs(value) >= math.MaxInt64 {
+			logger.Log.Infof("Skip statsd counter %s: value %g overflows int64", state.name, value)
+			continue
+		}
+		delta := int64(value)
+		if delta == 0 {
+			continue
+		}
+		output = append(output, repository.Metric{ID: state.name, MType: repository.CounterMetricKey, Delta: &delta, Labels: state.labels})
+	}
+
+	for _, state := range gauges {
+		value := state.value
+		if !state.absolute {
+			value += r.savedGauge(ctx, state.series)
+		}
+		output = append(output, repository.Metric{ID: state.name, MType: repository.GaugeMetricKey, Value: &value, Labels: state.labels})
+	}
+
+	for _, state := range timers {
+		histogram := repository.NewHistogram(state.name, r.histogramBuckets(ctx, state.series))
+		histogram.Labels = state.labels
+		for i, value := range state.values {
+			for range state.weights[i] {
+				histogram.Observe(value)
+			}
+		}
+		output = append(output, *histogram)
+	}
+
+	if len(output) == 0 {
+		return
+	}
+
+	if _, err := r.updater.UpdateMetrics(ctx, output); err != nil {
+		logger.Log.Errorf("Error while flush statsd metrics: %v", err)
+	}
+}
+
+// savedGauge возвращает текущее значение gauge из репозитория, 0 если его еще нет.
+func (r *Receiver) savedGauge(ctx context.Context, s series) float64 {
+	metric, err := r.updater.GetMetricWithLabels(ctx, repository.GaugeMetricKey, s.name, s.labels)
+	if err != nil {
+		if !errors.Is(err, types.ErrCantFindMetric) {
+			logger.Log.Errorf("Error while get gauge %s: %v", s.name, err)
+		}
+		return 0
+	}
+	return metric.GetValue()
+}
+
+// histogramBuckets возвращает границы бакетов уже сохраненной гистограммы или границы по умолчанию.
+func (r *Receiver) histogramBuckets(ctx context.Context, s series) []float64 {
+	metric, err := r.updater.GetMetricWithLabels(ctx, repository.HistogramMetricKey, s.name, s.labels)
+	if err != nil {
+		return r.buckets
+	}
+	return metric.Buckets
+}
@@ -0,0 +1,133 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+	"github.com/whynullname/go-collect-metrics/internal/usecase/metrics"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Sample
+		wantErr bool
+	}{
+		{name: "counter", line: "requests:1|c", want: Sample{Name: "requests", Type: TypeCounter, Value: 1, SampleRate: 1}},
+		{name: "counter with rate", line: "requests:1|c|@0.1", want: Sample{Name: "requests", Type: TypeCounter, Value: 1, SampleRate: 0.1}},
+		{name: "gauge", line: "CPUutilization1:42|g", want: Sample{Name: "CPUutilization1", Type: TypeGauge, Value: 42, SampleRate: 1}},
+		{name: "relative gauge", line: "queue:-3|g", want: Sample{Name: "queue", Type: TypeGauge, Value: -3, SampleRate: 1, Relative: true}},
+		{name: "timer with tags", line: "latency:12|ms|#host:a,env:prod", want: Sample{Name: "latency", Type: TypeTimer,
+			Value: 12, SampleRate: 1, Labels: repository.Labels{"host": "a", "env": "prod"}}},
+		{name: "invalid tag names", line: "latency:12|ms|#k8s.pod:a,my-tag:b", want: Sample{Name: "latency", Type: TypeTimer,
+			Value: 12, SampleRate: 1, Labels: repository.Labels{"k8s_pod": "a", "my_tag": "b"}}},
+		{name: "missing type", line: "requests:1", wantErr: true},
+		{name: "nan value", line: "requests:NaN|c", wantErr: true},
+		{name: "inf value", line: "latency:+Inf|ms", wantErr: true},
+		{name: "unsupported type", line: "users:1|s", wantErr: true},
+		{name: "bad value", line: "requests:abc|c", wantErr: true},
+		{name: "bad rate", line: "requests:1|c|@2", wantErr: true},
+		{name: "missing name", line: ":1|c", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sample, err := ParseLine(test.line)
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, sample)
+		})
+	}
+}
+
+func TestReceiverFlush(t *testing.T) {
+	logger.Initialize("info")
+	metricsUseCase := metrics.NewMetricUseCase(inmemory.NewInMemoryRepository())
+	receiver := NewReceiver(metricsUseCase, "", time.Minute)
+	ctx := context.TODO()
+
+	receiver.HandlePacket([]byte("requests:1|c\nrequests:1|c|@0.5\nqueue:10|g\nqueue:+5|g\nlatency:20|ms|@0.5\nbroken\n"))
+	receiver.Flush(ctx)
+
+	counter, err := metricsUseCase.GetMetric(ctx, repository.CounterMetricKey, "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), counter.GetDelta())
+
+	gauge, err := metricsUseCase.GetMetric(ctx, repository.GaugeMetricKey, "queue")
+	require.NoError(t, err)
+	assert.Equal(t, 15.0, gauge.GetValue())
+
+	histogram, err := metricsUseCase.GetMetric(ctx, repository.HistogramMetricKey, "latency")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), histogram.GetCount())
+	assert.InDelta(t, 0.04, histogram.GetSum(), 1e-9)
+
+	// относительное изменение без абсолютного значения применяется к сохраненному gauge
+	receiver.HandlePacket([]byte("queue:-7|g\nrequests:2|c"))
+	receiver.Flush(ctx)
+
+	gauge, err = metricsUseCase.GetMetric(ctx, repository.GaugeMetricKey, "queue")
+	require.NoError(t, err)
+	assert.Equal(t, 8.0, gauge.GetValue())
+
+	counter, err = metricsUseCase.GetMetric(ctx, repository.CounterMetricKey, "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), counter.GetDelta())
+
+	// вес одного значения timer ограничен, а counter за пределами int64 пропускается
+	receiver.HandlePacket([]byte("slow:20|ms|@0.000001\nhuge:1e300|c"))
+	receiver.Flush(ctx)
+
+	histogram, err = metricsUseCase.GetMetric(ctx, repository.HistogramMetricKey, "slow")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(maxTimerWeight), histogram.GetCount())
+
+	_, err = metricsUseCase.GetMetric(ctx, repository.CounterMetricKey, "huge")
+	assert.Error(t, err)
+}
+
+func TestReceiverUDP(t *testing.T) {
+	logger.Initialize("info")
+	metricsUseCase := metrics.NewMetricUseCase(inmemory.NewInMemoryRepository())
+	receiver := NewReceiver(metricsUseCase, "", time.Hour)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- receiver.Serve(ctx, conn)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("CPUutilization1:42|g|#host:a"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		receiver.mx.Lock()
+		defer receiver.mx.Unlock()
+		return len(receiver.gauges) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// при остановке накопленные значения записываются
+	cancel()
+	require.NoError(t, <-done)
+
+	gauge, err := metricsUseCase.GetMetricWithLabels(context.TODO(), repository.GaugeMetricKey, "CPUutilization1", repository.Labels{"host": "a"})
+	require.NoError(t, err)
+	assert.Equal(t, 42.0, gauge.GetValue())
+}
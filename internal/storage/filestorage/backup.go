@@ -0,0 +1,247 @@
+package filestorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// Копии снимков хранятся рядом со снимком в файлах <snapshot>.backup.<время снимка в UTC>.
+// Копия - жесткая ссылка на только что записанный снимок: следующий снимок заменяет файл переименованием,
+// и копия сохраняет старое содержимое без лишней записи на диск. Формат и шифрование у копии те же, что у снимка.
+const (
+	backupExt    = ".backup."
+	backupLayout = "20060102T150405.000000000Z"
+	// preRestoreExt файлы с состоянием перед RestoreFrom. Они не входят в Backups и не удаляются ротацией.
+	preRestoreExt = ".pre-restore."
+)
+
+var (
+	ErrBackupNotFound = errors.New("snapshot backup not found")
+	ErrRepoNotEmpty   = errors.New("repository is not empty")
+)
+
+// Backup копия снимка.
+type Backup struct {
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+// WithBackups сохраняет копию каждого снимка и удаляет копии сверх count самых новых и старше maxAge.
+// Нулевое значение снимает соответствующее ограничение, самая новая копия не удаляется никогда.
+func WithBackups(count int, maxAge time.Duration) Option {
+	return func(s *FileStorage) {
+		s.backupCount = count
+		s.backupMaxAge = maxAge
+	}
+}
+
+func (s *FileStorage) backupsEnabled() bool {
+	return s.backupCount > 0 || s.backupMaxAge > 0
+}
+
+func backupPath(path string, at time.Time) string {
+	return path + backupExt + at.UTC().Format(backupLayout)
+}
+
+// Backups возвращает копии снимков от старых к новым.
+func (s *FileStorage) Backups() ([]Backup, error) {
+	entries, err := os.ReadDir(filepath.Dir(s.path))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(s.path) + backupExt
+	backups := make([]Backup, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		at, err := time.Parse(backupLayout, strings.TrimPrefix(name, prefix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{Path: filepath.Join(filepath.Dir(s.path), name), Time: at})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// backup сохраняет копию только что записанного снимка и применяет ограничения на число и возраст копий.
+// Вызывается под s.snapshotMx.
+func (s *FileStorage) backup(at time.Time) (Backup, error) {
+	backup := Backup{Path: backupPath(s.path, at), Time: at.UTC()}
+	if err := os.Link(s.path, backup.Path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return backup, nil
+		}
+		// файловая система без жестких ссылок
+		if err := copyFile(s.path, backup.Path); err != nil {
+			return Backup{}, err
+		}
+	}
+	if err := syncDir(s.path); err != nil {
+		return Backup{}, err
+	}
+
+	if err := s.pruneBackups(at); err != nil {
+		logger.Log.Errorf("Can't remove old snapshot backups: %v", err)
+	}
+	return backup, nil
+}
+
+func (s *FileStorage) pruneBackups(now time.Time) error {
+	backups, err := s.Backups()
+	if err != nil {
+		return err
+	}
+
+	for i, backup := range backups {
+		newest := len(backups) - 1 - i
+		if newest == 0 {
+			break
+		}
+		overCount := s.backupCount > 0 && newest >= s.backupCount
+		tooOld := s.backupMaxAge > 0 && now.Sub(backup.Time) > s.backupMaxAge
+		if !overCount && !tooOld {
+			continue
+		}
+		if err := os.Remove(backup.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+	}
+	return err
+}
+
+// FindBackup ищет снимок по point: путь к файлу снимка, имя копии или время в RFC3339.
+// Для времени выбирается последняя копия, сделанная не позже него.
+func (s *FileStorage) FindBackup(point string) (Backup, error) {
+	if info, err := os.Stat(point); err == nil && !info.IsDir() {
+		return Backup{Path: point, Time: info.ModTime()}, nil
+	}
+
+	backups, err := s.Backups()
+	if err != nil {
+		return Backup{}, err
+	}
+	for _, backup := range backups {
+		if filepath.Base(backup.Path) == point || strings.TrimPrefix(filepath.Base(backup.Path), filepath.Base(s.path)+backupExt) == point {
+			return backup, nil
+		}
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, point)
+	if err != nil {
+		return Backup{}, fmt.Errorf("%w: %q", ErrBackupNotFound, point)
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if !backups[i].Time.After(at) {
+			return backups[i], nil
+		}
+	}
+	return Backup{}, fmt.Errorf("%w: no backup before %s", ErrBackupNotFound, point)
+}
+
+// RestoreFrom восстанавливает метрики в repo из снимка point вместо последнего снимка и журнала (см. FindBackup).
+// Восстановленное состояние сразу сохраняется как текущий снимок, а журнал после последнего снимка отбрасывается,
+// поэтому следующий запуск без point начнет с того же состояния. Прежнее состояние, снимок вместе с журналом,
+// перед этим сохраняется в <snapshot>.pre-restore.<время> независимо от WithBackups, и к нему можно вернуться,
+// передав путь к этому файлу в point. Как и для ReadAllMetrics, repo должен быть исходным репозиторием без оберток.
+// Метрики снимка записываются через UpdateMetrics, поэтому counter прибавились бы к сохраненным значениям,
+// а серии, которых нет в снимке, остались бы. Для непустого repo, например базы данных, возвращается ErrRepoNotEmpty.
+func (s *FileStorage) RestoreFrom(repo repository.Repository, point string) (Backup, error) {
+	backup, err := s.FindBackup(point)
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := checkEmpty(repo); err != nil {
+		return Backup{}, err
+	}
+
+	s.mx.Lock()
+	err = s.savePreRestore()
+	if err == nil {
+		var savedMetrics []repository.Metric
+		savedMetrics, err = readSnapshot(backup.Path, s.keys, s.plaintext)
+		if err == nil && len(savedMetrics) > 0 {
+			_, err = repo.UpdateMetrics(context.TODO(), savedMetrics)
+		}
+	}
+	s.mx.Unlock()
+	if err != nil {
+		return Backup{}, err
+	}
+
+	if _, err := s.Snapshot(repo); err != nil {
+		return Backup{}, err
+	}
+	return backup, nil
+}
+
+func checkEmpty(repo repository.Repository) error {
+	for _, metricType := range repository.MetricTypes {
+		saved, err := repo.GetAllMetricsByType(context.TODO(), metricType)
+		if err != nil {
+			return err
+		}
+		if len(saved) > 0 {
+			return fmt.Errorf("%w: restore from snapshot copy needs an empty repository, found %d %s metrics", ErrRepoNotEmpty, len(saved), metricType)
+		}
+	}
+	return nil
+}
+
+// savePreRestore сохраняет текущее состояние перед RestoreFrom. Если снимка и журнала нет, сохранять нечего.
+// Вызывается под s.mx.
+func (s *FileStorage) savePreRestore() error {
+	current, err := s.readState()
+	if err != nil {
+		return fmt.Errorf("can't read current state before restore: %w", err)
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	path := s.path + preRestoreExt + time.Now().UTC().Format(backupLayout)
+	if err := s.writeFile(path, current); err != nil {
+		return fmt.Errorf("can't save current state before restore: %w", err)
+	}
+	logger.Log.Infof("Saved metrics state before restore to %s", path)
+	return nil
+}
@@ -0,0 +1,186 @@
+package filestorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+)
+
+func TestBackupsRetention(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	storage, err := NewFileStorage(path, WithBackups(3, 0))
+	require.NoError(t, err)
+	defer storage.Close()
+	repo := storage.Journal(inmemory.NewInMemoryRepository())
+
+	var last Backup
+	for i := 0; i < 5; i++ {
+		_, err := repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 1)})
+		require.NoError(t, err)
+		last, err = storage.Snapshot(repo)
+		require.NoError(t, err)
+	}
+
+	backups, err := storage.Backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 3)
+	assert.Equal(t, last, backups[2])
+
+	// каждая копия хранит снимок на момент своего создания
+	for i, backup := range backups {
+		snapshot, err := readSnapshot(backup.Path, nil, false)
+		require.NoError(t, err)
+		require.Len(t, snapshot, 1)
+		assert.Equal(t, int64(i+3), snapshot[0].GetDelta())
+	}
+
+	// по возрасту удаляются все копии, кроме самой новой
+	storage.backupCount, storage.backupMaxAge = 0, time.Hour
+	require.NoError(t, storage.pruneBackups(time.Now().Add(2*time.Hour)))
+	backups, err = storage.Backups()
+	require.NoError(t, err)
+	assert.Equal(t, []Backup{last}, backups)
+}
+
+func TestBackupsDisabled(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	backup, err := storage.Snapshot(inmemory.NewInMemoryRepository())
+	require.NoError(t, err)
+	assert.Equal(t, path, backup.Path)
+	backups, err := storage.Backups()
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+}
+
+func TestRestoreFrom(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	storage, err := NewFileStorage(path, WithBackups(10, 0))
+	require.NoError(t, err)
+	repo := storage.Journal(inmemory.NewInMemoryRepository())
+	snapshots := make([]Backup, 0)
+	for _, value := range []float64{1, 2, 3} {
+		_, err := repo.UpdateMetrics(ctx, []repository.Metric{gauge("Alloc", value)})
+		require.NoError(t, err)
+		backup, err := storage.Snapshot(repo)
+		require.NoError(t, err)
+		snapshots = append(snapshots, backup)
+	}
+	// обновление после последнего снимка есть только в журнале
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{gauge("Alloc", 4)})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	tests := []struct {
+		name  string
+		point string
+		want  float64
+	}{
+		// каждое восстановление сохраняет новый снимок, поэтому поиск по времени после всех снимков идет первым
+		{name: "time after snapshots", point: time.Now().Add(time.Hour).Format(time.RFC3339), want: 3},
+		{name: "path", point: snapshots[0].Path, want: 1},
+		{name: "name", point: filepath.Base(snapshots[1].Path), want: 2},
+		{name: "timestamp", point: snapshots[1].Time.Format(backupLayout), want: 2},
+		{name: "time between snapshots", point: snapshots[2].Time.Add(-time.Nanosecond).Format(time.RFC3339Nano), want: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage, err := NewFileStorage(path, WithBackups(10, 0))
+			require.NoError(t, err)
+			defer storage.Close()
+
+			found, err := storage.FindBackup(test.point)
+			require.NoError(t, err)
+			restored := inmemory.NewInMemoryRepository()
+			backup, err := storage.RestoreFrom(restored, test.point)
+			require.NoError(t, err)
+			assert.Equal(t, found, backup)
+			assert.Equal(t, test.want, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+		})
+	}
+
+	// последнее восстановленное состояние стало текущим снимком, журнал отброшен
+	restored := restore(t, path)
+	assert.Equal(t, 2.0, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+
+	storage, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+	_, err = storage.RestoreFrom(inmemory.NewInMemoryRepository(), "2000-01-01T00:00:00Z")
+	assert.ErrorIs(t, err, ErrBackupNotFound)
+	_, err = storage.RestoreFrom(inmemory.NewInMemoryRepository(), "yesterday")
+	assert.ErrorIs(t, err, ErrBackupNotFound)
+
+	// в непустой репозиторий снимок не восстанавливается: counter сложились бы с сохраненными значениями
+	_, err = storage.RestoreFrom(restored, snapshots[0].Path)
+	assert.ErrorIs(t, err, ErrRepoNotEmpty)
+	assert.Equal(t, 2.0, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+	_, err = os.Stat(snapshots[0].Path)
+	assert.NoError(t, err)
+}
+
+func TestRestoreFromWithoutBackups(t *testing.T) {
+	logger.Initialize("info")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.json")
+	ctx := context.Background()
+
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	repo := storage.Journal(inmemory.NewInMemoryRepository())
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{gauge("Alloc", 1)})
+	require.NoError(t, err)
+	_, err = storage.Snapshot(repo)
+	require.NoError(t, err)
+	old := filepath.Join(dir, "old.json")
+	require.NoError(t, copyFile(path, old))
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{gauge("Alloc", 2)})
+	require.NoError(t, err)
+	_, err = storage.Snapshot(repo)
+	require.NoError(t, err)
+	// обновление после последнего снимка есть только в журнале
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{gauge("Alloc", 3)})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	storage, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+	restored := inmemory.NewInMemoryRepository()
+	_, err = storage.RestoreFrom(restored, old)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+
+	// состояние до восстановления, вместе с журналом, сохранено вне ротации копий
+	saved, err := filepath.Glob(path + preRestoreExt + "*")
+	require.NoError(t, err)
+	require.Len(t, saved, 1)
+	backups, err := storage.Backups()
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+
+	restored = inmemory.NewInMemoryRepository()
+	_, err = storage.RestoreFrom(restored, saved[0])
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+}
@@ -0,0 +1,239 @@
+package filestorage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// Бинарный снимок: магическая строка с версией формата, затем метрики подряд до конца файла.
+// Метрика - байт типа, имя, число меток и пары имя-значение, затем значение:
+// float64 для gauge, varint для counter, бакеты, счетчики, сумма и число наблюдений для histogram.
+// Строки и длины массивов записываются как uvarint длины и байты, float64 - как 8 байт little endian.
+var binaryMagic = []byte("MSNAP\x01")
+
+const (
+	binaryGauge byte = iota + 1
+	binaryCounter
+	binaryHistogram
+)
+
+// maxBinaryLength ограничивает длины строк и массивов, чтобы испорченный файл не приводил к огромным аллокациям.
+const maxBinaryLength = 1 << 20
+
+// BinaryCodec компактный бинарный формат.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string {
+	return FormatBinary
+}
+
+func (BinaryCodec) Encode(w io.Writer, metrics []repository.Metric) error {
+	writer := bufio.NewWriter(w)
+	buf := append([]byte(nil), binaryMagic...)
+	for i := range metrics {
+		var err error
+		buf, err = appendBinaryMetric(buf, &metrics[i])
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+		buf = buf[:0]
+	}
+	if _, err := writer.Write(buf); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func appendBinaryMetric(buf []byte, metric *repository.Metric) ([]byte, error) {
+	switch metric.MType {
+	case repository.GaugeMetricKey:
+		buf = append(buf, binaryGauge)
+	case repository.CounterMetricKey:
+		buf = append(buf, binaryCounter)
+	case repository.HistogramMetricKey:
+		buf = append(buf, binaryHistogram)
+	default:
+		return nil, fmt.Errorf("%w: metric type %q", ErrInvalidFormat, metric.MType)
+	}
+
+	buf = appendString(buf, metric.ID)
+	names := metric.Labels.Names()
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = appendString(buf, name)
+		buf = appendString(buf, metric.Labels[name])
+	}
+
+	switch metric.MType {
+	case repository.GaugeMetricKey:
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(metric.GetValue()))
+	case repository.CounterMetricKey:
+		buf = binary.AppendVarint(buf, metric.GetDelta())
+	case repository.HistogramMetricKey:
+		buf = binary.AppendUvarint(buf, uint64(len(metric.Buckets)))
+		for _, bucket := range metric.Buckets {
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(bucket))
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(metric.Counts)))
+		for _, count := range metric.Counts {
+			buf = binary.AppendUvarint(buf, count)
+		}
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(metric.GetSum()))
+		buf = binary.AppendUvarint(buf, metric.GetCount())
+	}
+	return buf, nil
+}
+
+func appendString(buf []byte, value string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func (BinaryCodec) Decode(r io.Reader) ([]repository.Metric, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != string(binaryMagic) {
+		return nil, fmt.Errorf("%w: bad binary header", ErrInvalidFormat)
+	}
+
+	metrics := make([]repository.Metric, 0)
+	for {
+		kind, err := reader.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return metrics, nil
+			}
+			return nil, err
+		}
+
+		metric, err := readBinaryMetric(reader, kind)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("%w: %w", ErrInvalidFormat, err)
+		}
+		metrics = append(metrics, metric)
+	}
+}
+
+func readBinaryMetric(reader *bufio.Reader, kind byte) (repository.Metric, error) {
+	var metric repository.Metric
+	switch kind {
+	case binaryGauge:
+		metric.MType = repository.GaugeMetricKey
+	case binaryCounter:
+		metric.MType = repository.CounterMetricKey
+	case binaryHistogram:
+		metric.MType = repository.HistogramMetricKey
+	default:
+		return metric, fmt.Errorf("unknown metric kind %d", kind)
+	}
+
+	var err error
+	if metric.ID, err = readString(reader); err != nil {
+		return metric, err
+	}
+	labelsCount, err := readLength(reader)
+	if err != nil {
+		return metric, err
+	}
+	if labelsCount > 0 {
+		metric.Labels = make(repository.Labels, labelsCount)
+	}
+	for i := 0; i < labelsCount; i++ {
+		name, err := readString(reader)
+		if err != nil {
+			return metric, err
+		}
+		if metric.Labels[name], err = readString(reader); err != nil {
+			return metric, err
+		}
+	}
+
+	switch kind {
+	case binaryGauge:
+		value, err := readFloat(reader)
+		if err != nil {
+			return metric, err
+		}
+		metric.Value = &value
+	case binaryCounter:
+		delta, err := binary.ReadVarint(reader)
+		if err != nil {
+			return metric, err
+		}
+		metric.Delta = &delta
+	case binaryHistogram:
+		bucketsCount, err := readLength(reader)
+		if err != nil {
+			return metric, err
+		}
+		metric.Buckets = make([]float64, bucketsCount)
+		for i := range metric.Buckets {
+			if metric.Buckets[i], err = readFloat(reader); err != nil {
+				return metric, err
+			}
+		}
+		countsCount, err := readLength(reader)
+		if err != nil {
+			return metric, err
+		}
+		metric.Counts = make([]uint64, countsCount)
+		for i := range metric.Counts {
+			if metric.Counts[i], err = binary.ReadUvarint(reader); err != nil {
+				return metric, err
+			}
+		}
+		sum, err := readFloat(reader)
+		if err != nil {
+			return metric, err
+		}
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return metric, err
+		}
+		metric.Sum, metric.Count = &sum, &count
+	}
+	return metric, nil
+}
+
+func readLength(reader *bufio.Reader) (int, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, err
+	}
+	if length > maxBinaryLength {
+		return 0, fmt.Errorf("length %d is too large", length)
+	}
+	return int(length), nil
+}
+
+func readString(reader *bufio.Reader) (string, error) {
+	length, err := readLength(reader)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func readFloat(reader *bufio.Reader) (float64, error) {
+	var data [8]byte
+	if _, err := io.ReadFull(reader, data[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(data[:])), nil
+}
@@ -0,0 +1,197 @@
+package filestorage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// Codec формат файла снимка. Формат записанного снимка определяется при чтении по первым байтам,
+// поэтому смена формата в настройках не мешает прочитать старый снимок.
+type Codec interface {
+	Name() string
+	Encode(w io.Writer, metrics []repository.Metric) error
+	Decode(r io.Reader) ([]repository.Metric, error)
+}
+
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatGzip   = "gzip"
+	FormatBinary = "binary"
+)
+
+var (
+	ErrUnknownFormat  = errors.New("unknown snapshot format")
+	ErrInvalidFormat  = errors.New("invalid snapshot")
+	gzipMagic         = []byte{0x1f, 0x8b}
+	defaultCodec      = JSONCodec{}
+	maxDetectionBytes = 512
+)
+
+// CodecByName возвращает формат снимка по имени из настроек.
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case FormatJSON, "":
+		return JSONCodec{}, nil
+	case FormatNDJSON:
+		return NDJSONCodec{}, nil
+	case FormatGzip:
+		return GzipCodec{}, nil
+	case FormatBinary:
+		return BinaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+}
+
+// decodeSnapshot определяет формат снимка и читает его. Пустой снимок означает, что метрик нет.
+func decodeSnapshot(r io.Reader) ([]repository.Metric, error) {
+	reader := bufio.NewReader(r)
+	codec, err := detectCodec(reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return make([]repository.Metric, 0), nil
+		}
+		return nil, err
+	}
+	return codec.Decode(reader)
+}
+
+// detectCodec определяет формат по первым байтам, не сдвигая позицию чтения.
+func detectCodec(reader *bufio.Reader) (Codec, error) {
+	header, err := reader.Peek(len(binaryMagic))
+	if len(header) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return GzipCodec{}, nil
+	case bytes.Equal(header, binaryMagic):
+		return BinaryCodec{}, nil
+	}
+
+	// JSON и NDJSON различаются первым значимым символом: массив или объект
+	prefix, _ := reader.Peek(maxDetectionBytes)
+	trimmed := bytes.TrimLeft(prefix, " \t\r\n")
+	if len(trimmed) == 0 {
+		if len(prefix) < maxDetectionBytes {
+			return nil, io.EOF
+		}
+		return nil, ErrInvalidFormat
+	}
+	switch trimmed[0] {
+	case '[':
+		return JSONCodec{}, nil
+	case '{':
+		return NDJSONCodec{}, nil
+	}
+	return nil, ErrInvalidFormat
+}
+
+// JSONCodec один JSON массив с отступами, формат снимка по умолчанию.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return FormatJSON
+}
+
+func (JSONCodec) Encode(w io.Writer, metrics []repository.Metric) error {
+	if metrics == nil {
+		// пустой снимок пишется как [], а не null, иначе его формат не определить
+		metrics = make([]repository.Metric, 0)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&metrics)
+}
+
+func (JSONCodec) Decode(r io.Reader) ([]repository.Metric, error) {
+	metrics := make([]repository.Metric, 0)
+	err := json.NewDecoder(r).Decode(&metrics)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// NDJSONCodec по одной метрике в строке. Снимок можно читать потоком и дописывать в конец.
+type NDJSONCodec struct{}
+
+func (NDJSONCodec) Name() string {
+	return FormatNDJSON
+}
+
+func (NDJSONCodec) Encode(w io.Writer, metrics []repository.Metric) error {
+	encoder := json.NewEncoder(w)
+	for i := range metrics {
+		if err := encoder.Encode(&metrics[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (NDJSONCodec) Decode(r io.Reader) ([]repository.Metric, error) {
+	metrics := make([]repository.Metric, 0)
+	decoder := json.NewDecoder(r)
+	for {
+		var metric repository.Metric
+		if err := decoder.Decode(&metric); err != nil {
+			if errors.Is(err, io.EOF) {
+				return metrics, nil
+			}
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+}
+
+// GzipCodec сжатый gzip JSON массив. При чтении формат внутри архива тоже определяется автоматически.
+type GzipCodec struct{}
+
+func (GzipCodec) Name() string {
+	return FormatGzip
+}
+
+func (GzipCodec) Encode(w io.Writer, metrics []repository.Metric) error {
+	if metrics == nil {
+		metrics = make([]repository.Metric, 0)
+	}
+	writer := gzip.NewWriter(w)
+	if err := json.NewEncoder(writer).Encode(&metrics); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (GzipCodec) Decode(r io.Reader) ([]repository.Metric, error) {
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	inner := bufio.NewReader(reader)
+	codec, err := detectCodec(inner)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return make([]repository.Metric, 0), nil
+		}
+		return nil, err
+	}
+	if _, ok := codec.(GzipCodec); ok {
+		return nil, ErrInvalidFormat
+	}
+	return codec.Decode(inner)
+}
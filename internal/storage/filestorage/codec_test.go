@@ -0,0 +1,103 @@
+package filestorage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+)
+
+func snapshotMetrics() []repository.Metric {
+	labeled := counter("requests", 42)
+	labeled.Labels = repository.Labels{"host": "a", "method": "GET"}
+	histogram := repository.NewHistogram("latency", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(3)
+	return []repository.Metric{gauge("Alloc", 1.25), counter("PollCount", -3), labeled, *histogram}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, name := range []string{FormatJSON, FormatNDJSON, FormatGzip, FormatBinary} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := CodecByName(name)
+			require.NoError(t, err)
+			assert.Equal(t, name, codec.Name())
+
+			var buf bytes.Buffer
+			require.NoError(t, codec.Encode(&buf, snapshotMetrics()))
+
+			// формат определяется по содержимому
+			decoded, err := decodeSnapshot(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, snapshotMetrics(), decoded)
+
+			buf.Reset()
+			require.NoError(t, codec.Encode(&buf, nil))
+			decoded, err = decodeSnapshot(&buf)
+			require.NoError(t, err)
+			assert.Empty(t, decoded)
+		})
+	}
+
+	_, err := CodecByName("xml")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func TestDecodeInvalidSnapshot(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, BinaryCodec{}.Encode(&buf, snapshotMetrics()))
+	truncated := buf.Bytes()[:buf.Len()-4]
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "truncated binary", data: truncated},
+		{name: "garbage", data: []byte("metrics")},
+		{name: "broken json", data: []byte(`[{"id": "Alloc"`)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeSnapshot(bytes.NewReader(test.data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSwitchFormat(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	// снимок в старом формате читается после смены формата и перезаписывается в новом
+	storage, err := NewFileStorage(path, WithCodec(NDJSONCodec{}))
+	require.NoError(t, err)
+	repo := inmemory.NewInMemoryRepository()
+	_, err = repo.UpdateMetrics(ctx, snapshotMetrics())
+	require.NoError(t, err)
+	require.NoError(t, storage.WriteMetrics(repo))
+	require.NoError(t, storage.Close())
+
+	storage, err = NewFileStorage(path, WithCodec(BinaryCodec{}))
+	require.NoError(t, err)
+	restored := inmemory.NewInMemoryRepository()
+	require.NoError(t, storage.ReadAllMetrics(restored))
+	require.NoError(t, storage.WriteMetrics(restored))
+	require.NoError(t, storage.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, binaryMagic))
+
+	snapshot, err := readSnapshot(path, nil, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, snapshotMetrics(), snapshot)
+}
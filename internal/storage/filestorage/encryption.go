@@ -0,0 +1,189 @@
+package filestorage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/whynullname/go-collect-metrics/internal/envelope"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Зашифрованные снимок и записи журнала:
+//
+//	magic "MSENC" | version (1 байт) | длина id ключа (1 байт) | id ключа | nonce (12 байт) | шифротекст AES-256-GCM
+//
+// Заголовок целиком передается в AES-GCM как additional data. По magic зашифрованные данные отличаются
+// от открытых. При включенном шифровании открытые данные отклоняются, иначе подмененный открытый снимок
+// был бы принят молча; старые данные переводятся в шифрование один раз через WithPlaintextMigration.
+var encryptionMagic = []byte("MSENC")
+
+const (
+	EncryptionVersion1 = 1
+	snapshotKeySize    = 32
+	encryptionNonce    = 12
+	keyIDHashSize      = 8
+	// hkdfInfo отделяет ключ снимков от других ключей, которые могли бы выводиться из того же RSA ключа.
+	hkdfInfo = "metrics-snapshot-encryption"
+)
+
+var (
+	ErrInvalidKey            = errors.New("invalid snapshot key")
+	ErrUnknownKey            = errors.New("unknown snapshot key")
+	ErrInvalidEncryption     = errors.New("invalid encrypted snapshot")
+	ErrUnsupportedEncryption = errors.New("unsupported snapshot encryption version")
+	ErrPlaintext             = errors.New("unencrypted data while snapshot encryption is enabled")
+)
+
+// Key ключ AES-256 для шифрования снимков. ID записывается в заголовок, по нему выбирается ключ при чтении.
+type Key struct {
+	ID     string
+	secret []byte
+}
+
+// NewKey создает ключ из 32 байт.
+func NewKey(id string, secret []byte) (Key, error) {
+	if len(secret) != snapshotKeySize {
+		return Key{}, fmt.Errorf("%w: need %d bytes, got %d", ErrInvalidKey, snapshotKeySize, len(secret))
+	}
+	if id == "" || len(id) > 255 {
+		return Key{}, fmt.Errorf("%w: bad id %q", ErrInvalidKey, id)
+	}
+	return Key{ID: id, secret: append([]byte(nil), secret...)}, nil
+}
+
+// ReadKeyFiles читает ключи из списка файлов через запятую. Файл содержит 32 байта как есть, в hex или base64.
+// id ключа - начало SHA-256 от ключа, так что переименование файла не мешает расшифровке.
+func ReadKeyFiles(paths string) ([]Key, error) {
+	keys := make([]Key, 0)
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := parseKeyFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		sum := sha256.Sum256(secret)
+		key, err := NewKey("file-"+hex.EncodeToString(sum[:keyIDHashSize]), secret)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseKeyFile(data []byte) ([]byte, error) {
+	if len(data) == snapshotKeySize {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if secret, err := hex.DecodeString(text); err == nil && len(secret) == snapshotKeySize {
+		return secret, nil
+	}
+	if secret, err := base64.StdEncoding.DecodeString(text); err == nil && len(secret) == snapshotKeySize {
+		return secret, nil
+	}
+	return nil, fmt.Errorf("%w: need %d bytes as raw, hex or base64", ErrInvalidKey, snapshotKeySize)
+}
+
+// DeriveKey выводит ключ снимков из закрытого RSA ключа через HKDF-SHA256.
+// id совпадает с envelope.KeyID этого RSA ключа, так видно, какой файл ключа нужен для расшифровки.
+func DeriveKey(privateKey *rsa.PrivateKey) (Key, error) {
+	reader := hkdf.New(sha256.New, x509.MarshalPKCS1PrivateKey(privateKey), nil, []byte(hkdfInfo))
+	secret := make([]byte, snapshotKeySize)
+	if _, err := io.ReadFull(reader, secret); err != nil {
+		return Key{}, err
+	}
+	return NewKey("rsa-"+envelope.KeyID(&privateKey.PublicKey), secret)
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptionMagic)
+}
+
+// seal шифрует plaintext ключом key.
+func seal(key Key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(encryptionMagic)+2+len(key.ID)+encryptionNonce)
+	header = append(header, encryptionMagic...)
+	header = append(header, EncryptionVersion1, byte(len(key.ID)))
+	header = append(header, key.ID...)
+	nonce := make([]byte, encryptionNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+
+	return gcm.Seal(header, nonce, plaintext, header), nil
+}
+
+// open расшифровывает данные, созданные seal, ключом из keys с id из заголовка.
+func open(keys []Key, data []byte) ([]byte, error) {
+	if !isEncrypted(data) || len(data) < len(encryptionMagic)+2 {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidEncryption)
+	}
+
+	offset := len(encryptionMagic)
+	if version := data[offset]; version != EncryptionVersion1 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedEncryption, version)
+	}
+	idLength := int(data[offset+1])
+	offset += 2
+	if len(data) < offset+idLength+encryptionNonce {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidEncryption)
+	}
+	keyID := string(data[offset : offset+idLength])
+	offset += idLength
+	nonce := data[offset : offset+encryptionNonce]
+	offset += encryptionNonce
+
+	for _, key := range keys {
+		if key.ID != keyID {
+			continue
+		}
+
+		gcm, err := newGCM(key.secret)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := gcm.Open(nil, nonce, data[offset:], data[:offset])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidEncryption, err)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,176 @@
+package filestorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/envelope"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+)
+
+func newTestKey(t *testing.T, id string) Key {
+	secret := make([]byte, snapshotKeySize)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	key, err := NewKey(id, secret)
+	require.NoError(t, err)
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	key := newTestKey(t, "first")
+	sealed, err := seal(key, []byte("metrics"))
+	require.NoError(t, err)
+	assert.True(t, isEncrypted(sealed))
+
+	plaintext, err := open([]Key{newTestKey(t, "second"), key}, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("metrics"), plaintext)
+
+	_, err = open([]Key{newTestKey(t, "second")}, sealed)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	// заголовок защищен вместе с данными
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = open([]Key{key}, tampered)
+	assert.ErrorIs(t, err, ErrInvalidEncryption)
+
+	tampered = append([]byte(nil), sealed...)
+	tampered[len(encryptionMagic)+2] = 'F'
+	_, err = open([]Key{{ID: "First", secret: key.secret}}, tampered)
+	assert.ErrorIs(t, err, ErrInvalidEncryption)
+
+	tampered = append([]byte(nil), sealed...)
+	tampered[len(encryptionMagic)] = 2
+	_, err = open([]Key{key}, tampered)
+	assert.ErrorIs(t, err, ErrUnsupportedEncryption)
+
+	_, err = open([]Key{key}, sealed[:len(encryptionMagic)+4])
+	assert.ErrorIs(t, err, ErrInvalidEncryption)
+}
+
+func TestReadKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	secret := bytes.Repeat([]byte{7}, snapshotKeySize)
+	files := map[string][]byte{
+		"raw.key":    secret,
+		"hex.key":    []byte(hex.EncodeToString(secret) + "\n"),
+		"base64.key": []byte(base64.StdEncoding.EncodeToString(secret)),
+		"short.key":  []byte("0102"),
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0600))
+	}
+
+	keys, err := ReadKeyFiles(filepath.Join(dir, "raw.key") + ", " + filepath.Join(dir, "hex.key") + "," + filepath.Join(dir, "base64.key"))
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+	for _, key := range keys {
+		assert.Equal(t, keys[0].ID, key.ID)
+		assert.Equal(t, secret, key.secret)
+	}
+
+	_, err = ReadKeyFiles(filepath.Join(dir, "short.key"))
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = ReadKeyFiles(filepath.Join(dir, "missing.key"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDeriveKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	key, err := DeriveKey(privateKey)
+	require.NoError(t, err)
+	assert.Equal(t, "rsa-"+envelope.KeyID(&privateKey.PublicKey), key.ID)
+
+	again, err := DeriveKey(privateKey)
+	require.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	other, err := DeriveKey(otherKey)
+	require.NoError(t, err)
+	assert.NotEqual(t, key.secret, other.secret)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+	oldKey, newKey := newTestKey(t, "old"), newTestKey(t, "new")
+
+	// открытые снимок и журнал от версии без шифрования после его включения отклоняются
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id": "PollCount", "type": "counter", "delta": 1}]`), 0666))
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	_, err = storage.Journal(inmemory.NewInMemoryRepository()).UpdateMetrics(ctx, []repository.Metric{gauge("Alloc", 1)})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	storage, err = NewFileStorage(path, WithEncryption(oldKey))
+	require.NoError(t, err)
+	assert.ErrorIs(t, storage.ReadAllMetrics(inmemory.NewInMemoryRepository()), ErrPlaintext)
+	require.NoError(t, os.Rename(path, path+".plain"))
+	assert.ErrorIs(t, storage.ReadAllMetrics(inmemory.NewInMemoryRepository()), ErrPlaintext, "plaintext wal")
+	require.NoError(t, os.Rename(path+".plain", path))
+	require.NoError(t, storage.Close())
+
+	// и читаются только при явной миграции
+	storage, err = NewFileStorage(path, WithEncryption(oldKey), WithPlaintextMigration())
+	require.NoError(t, err)
+	inner := inmemory.NewInMemoryRepository()
+	require.NoError(t, storage.ReadAllMetrics(inner))
+	repo := storage.Journal(inner)
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 2), gauge("Alloc", 1)})
+	require.NoError(t, err)
+	require.NoError(t, storage.WriteMetrics(repo))
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 4)})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	// ни снимок, ни журнал не содержат метрик в открытом виде
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, isEncrypted(data))
+	assert.NotContains(t, string(data), "PollCount")
+	generations, err := walGenerations(path)
+	require.NoError(t, err)
+	for _, generation := range generations {
+		data, err := os.ReadFile(walPath(path, generation))
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "PollCount")
+	}
+
+	storage, err = NewFileStorage(path)
+	require.NoError(t, err)
+	assert.ErrorIs(t, storage.ReadAllMetrics(inmemory.NewInMemoryRepository()), ErrUnknownKey)
+	require.NoError(t, storage.Close())
+
+	// смена ключа: новый шифрует, старый остается для чтения
+	storage, err = NewFileStorage(path, WithEncryption(newKey, oldKey))
+	require.NoError(t, err)
+	restored := inmemory.NewInMemoryRepository()
+	require.NoError(t, storage.ReadAllMetrics(restored))
+	assert.Equal(t, int64(7), getMetric(t, restored, repository.CounterMetricKey, "PollCount").GetDelta())
+	assert.Equal(t, 1.0, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+	require.NoError(t, storage.WriteMetrics(restored))
+	require.NoError(t, storage.Close())
+
+	snapshot, err := readSnapshot(path, []Key{newKey}, false)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+}
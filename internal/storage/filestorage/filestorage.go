@@ -1,83 +1,427 @@
+// Пакет filestorage сохраняет метрики на диск: снимок всех метрик и журнал обновлений, сделанных после него.
+//
+// Снимок пишется во временный файл и атомарно переименовывается, поэтому падение во время записи
+// оставляет предыдущий снимок целым. При восстановлении к снимку применяются все оставшиеся поколения журнала.
 package filestorage
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
 )
 
 type FileStorage struct {
-	file    *os.File
-	encoder *json.Encoder
-	decoder *json.Decoder
-	scanner *bufio.Scanner
-	mx      sync.RWMutex
+	path         string
+	codec        Codec
+	keys         []Key
+	plaintext    bool
+	syncInterval time.Duration
+	backupCount  int
+	backupMaxAge time.Duration
+	// mx упорядочивает обновления репозитория, записи в журнал и смену поколения журнала при снимке.
+	mx         sync.Mutex
+	wal        *os.File
+	generation uint64
+	unsynced   bool
+	// snapshotMx не дает двум снимкам переименоваться в обратном порядке.
+	snapshotMx      sync.Mutex
+	staleWALRemoved bool
+	done            chan struct{}
+	closeOnce       sync.Once
+	closed          bool
 }
 
-func NewFileStorage(filePath string) (*FileStorage, error) {
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+var ErrClosed = errors.New("file storage is closed")
 
+// Option настраивает FileStorage.
+type Option func(*FileStorage)
+
+// WithCodec задает формат, в котором пишется снимок. Читается снимок в любом из поддерживаемых форматов.
+func WithCodec(codec Codec) Option {
+	return func(s *FileStorage) {
+		s.codec = codec
+	}
+}
+
+// WithEncryption шифрует снимок и журнал первым из keys. Остальные ключи нужны только для чтения
+// данных, записанных до смены ключа. Открытые снимок и журнал при этом не читаются, см. WithPlaintextMigration.
+func WithEncryption(keys ...Key) Option {
+	return func(s *FileStorage) {
+		s.keys = keys
+	}
+}
+
+// WithPlaintextMigration разрешает прочитать открытые снимок и журнал при включенном шифровании.
+// Нужна один раз при включении шифрования: после следующего снимка открытых данных не остается.
+func WithPlaintextMigration() Option {
+	return func(s *FileStorage) {
+		s.plaintext = true
+	}
+}
+
+// WithSyncInterval сбрасывает журнал на диск раз в interval вместо каждого батча.
+// Так быстрее, но при падении машины теряются обновления за последний interval.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(s *FileStorage) {
+		s.syncInterval = interval
+	}
+}
+
+func NewFileStorage(filePath string, opts ...Option) (*FileStorage, error) {
+	storage := &FileStorage{
+		path:  filePath,
+		codec: defaultCodec,
+		done:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	generations, err := walGenerations(filePath)
 	if err != nil {
 		return nil, err
 	}
+	if len(generations) > 0 {
+		storage.generation = generations[len(generations)-1]
+	}
+	// старые поколения не дописываются: их хвост мог остаться недописанным после падения
+	if err := storage.openGeneration(storage.generation + 1); err != nil {
+		return nil, err
+	}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return &FileStorage{
-		file:    file,
-		encoder: encoder,
-		decoder: json.NewDecoder(file),
-		scanner: bufio.NewScanner(file),
-	}, nil
+	if storage.syncInterval > 0 {
+		go storage.syncLoop()
+	}
+	return storage, nil
 }
 
+// openGeneration начинает новое поколение журнала. Вызывается под s.mx или до начала работы.
+func (s *FileStorage) openGeneration(generation uint64) error {
+	file, err := os.OpenFile(walPath(s.path, generation), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	if s.wal != nil {
+		if err := s.closeWAL(); err != nil {
+			logger.Log.Errorf("Can't close wal generation %d: %v", s.generation, err)
+		}
+	}
+	s.wal, s.generation = file, generation
+	return nil
+}
+
+func (s *FileStorage) closeWAL() error {
+	err := s.wal.Sync()
+	if closeErr := s.wal.Close(); err == nil {
+		err = closeErr
+	}
+	s.unsynced = false
+	return err
+}
+
+// appendWAL записывает метрики в журнал. Вызывается под s.mx.
+func (s *FileStorage) appendWAL(metrics []repository.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if s.closed {
+		return ErrClosed
+	}
+	if err := appendWALRecord(s.wal, metrics, s.keys); err != nil {
+		return err
+	}
+
+	if s.syncInterval > 0 {
+		s.unsynced = true
+		return nil
+	}
+	return s.wal.Sync()
+}
+
+func (s *FileStorage) syncLoop() {
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mx.Lock()
+			if s.unsynced {
+				if err := s.wal.Sync(); err != nil {
+					logger.Log.Errorf("Can't sync wal: %v", err)
+				} else {
+					s.unsynced = false
+				}
+			}
+			s.mx.Unlock()
+		}
+	}
+}
+
+// RecordMetric сохраняет снимок раз в interval секунд, пока хранилище не закрыто.
+// При interval 0 снимки пишет обертка Synchronous после каждого обновления, и RecordMetric сразу возвращается.
 func (s *FileStorage) RecordMetric(interval uint64, repo repository.Repository) {
-	defer s.file.Close()
+	if interval == 0 {
+		return
+	}
+
 	duration := time.Duration(interval) * time.Second
 	ticker := time.NewTicker(duration)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		s.WriteMetrics(repo)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.WriteMetrics(repo); err != nil {
+				logger.Log.Errorf("Can't write metrics snapshot: %v", err)
+			}
+		}
 	}
 }
 
+// WriteMetrics сохраняет снимок всех метрик и удаляет поколения журнала, которые в него вошли.
 func (s *FileStorage) WriteMetrics(repo repository.Repository) error {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
-	gaugeMetrics, err := repo.GetAllMetricsByType(context.TODO(), repository.GaugeMetricKey)
+	_, err := s.Snapshot(repo)
+	return err
+}
+
+// Snapshot сохраняет снимок как WriteMetrics и возвращает его копию. Без WithBackups возвращается сам файл снимка.
+// Метрики читаются под той же блокировкой, под которой пишется журнал, и в этот момент начинается новое поколение,
+// так что в снимок попадают ровно обновления из закрытых поколений.
+func (s *FileStorage) Snapshot(repo repository.Repository) (Backup, error) {
+	s.snapshotMx.Lock()
+	defer s.snapshotMx.Unlock()
+
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return Backup{}, ErrClosed
+	}
+	at := time.Now()
+	outputMetrics, err := collectMetrics(repo)
+	if err != nil {
+		s.mx.Unlock()
+		return Backup{}, err
+	}
+	covered := s.generation
+	err = s.openGeneration(covered + 1)
+	s.mx.Unlock()
+	if err != nil {
+		return Backup{}, err
+	}
+
+	if err := s.writeFile(s.path, outputMetrics); err != nil {
+		return Backup{}, err
+	}
+	if err := s.removeGenerations(covered); err != nil {
+		return Backup{}, err
+	}
+
+	if !s.backupsEnabled() {
+		return Backup{Path: s.path, Time: at.UTC()}, nil
+	}
+	return s.backup(at)
+}
+
+func collectMetrics(repo repository.Repository) ([]repository.Metric, error) {
+	outputMetrics := make([]repository.Metric, 0)
+	for _, metricType := range repository.MetricTypes {
+		metrics, err := repo.GetAllMetricsByType(context.TODO(), metricType)
+		if err != nil {
+			return nil, err
+		}
+		outputMetrics = append(outputMetrics, metrics...)
+	}
+	return outputMetrics, nil
+}
+
+// writeFile пишет снимок во временный файл, сбрасывает его на диск и атомарно заменяет им файл path.
+func (s *FileStorage) writeFile(path string, metrics []repository.Metric) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
-	counterMetrics, err := repo.GetAllMetricsByType(context.TODO(), repository.CounterMetricKey)
+
+	err = s.encode(file, metrics)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
 
-	outputMetrics := append(gaugeMetrics, counterMetrics...)
-	s.file.Seek(0, 0)
-	s.file.Truncate(0)
-	defer s.file.Sync()
-	return s.encoder.Encode(&outputMetrics)
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
 }
 
-func (s *FileStorage) ReadAllMetrics(repo repository.Repository) error {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
-	savedMetrics := make([]repository.Metric, 0)
-	err := s.decoder.Decode(&savedMetrics)
+// encode пишет снимок в формате s.codec. Зашифрованный снимок сначала целиком кодируется в памяти:
+// AES-GCM проверяет целостность всего шифротекста сразу.
+func (s *FileStorage) encode(w io.Writer, metrics []repository.Metric) error {
+	if len(s.keys) == 0 {
+		return s.codec.Encode(w, metrics)
+	}
+
+	var buf bytes.Buffer
+	if err := s.codec.Encode(&buf, metrics); err != nil {
+		return err
+	}
+	sealed, err := seal(s.keys[0], buf.Bytes())
 	if err != nil {
 		return err
 	}
+	_, err = w.Write(sealed)
+	return err
+}
 
-	for _, metric := range savedMetrics {
-		repo.UpdateMetric(context.TODO(), &metric)
+// removeGenerations удаляет поколения журнала с номером не больше upTo.
+func (s *FileStorage) removeGenerations(upTo uint64) error {
+	generations, err := walGenerations(s.path)
+	if err != nil {
+		return err
 	}
 
+	for _, generation := range generations {
+		if generation > upTo {
+			break
+		}
+		if err := os.Remove(walPath(s.path, generation)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
 	return nil
 }
+
+// syncDir сбрасывает на диск директорию файла path, чтобы создание и переименование файлов пережили падение.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// ReadAllMetrics восстанавливает метрики из снимка и всех поколений журнала и записывает их в repo.
+// repo должен быть исходным репозиторием, а не оберткой Journal, иначе восстановленные метрики попадут в журнал повторно.
+func (s *FileStorage) ReadAllMetrics(repo repository.Repository) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	savedMetrics, err := s.readState()
+	if err != nil || len(savedMetrics) == 0 {
+		return err
+	}
+	_, err = repo.UpdateMetrics(context.TODO(), savedMetrics)
+	return err
+}
+
+// readState читает снимок и применяет к нему все поколения журнала. Вызывается под s.mx.
+func (s *FileStorage) readState() ([]repository.Metric, error) {
+	savedMetrics, err := readSnapshot(s.path, s.keys, s.plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	// журнал хранит итоговые значения, поэтому каждая запись заменяет состояние метрики целиком
+	state := make(map[string]int, len(savedMetrics))
+	for i := range savedMetrics {
+		state[stateKey(&savedMetrics[i])] = i
+	}
+	apply := func(metrics []repository.Metric) {
+		for _, metric := range metrics {
+			key := stateKey(&metric)
+			if i, ok := state[key]; ok {
+				savedMetrics[i] = metric
+				continue
+			}
+			state[key] = len(savedMetrics)
+			savedMetrics = append(savedMetrics, metric)
+		}
+	}
+
+	generations, err := walGenerations(s.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, generation := range generations {
+		if err := readWAL(walPath(s.path, generation), s.keys, s.plaintext, apply); err != nil {
+			return nil, err
+		}
+	}
+	return savedMetrics, nil
+}
+
+func stateKey(metric *repository.Metric) string {
+	return metric.MType + ":" + metric.Key()
+}
+
+// readSnapshot читает снимок, зашифрованный снимок расшифровывается ключами keys.
+// Если keys не пуст, открытый снимок читается только при allowPlaintext.
+// Отсутствующий или пустой файл означает, что снимка еще нет.
+func readSnapshot(path string, keys []Key, allowPlaintext bool) ([]repository.Metric, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return make([]repository.Metric, 0), nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if header, _ := reader.Peek(len(encryptionMagic)); !isEncrypted(header) {
+		if len(header) > 0 && len(keys) > 0 && !allowPlaintext {
+			return nil, fmt.Errorf("snapshot %s: %w", path, ErrPlaintext)
+		}
+		return decodeSnapshot(reader)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(keys, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(bytes.NewReader(plaintext))
+}
+
+// Close сбрасывает журнал на диск и закрывает его. После Close обновления через Journal и снимки возвращают ErrClosed.
+func (s *FileStorage) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		s.closed = true
+		err = s.closeWAL()
+	})
+	return err
+}
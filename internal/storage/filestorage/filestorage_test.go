@@ -0,0 +1,195 @@
+package filestorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
+)
+
+func counter(id string, delta int64) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.CounterMetricKey, Delta: &delta}
+}
+
+func gauge(id string, value float64) repository.Metric {
+	return repository.Metric{ID: id, MType: repository.GaugeMetricKey, Value: &value}
+}
+
+// restore открывает хранилище заново, как после перезапуска, и восстанавливает метрики в пустой репозиторий.
+func restore(t *testing.T, path string) *inmemory.InMemoryRepo {
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	repo := inmemory.NewInMemoryRepository()
+	require.NoError(t, storage.ReadAllMetrics(repo))
+	return repo
+}
+
+func getMetric(t *testing.T, repo repository.Repository, metricType, id string) *repository.Metric {
+	metric, err := repo.GetMetric(context.Background(), id, metricType, nil)
+	require.NoError(t, err)
+	return metric
+}
+
+func TestRecoverFromWAL(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	repo := storage.Journal(inmemory.NewInMemoryRepository())
+
+	poll := counter("PollCount", 2)
+	_, err = repo.UpdateMetric(ctx, &poll)
+	require.NoError(t, err)
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 3), gauge("Alloc", 1)})
+	require.NoError(t, err)
+	require.NoError(t, storage.WriteMetrics(repo))
+
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 4), gauge("Alloc", 2)})
+	require.NoError(t, err)
+	// падение без закрытия: снимок содержит PollCount=5, остальное есть только в журнале
+
+	restored := restore(t, path)
+	assert.Equal(t, int64(9), getMetric(t, restored, repository.CounterMetricKey, "PollCount").GetDelta())
+	assert.Equal(t, 2.0, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+
+	// вошедшее в снимок поколение 1 удалено, 3 открыто при восстановлении
+	generations, err := walGenerations(path)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 3}, generations)
+}
+
+func TestRecoverTwice(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	repo := storage.Journal(inmemory.NewInMemoryRepository())
+	_, err = repo.UpdateMetrics(context.Background(), []repository.Metric{counter("PollCount", 2), counter("PollCount", 3)})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	// записи журнала хранят итоговые значения, повторное восстановление не удваивает counter
+	restore(t, path)
+	restored := restore(t, path)
+	assert.Equal(t, int64(5), getMetric(t, restored, repository.CounterMetricKey, "PollCount").GetDelta())
+}
+
+func TestTruncatedWAL(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	repo := storage.Journal(inmemory.NewInMemoryRepository())
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 1)})
+	require.NoError(t, err)
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 1)})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	// падение посреди записи последнего батча
+	wal := walPath(path, 1)
+	info, err := os.Stat(wal)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(wal, info.Size()-3))
+
+	restored := restore(t, path)
+	assert.Equal(t, int64(1), getMetric(t, restored, repository.CounterMetricKey, "PollCount").GetDelta())
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	legacy := `[{"id": "PollCount", "type": "counter", "delta": 7}, {"id": "Alloc", "type": "gauge", "value": 1.5}]`
+	require.NoError(t, os.WriteFile(path, []byte(legacy), 0666))
+
+	restored := restore(t, path)
+	assert.Equal(t, int64(7), getMetric(t, restored, repository.CounterMetricKey, "PollCount").GetDelta())
+	assert.Equal(t, 1.5, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+
+	// пустой файл от старых версий означает, что снимка нет
+	require.NoError(t, os.WriteFile(path, nil, 0666))
+	restore(t, path)
+}
+
+func TestJournalUpdateMetricsOnce(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	repo := storage.Journal(inmemory.NewInMemoryRepository())
+	_, err = repo.UpdateMetricsOnce(ctx, "first", []repository.Metric{counter("PollCount", 2)})
+	require.NoError(t, err)
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 3)})
+	require.NoError(t, err)
+	// повтор возвращает старый ответ PollCount=2, но в журнал попадает текущее значение
+	output, err := repo.UpdateMetricsOnce(ctx, "first", []repository.Metric{counter("PollCount", 2)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), output[0].GetDelta())
+	require.NoError(t, storage.Close())
+
+	restored := restore(t, path)
+	assert.Equal(t, int64(5), getMetric(t, restored, repository.CounterMetricKey, "PollCount").GetDelta())
+}
+
+func TestSynchronous(t *testing.T) {
+	logger.Initialize("info")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	// журнал от прежнего запуска с интервалом, его значения старше снимков этого запуска
+	stale, err := os.OpenFile(walPath(path, 1), os.O_WRONLY|os.O_CREATE, 0666)
+	require.NoError(t, err)
+	require.NoError(t, appendWALRecord(stale, []repository.Metric{counter("PollCount", 100)}, nil))
+	require.NoError(t, stale.Close())
+
+	storage, err := NewFileStorage(path)
+	require.NoError(t, err)
+	repo := storage.Synchronous(inmemory.NewInMemoryRepository())
+
+	// при интервале 0 фоновая запись не запускается
+	storage.RecordMetric(0, repo)
+
+	poll := counter("PollCount", 2)
+	_, err = repo.UpdateMetric(ctx, &poll)
+	require.NoError(t, err)
+	snapshot, err := readSnapshot(path, nil, false)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, int64(2), snapshot[0].GetDelta())
+
+	_, err = repo.UpdateMetrics(ctx, []repository.Metric{counter("PollCount", 3), gauge("Alloc", 1)})
+	require.NoError(t, err)
+	_, err = repo.UpdateMetricsOnce(ctx, "key", []repository.Metric{gauge("Alloc", 4)})
+	require.NoError(t, err)
+	snapshot, err = readSnapshot(path, nil, false)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+
+	// снимок после обновления не сменяет поколения журнала
+	generations, err := walGenerations(path)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, generations)
+
+	require.NoError(t, storage.Close())
+	_, err = repo.UpdateMetric(ctx, &poll)
+	assert.ErrorIs(t, err, ErrClosed)
+
+	restored := restore(t, path)
+	assert.Equal(t, int64(5), getMetric(t, restored, repository.CounterMetricKey, "PollCount").GetDelta())
+	assert.Equal(t, 4.0, getMetric(t, restored, repository.GaugeMetricKey, "Alloc").GetValue())
+}
@@ -0,0 +1,81 @@
+package filestorage
+
+import (
+	"context"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// journaledRepository записывает в журнал FileStorage состояние метрик после каждого успешного обновления.
+// Остальные методы вызываются у исходного репозитория без изменений.
+type journaledRepository struct {
+	repository.Repository
+	storage *FileStorage
+}
+
+// Journal оборачивает repo так, что результат каждого обновления попадает в журнал до ответа клиенту.
+// Обновление и запись в журнал идут под одной блокировкой, иначе порядок записей мог бы не совпасть
+// с порядком изменений и восстановление вернуло бы старое значение.
+func (s *FileStorage) Journal(repo repository.Repository) repository.Repository {
+	return &journaledRepository{Repository: repo, storage: s}
+}
+
+func (r *journaledRepository) UpdateMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
+	r.storage.mx.Lock()
+	defer r.storage.mx.Unlock()
+
+	output, err := r.Repository.UpdateMetric(ctx, metric)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storage.appendWAL([]repository.Metric{*output}); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (r *journaledRepository) UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
+	r.storage.mx.Lock()
+	defer r.storage.mx.Unlock()
+
+	output, err := r.Repository.UpdateMetrics(ctx, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storage.appendWAL(output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// UpdateMetricsOnce при повторе ключа возвращает сохраненный результат первой попытки, он может быть старше
+// текущих значений. Поэтому в журнал пишется текущее состояние затронутых метрик, а не ответ.
+func (r *journaledRepository) UpdateMetricsOnce(ctx context.Context, key string, metrics []repository.Metric) ([]repository.Metric, error) {
+	r.storage.mx.Lock()
+	defer r.storage.mx.Unlock()
+
+	output, err := r.Repository.UpdateMetricsOnce(ctx, key, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make([]repository.Metric, 0, len(metrics))
+	seen := make(map[string]struct{}, len(metrics))
+	for i := range metrics {
+		metricKey := stateKey(&metrics[i])
+		if _, ok := seen[metricKey]; ok {
+			continue
+		}
+		seen[metricKey] = struct{}{}
+
+		saved, err := r.Repository.GetMetric(ctx, metrics[i].ID, metrics[i].MType, metrics[i].Labels)
+		if err != nil {
+			return nil, err
+		}
+		current = append(current, *saved)
+	}
+	if err := r.storage.appendWAL(current); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
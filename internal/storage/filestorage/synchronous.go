@@ -0,0 +1,85 @@
+package filestorage
+
+import (
+	"context"
+
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// writeCurrent сохраняет снимок для Synchronous. Поколения журнала от прежнего запуска с интервалом
+// уже вошли в восстановленное состояние и удаляются после первого снимка, иначе следующий запуск
+// применил бы их поверх более нового снимка.
+func (s *FileStorage) writeCurrent(repo repository.Repository) error {
+	s.snapshotMx.Lock()
+	defer s.snapshotMx.Unlock()
+
+	s.mx.Lock()
+	closed, generation := s.closed, s.generation
+	s.mx.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	outputMetrics, err := collectMetrics(repo)
+	if err != nil {
+		return err
+	}
+	if err := s.writeFile(s.path, outputMetrics); err != nil {
+		return err
+	}
+	if s.staleWALRemoved {
+		return nil
+	}
+	if err := s.removeGenerations(generation - 1); err != nil {
+		return err
+	}
+	s.staleWALRemoved = true
+	return nil
+}
+
+// synchronousRepository сохраняет снимок после каждого успешного обновления, как требует STORE_INTERVAL=0.
+type synchronousRepository struct {
+	repository.Repository
+	storage *FileStorage
+}
+
+// Synchronous оборачивает repo так, что обновление возвращается только после записи снимка на диск.
+// Если снимок записать не удалось, возвращается ошибка, хотя само обновление уже применено.
+// Журнал в этом режиме не пишется, поэтому снимок после обновления только атомарно заменяет прежний,
+// без смены поколений журнала и без копий.
+func (s *FileStorage) Synchronous(repo repository.Repository) repository.Repository {
+	return &synchronousRepository{Repository: repo, storage: s}
+}
+
+func (r *synchronousRepository) UpdateMetric(ctx context.Context, metric *repository.Metric) (*repository.Metric, error) {
+	output, err := r.Repository.UpdateMetric(ctx, metric)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storage.writeCurrent(r.Repository); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (r *synchronousRepository) UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
+	output, err := r.Repository.UpdateMetrics(ctx, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storage.writeCurrent(r.Repository); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (r *synchronousRepository) UpdateMetricsOnce(ctx context.Context, key string, metrics []repository.Metric) ([]repository.Metric, error) {
+	output, err := r.Repository.UpdateMetricsOnce(ctx, key, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.storage.writeCurrent(r.Repository); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
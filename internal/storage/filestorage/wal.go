@@ -0,0 +1,140 @@
+package filestorage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// Журнал (WAL) хранится рядом со снимком в файлах-поколениях <snapshot>.wal.<номер>.
+// Каждая запись - длина данных, CRC32 и JSON массив метрик в том состоянии, которое получилось после обновления.
+// При включенном шифровании JSON записи шифруется так же, как снимок.
+// Записи хранят итоговые значения, а не приращения, поэтому повторное применение записи ничего не меняет.
+const (
+	walExt        = ".wal."
+	walHeaderSize = 8
+	maxWALRecord  = 64 << 20
+)
+
+var ErrWALRecordTooLarge = errors.New("wal record too large")
+
+// walGenerations возвращает номера поколений журнала для снимка path по возрастанию.
+func walGenerations(path string) ([]uint64, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(path) + walExt
+	generations := make([]uint64, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		generation, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i] < generations[j]
+	})
+	return generations, nil
+}
+
+func walPath(path string, generation uint64) string {
+	return fmt.Sprintf("%s%s%020d", path, walExt, generation)
+}
+
+// appendWALRecord дописывает в журнал одну запись с метриками. Если keys не пуст, запись шифруется первым ключом.
+func appendWALRecord(file *os.File, metrics []repository.Metric, keys []Key) error {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		if data, err = seal(keys[0], data); err != nil {
+			return err
+		}
+	}
+	if len(data) > maxWALRecord {
+		return ErrWALRecordTooLarge
+	}
+
+	record := make([]byte, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[walHeaderSize:], data)
+
+	_, err = file.Write(record)
+	return err
+}
+
+// readWAL по порядку передает в apply метрики из записей поколения.
+// Недописанная или испорченная запись в конце - след падения во время записи, она и все после нее пропускаются.
+// Запись, которую не удалось расшифровать ключами keys, - ошибка настройки, а не падения, поэтому возвращается ошибка.
+// Так же, если keys не пуст, открытая запись без allowPlaintext.
+func readWAL(path string, keys []Key, allowPlaintext bool, apply func(metrics []repository.Metric)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Log.Warnf("Truncated record in wal %s, skip the rest", path)
+			}
+			return nil
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxWALRecord {
+			logger.Log.Warnf("Corrupted record in wal %s, skip the rest", path)
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			logger.Log.Warnf("Truncated record in wal %s, skip the rest", path)
+			return nil
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			logger.Log.Warnf("Corrupted record in wal %s, skip the rest", path)
+			return nil
+		}
+		if isEncrypted(data) {
+			if data, err = open(keys, data); err != nil {
+				return fmt.Errorf("wal %s: %w", path, err)
+			}
+		} else if len(keys) > 0 && !allowPlaintext {
+			return fmt.Errorf("wal %s: %w", path, ErrPlaintext)
+		}
+
+		var metrics []repository.Metric
+		if err := json.Unmarshal(data, &metrics); err != nil {
+			logger.Log.Warnf("Can't decode record in wal %s, skip the rest: %v", path, err)
+			return nil
+		}
+		apply(metrics)
+	}
+}
@@ -3,29 +3,51 @@ package metrics
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
 
+	"github.com/whynullname/go-collect-metrics/internal/logger"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
 	"github.com/whynullname/go-collect-metrics/internal/repository/types"
 )
 
 type MetricsUseCase struct {
-	repository repository.Repository
+	repository       repository.Repository
+	histogramBuckets []float64
 }
 
-func NewMetricUseCase(repository repository.Repository) *MetricsUseCase {
-	return &MetricsUseCase{
-		repository: repository,
+// Option настраивает MetricsUseCase.
+type Option func(*MetricsUseCase)
+
+// WithHistogramBuckets задает границы бакетов для новых гистограмм, которые создаются из одиночных наблюдений.
+func WithHistogramBuckets(buckets []float64) Option {
+	return func(m *MetricsUseCase) {
+		m.histogramBuckets = buckets
+	}
+}
+
+func NewMetricUseCase(repo repository.Repository, opts ...Option) *MetricsUseCase {
+	useCase := &MetricsUseCase{
+		repository:       repo,
+		histogramBuckets: repository.DefaultHistogramBuckets,
+	}
+	for _, opt := range opts {
+		opt(useCase)
 	}
+	return useCase
 }
 
 // UpdateMetric обновить метрику в репозитории.
 func (m *MetricsUseCase) UpdateMetric(ctx context.Context, json *repository.Metric) (*repository.Metric, error) {
-	if json == nil || (json.Delta == nil && json.Value == nil) {
+	if json == nil {
 		return nil, types.ErrMetricNilValue
 	}
 
-	if json.MType != repository.CounterMetricKey && json.MType != repository.GaugeMetricKey {
-		return nil, types.ErrUnsupportedMetricType
+	json.Labels = json.Labels.Normalize()
+	if err := validateMetric(json); err != nil {
+		return nil, err
 	}
 
 	return m.repository.UpdateMetric(ctx, json)
@@ -33,25 +55,216 @@ func (m *MetricsUseCase) UpdateMetric(ctx context.Context, json *repository.Metr
 
 // UpdateMetrics обновить массив метрик в репозитории.
 func (m *MetricsUseCase) UpdateMetrics(ctx context.Context, metrics []repository.Metric) ([]repository.Metric, error) {
-	for _, metric := range metrics {
-		if metric.Delta == nil && metric.Value == nil {
-			return nil, types.ErrMetricNilValue
+	for i := range metrics {
+		metrics[i].Labels = metrics[i].Labels.Normalize()
+		if err := validateMetric(&metrics[i]); err != nil {
+			return nil, err
 		}
+	}
+
+	return m.repository.UpdateMetrics(ctx, metrics)
+}
+
+// maxIdempotencyKeyLength ограничивает длину ключа идемпотентности.
+const maxIdempotencyKeyLength = 128
+
+// UpdateMetricsOnce обновить массив метрик не больше одного раза для ключа идемпотентности.
+// Повтор с тем же ключом возвращает результат первого применения, counter не увеличивается повторно.
+// Пустой ключ равносилен вызову UpdateMetrics.
+func (m *MetricsUseCase) UpdateMetricsOnce(ctx context.Context, key string, metrics []repository.Metric) ([]repository.Metric, error) {
+	if key == "" {
+		return m.UpdateMetrics(ctx, metrics)
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, types.ErrInvalidIdempotencyKey
+	}
 
-		if metric.MType != repository.CounterMetricKey && metric.MType != repository.GaugeMetricKey {
-			return nil, types.ErrUnsupportedMetricType
+	for i := range metrics {
+		metrics[i].Labels = metrics[i].Labels.Normalize()
+		if err := validateMetric(&metrics[i]); err != nil {
+			return nil, err
 		}
 	}
 
-	return m.repository.UpdateMetrics(ctx, metrics)
+	return m.repository.UpdateMetricsOnce(ctx, key, metrics)
+}
+
+// ObserveHistogram добавить одно наблюдение в гистограмму.
+// Если гистограммы еще нет, она создается с границами бакетов по умолчанию.
+func (m *MetricsUseCase) ObserveHistogram(ctx context.Context, metricName string, labels repository.Labels, value float64) (*repository.Metric, error) {
+	if !isFinite(value) {
+		return nil, types.ErrNonFiniteValue
+	}
+	labels = labels.Normalize()
+	if err := labels.Validate(); err != nil {
+		return nil, err
+	}
+
+	buckets := m.histogramBuckets
+	saved, err := m.repository.GetMetric(ctx, metricName, repository.HistogramMetricKey, labels)
+	if err == nil {
+		buckets = saved.Buckets
+	} else if !errors.Is(err, types.ErrCantFindMetric) {
+		return nil, err
+	}
+
+	histogram := repository.NewHistogram(metricName, buckets)
+	histogram.Labels = labels
+	histogram.Observe(value)
+	return m.repository.UpdateMetric(ctx, histogram)
 }
 
 // GetMetric получить метрику по типу и имени.
 func (m *MetricsUseCase) GetMetric(ctx context.Context, metricType string, metricName string) (*repository.Metric, error) {
-	return m.repository.GetMetric(ctx, metricName, metricType)
+	return m.repository.GetMetric(ctx, metricName, metricType, nil)
+}
+
+// GetMetricWithLabels получить метрику по типу, имени и меткам.
+func (m *MetricsUseCase) GetMetricWithLabels(ctx context.Context, metricType string, metricName string, labels repository.Labels) (*repository.Metric, error) {
+	return m.repository.GetMetric(ctx, metricName, metricType, labels.Normalize())
 }
 
 // GetAllMetricsByType получить слайс метрик по типу.
 func (m *MetricsUseCase) GetAllMetricsByType(ctx context.Context, metricType string) ([]repository.Metric, error) {
 	return m.repository.GetAllMetricsByType(ctx, metricType)
 }
+
+// GetAllMetrics получить метрики всех типов.
+func (m *MetricsUseCase) GetAllMetrics(ctx context.Context) ([]repository.Metric, error) {
+	output := make([]repository.Metric, 0)
+	for _, metricType := range repository.MetricTypes {
+		metrics, err := m.repository.GetAllMetricsByType(ctx, metricType)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, metrics...)
+	}
+	return output, nil
+}
+
+// GetAllMetricsByLabels получить метрики всех типов, метки которых содержат selector.
+func (m *MetricsUseCase) GetAllMetricsByLabels(ctx context.Context, selector repository.Labels) ([]repository.Metric, error) {
+	metrics, err := m.GetAllMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return repository.FilterByLabels(metrics, selector.Normalize()), nil
+}
+
+const (
+	// maxRangePoints ограничивает число точек в ответе QueryRange.
+	maxRangePoints = 11000
+	// rangeLookback на сколько назад от точки ищется последнее известное значение.
+	rangeLookback = 5 * time.Minute
+)
+
+// QueryRange получить значения метрики за период [from, to] с шагом step.
+// Для каждой точки берется последнее значение, сохраненное не раньше чем за rangeLookback до нее.
+// Точки, для которых значений нет, пропускаются.
+func (m *MetricsUseCase) QueryRange(ctx context.Context, metricType, metricName string, labels repository.Labels,
+	from, to time.Time, step time.Duration) ([]repository.Sample, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("%w: step must be positive", types.ErrInvalidRangeQuery)
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("%w: end is before start", types.ErrInvalidRangeQuery)
+	}
+	if to.Sub(from)/step >= maxRangePoints {
+		return nil, fmt.Errorf("%w: more than %d points requested", types.ErrInvalidRangeQuery, maxRangePoints)
+	}
+
+	samples, err := m.repository.GetMetricHistory(ctx, metricName, metricType, labels.Normalize(), from.Add(-rangeLookback), to)
+	if err != nil {
+		return nil, err
+	}
+
+	return alignSamples(samples, from, to, step, rangeLookback), nil
+}
+
+// alignSamples приводит отсортированные по времени значения к сетке from, from+step, ..., to.
+func alignSamples(samples []repository.Sample, from, to time.Time, step, lookback time.Duration) []repository.Sample {
+	output := make([]repository.Sample, 0)
+	index := -1
+	for point := from; !point.After(to); point = point.Add(step) {
+		for index+1 < len(samples) && !samples[index+1].Timestamp.After(point) {
+			index++
+		}
+		if index < 0 || point.Sub(samples[index].Timestamp) > lookback {
+			continue
+		}
+
+		output = append(output, repository.Sample{
+			Timestamp: point,
+			Value:     samples[index].Value,
+		})
+	}
+	return output
+}
+
+// RunHistoryRetention горутина, которая каждые interval удаляет из истории значения старше retention.
+func (m *MetricsUseCase) RunHistoryRetention(ctx context.Context, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.repository.DeleteHistoryBefore(ctx, time.Now().Add(-retention)); err != nil {
+				logger.Log.Errorf("Error while delete old history: %v", err)
+			}
+		}
+	}
+}
+
+// RunIdempotencyRetention горутина, которая каждые interval удаляет ключи идемпотентности старше ttl.
+func (m *MetricsUseCase) RunIdempotencyRetention(ctx context.Context, ttl time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.repository.DeleteIdempotencyKeysBefore(ctx, time.Now().Add(-ttl)); err != nil {
+				logger.Log.Errorf("Error while delete old idempotency keys: %v", err)
+			}
+		}
+	}
+}
+
+// isFinite сообщает, что значение не NaN и не ±Inf: такие значения ломают суммы и экспорт.
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+func validateMetric(metric *repository.Metric) error {
+	if err := metric.Labels.Validate(); err != nil {
+		return err
+	}
+
+	switch metric.MType {
+	case repository.GaugeMetricKey:
+		if metric.Value == nil {
+			return types.ErrMetricNilValue
+		}
+		if !isFinite(*metric.Value) {
+			return types.ErrNonFiniteValue
+		}
+	case repository.CounterMetricKey:
+		if metric.Delta == nil {
+			return types.ErrMetricNilValue
+		}
+	case repository.HistogramMetricKey:
+		return metric.ValidateHistogram()
+	default:
+		if metric.Delta == nil && metric.Value == nil {
+			return types.ErrMetricNilValue
+		}
+		return types.ErrUnsupportedMetricType
+	}
+
+	return nil
+}
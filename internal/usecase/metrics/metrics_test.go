@@ -3,11 +3,17 @@ package metrics
 import (
 	"context"
 	"log"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	config "github.com/whynullname/go-collect-metrics/internal/configs/serverconfig"
 	"github.com/whynullname/go-collect-metrics/internal/repository"
+	"github.com/whynullname/go-collect-metrics/internal/repository/inmemory"
 	"github.com/whynullname/go-collect-metrics/internal/repository/postgres"
+	"github.com/whynullname/go-collect-metrics/internal/repository/types"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
@@ -61,3 +67,132 @@ func BenchmarkMetricsUseCase(b *testing.B) {
 		}
 	})
 }
+
+func TestAlignSamples(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := []repository.Sample{
+		{Timestamp: start.Add(5 * time.Second), Value: 1},
+		{Timestamp: start.Add(12 * time.Second), Value: 2},
+		{Timestamp: start.Add(14 * time.Second), Value: 3},
+	}
+
+	aligned := alignSamples(samples, start, start.Add(40*time.Second), 10*time.Second, 15*time.Second)
+	assert.Equal(t, []repository.Sample{
+		{Timestamp: start.Add(10 * time.Second), Value: 1},
+		{Timestamp: start.Add(20 * time.Second), Value: 3},
+	}, aligned, "points at 30s and 40s are further than lookback from the last sample")
+}
+
+func TestQueryRange(t *testing.T) {
+	repo := inmemory.NewInMemoryRepository(inmemory.WithHistory())
+	useCase := NewMetricUseCase(repo)
+	labels := repository.Labels{"host": "a"}
+
+	from := time.Now()
+	for _, delta := range []int64{1, 2, 3} {
+		_, err := useCase.UpdateMetric(context.Background(), &repository.Metric{
+			ID: "PollCount", MType: repository.CounterMetricKey, Delta: &delta, Labels: labels,
+		})
+		require.NoError(t, err)
+	}
+	to := time.Now()
+
+	samples, err := useCase.QueryRange(context.Background(), repository.CounterMetricKey, "PollCount", labels, from, to, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, samples, 0, "the only point is before the first sample")
+
+	samples, err = useCase.QueryRange(context.Background(), repository.CounterMetricKey, "PollCount", labels, to, to, time.Second)
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+	assert.Equal(t, float64(6), samples[0].Value)
+
+	_, err = useCase.QueryRange(context.Background(), repository.CounterMetricKey, "PollCount", labels, to, from, time.Second)
+	assert.ErrorIs(t, err, types.ErrInvalidRangeQuery)
+	_, err = useCase.QueryRange(context.Background(), repository.CounterMetricKey, "PollCount", labels, from, from.Add(time.Hour), time.Millisecond)
+	assert.ErrorIs(t, err, types.ErrInvalidRangeQuery)
+	_, err = useCase.QueryRange(context.Background(), repository.HistogramMetricKey, "PollCount", labels, from, to, time.Second)
+	assert.ErrorIs(t, err, types.ErrUnsupportedMetricType)
+
+	require.NoError(t, repo.DeleteHistoryBefore(context.Background(), time.Now().Add(time.Second)))
+	samples, err = useCase.QueryRange(context.Background(), repository.CounterMetricKey, "PollCount", labels, to, to, time.Second)
+	require.NoError(t, err)
+	assert.Len(t, samples, 0)
+}
+
+func TestUpdateMetricsOnce(t *testing.T) {
+	repo := inmemory.NewInMemoryRepository()
+	useCase := NewMetricUseCase(repo)
+	delta := int64(5)
+	batch := func() []repository.Metric {
+		return []repository.Metric{{ID: "PollCount", MType: repository.CounterMetricKey, Delta: &delta}}
+	}
+
+	first, err := useCase.UpdateMetricsOnce(context.Background(), "batch-1", batch())
+	require.NoError(t, err)
+	retried, err := useCase.UpdateMetricsOnce(context.Background(), "batch-1", batch())
+	require.NoError(t, err)
+	assert.Equal(t, first, retried, "retry returns the original result")
+
+	saved, err := useCase.GetMetric(context.Background(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), saved.GetDelta())
+
+	_, err = useCase.UpdateMetricsOnce(context.Background(), "batch-2", batch())
+	require.NoError(t, err)
+	_, err = useCase.UpdateMetricsOnce(context.Background(), "", batch())
+	require.NoError(t, err)
+	saved, err = useCase.GetMetric(context.Background(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), saved.GetDelta())
+
+	// после удаления ключа батч применяется снова
+	require.NoError(t, repo.DeleteIdempotencyKeysBefore(context.Background(), time.Now().Add(time.Second)))
+	_, err = useCase.UpdateMetricsOnce(context.Background(), "batch-1", batch())
+	require.NoError(t, err)
+	saved, err = useCase.GetMetric(context.Background(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), saved.GetDelta())
+
+	_, err = useCase.UpdateMetricsOnce(context.Background(), strings.Repeat("k", maxIdempotencyKeyLength+1), batch())
+	assert.ErrorIs(t, err, types.ErrInvalidIdempotencyKey)
+
+	// батч с ошибкой в середине не применяется частично, и повтор с тем же ключом применяет его один раз
+	_, err = useCase.UpdateMetrics(context.Background(), []repository.Metric{*repository.NewHistogram("latency", []float64{1})})
+	require.NoError(t, err)
+	broken := append(batch(), *repository.NewHistogram("latency", []float64{1, 2}))
+	_, err = useCase.UpdateMetricsOnce(context.Background(), "batch-3", broken)
+	assert.ErrorIs(t, err, types.ErrHistogramBucketsMismatch)
+	saved, err = useCase.GetMetric(context.Background(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), saved.GetDelta())
+
+	_, err = useCase.UpdateMetricsOnce(context.Background(), "batch-3", batch())
+	require.NoError(t, err)
+	_, err = useCase.UpdateMetricsOnce(context.Background(), "batch-3", batch())
+	require.NoError(t, err)
+	saved, err = useCase.GetMetric(context.Background(), repository.CounterMetricKey, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(25), saved.GetDelta())
+}
+
+func TestCounterDeltas(t *testing.T) {
+	previous := make(map[string]int64)
+	total := func(value int64) []repository.Metric {
+		gauge := float64(value)
+		return []repository.Metric{
+			{ID: "db_pool_acquire_total", MType: repository.CounterMetricKey, Delta: &value},
+			{ID: "db_pool_total_conns", MType: repository.GaugeMetricKey, Value: &gauge},
+		}
+	}
+
+	metrics := counterDeltas(total(5), previous)
+	assert.Equal(t, int64(5), metrics[0].GetDelta())
+	assert.Equal(t, 5.0, metrics[1].GetValue())
+
+	metrics = counterDeltas(total(8), previous)
+	assert.Equal(t, int64(3), metrics[0].GetDelta())
+
+	// счетчик начался заново
+	metrics = counterDeltas(total(2), previous)
+	assert.Equal(t, int64(2), metrics[0].GetDelta())
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/whynullname/go-collect-metrics/internal/logger"
+	"github.com/whynullname/go-collect-metrics/internal/repository"
+)
+
+// SelfMetricsSource возвращает собственные метрики сервера. Counter метрики содержат накопленные значения.
+type SelfMetricsSource func() []repository.Metric
+
+// RunSelfMetrics горутина, которая каждые interval сохраняет собственные метрики сервера в репозиторий.
+// Накопленные значения counter переводятся в приращения с прошлого сбора.
+func (m *MetricsUseCase) RunSelfMetrics(ctx context.Context, interval time.Duration, source SelfMetricsSource) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	previous := make(map[string]int64)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metrics := counterDeltas(source(), previous)
+			if _, err := m.repository.UpdateMetrics(ctx, metrics); err != nil {
+				logger.Log.Errorf("Error while save self metrics: %v", err)
+			}
+		}
+	}
+}
+
+// counterDeltas заменяет накопленные значения counter приращениями относительно previous и обновляет previous.
+// Если значение уменьшилось, источник начал счет заново и приращением считается само значение.
+func counterDeltas(metrics []repository.Metric, previous map[string]int64) []repository.Metric {
+	for i := range metrics {
+		if metrics[i].MType != repository.CounterMetricKey {
+			continue
+		}
+
+		key := metrics[i].Key()
+		total := metrics[i].GetDelta()
+		delta := total
+		if last, ok := previous[key]; ok && total >= last {
+			delta = total - last
+		}
+		previous[key] = total
+		metrics[i].Delta = &delta
+	}
+	return metrics
+}